@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/lanelewis/rclone-proxy/config"
+	"github.com/lanelewis/rclone-proxy/database"
+)
+
+// runBench simulates a burst of concurrent PUTs against the configured key
+// store and prints the throughput, e.g. `rclone-proxy bench -workers 200`.
+func runBench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	workers := flags.Int("workers", 100, "number of concurrent uploaders")
+	puts := flags.Int("puts", 5000, "total number of PUTs to simulate")
+	cfg, err := config.LoadFlags(flags, args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	database.SetKeyPepper(os.Getenv("KEY_PEPPER"))
+	database.SetTimeouts(cfg.Database.ConnectTimeout, cfg.Database.QueryTimeout)
+	db, err := database.OpenStore(cfg.Database.Driver, cfg.Database.URL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	result, err := database.SimulatePuts(context.Background(), db, *workers, *puts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("workers: %d\nputs: %d\nfailed: %d\nlost increments: %d\nelapsed: %s\nputs/sec: %.1f\n",
+		result.Workers, result.Puts, result.Failed, result.LostPuts, result.Elapsed, result.PerSecond)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/lanelewis/rclone-proxy/config"
+)
+
+// runConfig works with the configuration without starting the server, e.g.
+// `rclone-proxy config check -config exius.yaml` validates it and prints the
+// settings that would be used.
+func runConfig(args []string) {
+	if len(args) == 0 || args[0] != "check" {
+		log.Fatal("usage: config check [-config file] [flags]")
+	}
+	cfg, err := config.Load("config check", args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	err = cfg.Write(os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,432 @@
+// Package config loads the settings of the server. Every setting has a
+// default, which a YAML file can change, which an environment variable
+// overrides, which a command line flag overrides in turn. Secrets such as
+// ADMINKEY are only read from the environment, so they stay out of files
+// and process listings.
+package config
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lanelewis/rclone-proxy/filetype"
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv names the environment variable that can give the config file
+// instead of -config.
+const FileEnv = "CONFIG_FILE"
+
+type Config struct {
+	// Listen is the address the server listens on.
+	Listen  string  `yaml:"listen"`
+	Backend Backend `yaml:"backend"`
+	// ShutdownTimeout is how long requests in flight get to finish on
+	// shutdown.
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	// ExpiredKeySweep is how often expired keys are deleted.
+	ExpiredKeySweep time.Duration `yaml:"expiredKeySweep"`
+	Database        Database      `yaml:"database"`
+	CORS            CORS          `yaml:"cors"`
+	Log             Log           `yaml:"log"`
+	Metrics         Metrics       `yaml:"metrics"`
+	Webhooks        Webhooks      `yaml:"webhooks"`
+	// Types are file types added to the built in ones, for endpoints to
+	// name in PutTypes.
+	Types []Type `yaml:"types"`
+}
+
+// Backend are the rclone servers requests are proxied to.
+type Backend struct {
+	WebDAV string `yaml:"webdav"`
+	Admin  string `yaml:"admin"`
+}
+
+type Database struct {
+	// Driver is postgres, sqlite or memory.
+	Driver string `yaml:"driver"`
+	// URL is the postgres URL, or the file of the sqlite database.
+	URL string `yaml:"url"`
+	// ConnectTimeout is how long to wait for postgres to come up.
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	// QueryTimeout bounds each postgres query.
+	QueryTimeout time.Duration `yaml:"queryTimeout"`
+}
+
+// CORS is the cross origin policy, as understood by github.com/rs/cors.
+type CORS struct {
+	AllowedOrigins   []string `yaml:"allowedOrigins"`
+	AllowedMethods   []string `yaml:"allowedMethods"`
+	AllowedHeaders   []string `yaml:"allowedHeaders"`
+	ExposedHeaders   []string `yaml:"exposedHeaders"`
+	AllowCredentials bool     `yaml:"allowCredentials"`
+	// MaxAge is how many seconds browsers may cache a preflight response.
+	MaxAge int `yaml:"maxAge"`
+}
+
+type Log struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+type Metrics struct {
+	// Auth is who may read /metrics: admin, token or none. The token itself
+	// comes from METRICS_TOKEN.
+	Auth string `yaml:"auth"`
+}
+
+// Rules for who may scrape /metrics, set with metrics.auth or METRICS_AUTH.
+const (
+	MetricsAuthAdmin = "admin"
+	MetricsAuthToken = "token"
+	MetricsAuthNone  = "none"
+)
+
+type Webhooks struct {
+	// Enabled turns webhooks on. They are signed with WEBHOOK_SECRET, which
+	// must then be set.
+	Enabled bool `yaml:"enabled"`
+	// AllowedNetworks are CIDR blocks webhooks may reach although they are
+	// loopback, link-local or private. Other such addresses are refused.
+	AllowedNetworks []string `yaml:"allowedNetworks"`
+}
+
+// Type is a file type for the filetype registry.
+type Type struct {
+	Name string `yaml:"name"`
+	// Extensions the file name must end in, with the dot.
+	Extensions []string    `yaml:"extensions"`
+	Signatures []Signature `yaml:"signatures"`
+	// Text types match any utf-8 text.
+	Text bool `yaml:"text"`
+}
+
+// Signature is a run of magic bytes, in hex, at an offset from the start of
+// the file.
+type Signature struct {
+	Offset int    `yaml:"offset"`
+	Magic  string `yaml:"magic"`
+}
+
+// Default returns the settings used when nothing else is given, which are the
+// ones the server had before it could be configured.
+func Default() Config {
+	return Config{
+		Listen: "0.0.0.0:8080",
+		Backend: Backend{
+			WebDAV: "http://localhost:8081",
+			Admin:  "http://localhost:8082",
+		},
+		ShutdownTimeout: 30 * time.Second,
+		ExpiredKeySweep: 5 * time.Hour,
+		Database: Database{
+			Driver:         "postgres",
+			ConnectTimeout: 10 * time.Minute,
+			QueryTimeout:   5 * time.Second,
+		},
+		CORS: CORS{
+			AllowedOrigins: []string{"*"},
+			AllowedMethods: []string{"HEAD", "GET", "POST", "PUT", "PATCH", "DELETE"},
+			AllowedHeaders: []string{"*"},
+		},
+		Log:     Log{Level: "info", Format: "json"},
+		Metrics: Metrics{Auth: MetricsAuthAdmin},
+	}
+}
+
+// setting is a value that can be set from the environment and the command
+// line as well as the file.
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	set   func(string) error
+}
+
+func stringSetting(value *string) func(string) error {
+	return func(raw string) error {
+		*value = raw
+		return nil
+	}
+}
+
+func listSetting(value *[]string) func(string) error {
+	return func(raw string) error {
+		*value = nil
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*value = append(*value, item)
+			}
+		}
+		return nil
+	}
+}
+
+func durationSetting(value *time.Duration) func(string) error {
+	return func(raw string) (err error) {
+		*value, err = time.ParseDuration(raw)
+		return err
+	}
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"LISTEN_ADDR", "listen", "address to listen on", stringSetting(&c.Listen)},
+		{"WEBDAV_URL", "webdav-url", "URL of the rclone WebDAV server", stringSetting(&c.Backend.WebDAV)},
+		{"ADMIN_URL", "admin-url", "URL of the rclone rc server", stringSetting(&c.Backend.Admin)},
+		{"SHUTDOWN_TIMEOUT", "shutdown-timeout", "how long requests in flight get to finish on shutdown", durationSetting(&c.ShutdownTimeout)},
+		{"EXPIRED_KEY_SWEEP", "expired-key-sweep", "how often expired keys are deleted", durationSetting(&c.ExpiredKeySweep)},
+		{"DATABASE_DRIVER", "database-driver", "key store: postgres, sqlite or memory", stringSetting(&c.Database.Driver)},
+		{"DATABASE_URL", "database-url", "postgres URL or sqlite file", stringSetting(&c.Database.URL)},
+		{"DATABASE_CONNECT_TIMEOUT", "database-connect-timeout", "how long to wait for postgres to come up", durationSetting(&c.Database.ConnectTimeout)},
+		{"DATABASE_QUERY_TIMEOUT", "database-query-timeout", "how long each postgres query may take", durationSetting(&c.Database.QueryTimeout)},
+		{"CORS_ALLOWED_ORIGINS", "cors-allowed-origins", "comma separated origins allowed cross origin requests", listSetting(&c.CORS.AllowedOrigins)},
+		{"CORS_ALLOWED_METHODS", "cors-allowed-methods", "comma separated methods allowed cross origin", listSetting(&c.CORS.AllowedMethods)},
+		{"CORS_ALLOWED_HEADERS", "cors-allowed-headers", "comma separated headers allowed cross origin", listSetting(&c.CORS.AllowedHeaders)},
+		{"CORS_EXPOSED_HEADERS", "cors-exposed-headers", "comma separated response headers shown to cross origin scripts", listSetting(&c.CORS.ExposedHeaders)},
+		{"CORS_ALLOW_CREDENTIALS", "cors-allow-credentials", "whether cross origin requests may carry credentials", func(raw string) (err error) {
+			c.CORS.AllowCredentials, err = strconv.ParseBool(raw)
+			return err
+		}},
+		{"CORS_MAX_AGE", "cors-max-age", "seconds browsers may cache a preflight response", func(raw string) (err error) {
+			c.CORS.MaxAge, err = strconv.Atoi(raw)
+			return err
+		}},
+		{"LOG_LEVEL", "log-level", "debug, info, warn or error", stringSetting(&c.Log.Level)},
+		{"LOG_FORMAT", "log-format", "json or text", stringSetting(&c.Log.Format)},
+		{"METRICS_AUTH", "metrics-auth", "who may read /metrics: admin, token or none", stringSetting(&c.Metrics.Auth)},
+		{"WEBHOOKS_ENABLED", "webhooks-enabled", "whether endpoints may have a webhookURL", func(raw string) (err error) {
+			c.Webhooks.Enabled, err = strconv.ParseBool(raw)
+			return err
+		}},
+		{"WEBHOOK_ALLOWED_NETWORKS", "webhook-allowed-networks", "comma separated internal CIDR blocks webhooks may reach", listSetting(&c.Webhooks.AllowedNetworks)},
+	}
+}
+
+// Load works out the settings from the defaults, the config file named by
+// -config or CONFIG_FILE, the environment and the flags in args, in that
+// order, and validates them. name is the command the flags belong to.
+func Load(name string, args []string) (Config, error) {
+	return LoadFlags(flag.NewFlagSet(name, flag.ContinueOnError), args)
+}
+
+// LoadFlags is Load for a command with flags of its own, which are parsed
+// from args along with the settings.
+func LoadFlags(flags *flag.FlagSet, args []string) (Config, error) {
+	c := Default()
+	settings := c.settings()
+	file := flags.String("config", os.Getenv(FileEnv), "YAML config file (env "+FileEnv+")")
+	type flagValue struct {
+		setting setting
+		raw     string
+	}
+	var flagValues []flagValue
+	for _, s := range settings {
+		s := s
+		flags.Func(s.flag, s.usage+" (env "+s.env+")", func(raw string) error {
+			flagValues = append(flagValues, flagValue{s, raw})
+			return nil
+		})
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return c, err
+	}
+	if flags.NArg() > 0 {
+		return c, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+	if *file != "" {
+		err = c.readFile(*file)
+		if err != nil {
+			return c, err
+		}
+	}
+	for _, s := range settings {
+		if raw := os.Getenv(s.env); raw != "" {
+			err = s.set(raw)
+			if err != nil {
+				return c, fmt.Errorf("invalid %s %q: %w", s.env, raw, err)
+			}
+		}
+	}
+	for _, value := range flagValues {
+		err = value.setting.set(value.raw)
+		if err != nil {
+			return c, fmt.Errorf("invalid -%s %q: %w", value.setting.flag, value.raw, err)
+		}
+	}
+	return c, c.Validate()
+}
+
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	// misspelt settings would otherwise be silently ignored
+	decoder.KnownFields(true)
+	err = decoder.Decode(c)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func checkURL(name string, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an http or https URL", name)
+	}
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+		return fmt.Errorf("%s must not have a path or query", name)
+	}
+	return nil
+}
+
+// Validate reports every setting that is out of range.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		check(fmt.Errorf("listen must be host:port: %w", err))
+	}
+	check(checkURL("backend.webdav", c.Backend.WebDAV))
+	check(checkURL("backend.admin", c.Backend.Admin))
+	if c.ShutdownTimeout < 0 {
+		check(errors.New("shutdownTimeout must not be negative"))
+	}
+	if c.ExpiredKeySweep <= 0 {
+		check(errors.New("expiredKeySweep must be positive"))
+	}
+	switch c.Database.Driver {
+	case "postgres", "sqlite":
+		if c.Database.URL == "" {
+			check(fmt.Errorf("database.url is needed for the %s driver", c.Database.Driver))
+		}
+	case "memory":
+	default:
+		check(fmt.Errorf("unknown database.driver %q", c.Database.Driver))
+	}
+	if c.Database.ConnectTimeout <= 0 || c.Database.QueryTimeout <= 0 {
+		check(errors.New("database timeouts must be positive"))
+	}
+	if c.CORS.MaxAge < 0 {
+		check(errors.New("cors.maxAge must not be negative"))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		check(fmt.Errorf("unknown log.level %q", c.Log.Level))
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		check(fmt.Errorf("unknown log.format %q", c.Log.Format))
+	}
+	switch c.Metrics.Auth {
+	case MetricsAuthAdmin, MetricsAuthNone:
+	case MetricsAuthToken:
+		if os.Getenv("METRICS_TOKEN") == "" {
+			check(errors.New("metrics.auth token needs METRICS_TOKEN"))
+		}
+	default:
+		check(fmt.Errorf("unknown metrics.auth %q", c.Metrics.Auth))
+	}
+	if c.Webhooks.Enabled && os.Getenv("WEBHOOK_SECRET") == "" {
+		check(errors.New("webhooks.enabled needs WEBHOOK_SECRET"))
+	}
+	_, err := c.WebhookNetworks()
+	check(err)
+	seen := map[string]bool{}
+	for _, t := range c.Types {
+		_, err := t.fileType()
+		if err == nil && seen[t.Name] {
+			err = fmt.Errorf("type %q is given twice", t.Name)
+		}
+		seen[t.Name] = true
+		check(err)
+	}
+	return errors.Join(errs...)
+}
+
+func (t Type) fileType() (filetype.Type, error) {
+	ft := filetype.Type{Name: t.Name, Text: t.Text}
+	if t.Name == "" || t.Name == filetype.Any || strings.ContainsAny(t.Name, "; ") {
+		return ft, fmt.Errorf("invalid type name %q", t.Name)
+	}
+	if _, ok := filetype.Lookup(t.Name); ok {
+		return ft, fmt.Errorf("type %q is built in", t.Name)
+	}
+	for _, ext := range t.Extensions {
+		if !strings.HasPrefix(ext, ".") {
+			return ft, fmt.Errorf("extension %q of type %q must start with a dot", ext, t.Name)
+		}
+		ft.Extensions = append(ft.Extensions, strings.ToLower(ext))
+	}
+	for _, s := range t.Signatures {
+		magic, err := hex.DecodeString(s.Magic)
+		if err != nil || len(magic) == 0 || s.Offset < 0 || s.Offset+len(magic) > filetype.HeadSize {
+			return ft, fmt.Errorf("invalid signature %q at %d of type %q", s.Magic, s.Offset, t.Name)
+		}
+		ft.Signatures = append(ft.Signatures, filetype.Signature{Offset: s.Offset, Magic: magic})
+	}
+	if t.Text == (len(ft.Signatures) > 0) {
+		return ft, fmt.Errorf("type %q needs either signatures or text", t.Name)
+	}
+	return ft, nil
+}
+
+// WebhookNetworks parses Webhooks.AllowedNetworks.
+func (c Config) WebhookNetworks() ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range c.Webhooks.AllowedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhooks.allowedNetworks entry %q", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// RegisterTypes adds the configured types to the filetype registry.
+func (c Config) RegisterTypes() error {
+	for _, t := range c.Types {
+		ft, err := t.fileType()
+		if err != nil {
+			return err
+		}
+		filetype.Register(ft)
+	}
+	return nil
+}
+
+// Write prints c as YAML, with any password in the database URL hidden.
+func (c Config) Write(w io.Writer) error {
+	if u, err := url.Parse(c.Database.URL); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "REDACTED")
+			c.Database.URL = u.String()
+		}
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	err := encoder.Encode(c)
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
@@ -0,0 +1,105 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AuditEvent is one request recorded in the audit log. Time is in unix
+// milliseconds. KeyID is the key that made the request, empty if none was
+// resolved, and TargetKeyID the key it created, changed or deleted, if any.
+// Path is the /files/ URL path a file request was resolved to, below its
+// endpoint's name rather than the endpoint's backend path.
+type AuditEvent struct {
+	ID            int64
+	Time          int64
+	KeyID         string
+	ParentID      string
+	Action        string
+	Endpoint      string
+	Path          string
+	TargetKeyID   string
+	Status        int
+	RequestBytes  int64
+	ResponseBytes int64
+	ContentType   string
+	ClientIP      string
+	// Lineage is the ids from the root key down to KeyID at the time of the
+	// event, as /root/.../KeyID/, so events stay visible to the key's
+	// ancestors after it is deleted.
+	Lineage string `json:"-"`
+}
+
+// AuditFilter narrows the events returned by AuditEvents. Zero fields match
+// everything. Before is an event ID to page back from.
+type AuditFilter struct {
+	KeyID    string
+	Action   string
+	Endpoint string
+	Status   int
+	Since    int64
+	Until    int64
+	Before   int64
+	Limit    int
+}
+
+const auditColumns = `ID, Time, KeyID, ParentID, Action, Endpoint, Path, TargetKeyID, Status, RequestBytes, ResponseBytes, ContentType, ClientIP, Lineage`
+
+// auditLineage selects the lineage of the key bound to the first parameter,
+// or nothing if it does not exist. Root keys have a NULL ParentID.
+const auditLineage = `WITH RECURSIVE chain(KeyID, ParentID, Lineage) AS (
+	SELECT KeyID, ParentID, KeyID || '/' FROM keys WHERE KeyID=%[1]s
+	UNION ALL SELECT k.KeyID, k.ParentID, k.KeyID || '/' || c.Lineage FROM keys k JOIN chain c ON k.KeyID=c.ParentID)
+	SELECT '/' || Lineage FROM chain WHERE ParentID IS NULL`
+
+// auditWhere builds the conditions of an audit query for events of viewerID
+// and its descendants, or of every key if viewerID is empty. param returns the
+// placeholder of the nth argument.
+func auditWhere(viewerID string, filter AuditFilter, param func(n int) string) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, param(len(args))))
+	}
+	if viewerID != "" {
+		add("Lineage LIKE %s", "%/"+viewerID+"/%")
+	}
+	if filter.KeyID != "" {
+		add("KeyID=%s", filter.KeyID)
+	}
+	if filter.Action != "" {
+		add("Action=%s", filter.Action)
+	}
+	if filter.Endpoint != "" {
+		add("Endpoint=%s", filter.Endpoint)
+	}
+	if filter.Status != 0 {
+		add("Status=%s", filter.Status)
+	}
+	if filter.Since != 0 {
+		add("Time>=%s", filter.Since)
+	}
+	if filter.Until != 0 {
+		add("Time<%s", filter.Until)
+	}
+	if filter.Before != 0 {
+		add("ID<%s", filter.Before)
+	}
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// auditMatches is auditWhere for stores without sql.
+func auditMatches(event AuditEvent, viewerID string, filter AuditFilter) bool {
+	return (viewerID == "" || strings.Contains(event.Lineage, "/"+viewerID+"/")) &&
+		(filter.KeyID == "" || event.KeyID == filter.KeyID) &&
+		(filter.Action == "" || event.Action == filter.Action) &&
+		(filter.Endpoint == "" || event.Endpoint == filter.Endpoint) &&
+		(filter.Status == 0 || event.Status == filter.Status) &&
+		(filter.Since == 0 || event.Time >= filter.Since) &&
+		(filter.Until == 0 || event.Time < filter.Until) &&
+		(filter.Before == 0 || event.ID < filter.Before)
+}
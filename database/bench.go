@@ -0,0 +1,92 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type PutBenchResult struct {
+	Workers   int
+	Puts      int
+	Failed    int
+	LostPuts  int
+	Elapsed   time.Duration
+	PerSecond float64
+}
+
+// SimulatePuts creates a throwaway key and has workers run the same store calls
+// a PUT makes through AuthenticateAndRoute concurrently, reserving a quota slot
+// and committing it. LostPuts counts increments that did not reach the store.
+func SimulatePuts(ctx context.Context, db KeyStore, workers int, puts int) (result PutBenchResult, err error) {
+	keyValue, err := addBenchKey(ctx, db, puts)
+	if err != nil {
+		return result, err
+	}
+	keyID := KeyID(keyValue)
+	defer db.DeleteKey(context.Background(), keyID, false)
+
+	jobs := make(chan struct{}, puts)
+	for i := 0; i < puts; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	var failed int
+	var failedLock sync.Mutex
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				_, err := db.Reserve(ctx, keyID, "bench", "Put")
+				if err == nil {
+					err = db.Commit(ctx, keyID, "bench", "Put", nil)
+				}
+				if err != nil {
+					failedLock.Lock()
+					failed++
+					failedLock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	keySet, err := db.GetKey(ctx, keyValue)
+	if err != nil {
+		return result, err
+	}
+	return PutBenchResult{
+		Workers:   workers,
+		Puts:      puts,
+		Failed:    failed,
+		LostPuts:  puts - failed - keySet.Endpoints["bench"].PutCount,
+		Elapsed:   elapsed,
+		PerSecond: float64(puts) / elapsed.Seconds(),
+	}, nil
+}
+
+// addBenchKey adds a throwaway key with room for puts Puts on its "bench"
+// endpoint and returns its value.
+func addBenchKey(ctx context.Context, db KeyStore, puts int) (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	keyValue := "bench-" + hex.EncodeToString(b)
+	return keyValue, db.AddKey(ctx, KeySet{
+		KeyValue: keyValue,
+		Endpoints: map[string]Endpoint{
+			"bench": {MaxPut: puts, MaxPutSize: 1, MaxTotalBytes: int64(puts), PutTypes: []string{"any"}, Path: "/bench", Put: true},
+		},
+		MaxTotalBytes:  int64(puts),
+		InitiateExpire: "Never",
+		ExpireDelta:    9223372036854775807,
+	})
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// BenchmarkConcurrentPuts runs the store calls of a PUT, a Reserve and its
+// Commit, from parallel goroutines against one key, and fails if any of the
+// increments they made did not reach the store.
+func BenchmarkConcurrentPuts(b *testing.B) {
+	for _, store := range []struct {
+		name string
+		open func(b *testing.B) KeyStore
+	}{
+		{"memory", func(b *testing.B) KeyStore {
+			return NewMemoryStore()
+		}},
+		{"sqlite", func(b *testing.B) KeyStore {
+			db, err := BuildSQLite(filepath.Join(b.TempDir(), "keys.db"))
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(func() { db.Close() })
+			return db
+		}},
+	} {
+		b.Run(store.name, func(b *testing.B) {
+			ctx := context.Background()
+			db := store.open(b)
+			keyValue, err := addBenchKey(ctx, db, b.N)
+			if err != nil {
+				b.Fatal(err)
+			}
+			keyID := KeyID(keyValue)
+			var failed atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					_, err := db.Reserve(ctx, keyID, "bench", "Put")
+					if err == nil {
+						err = db.Commit(ctx, keyID, "bench", "Put", nil)
+					}
+					if err != nil {
+						failed.Add(1)
+					}
+				}
+			})
+			b.StopTimer()
+			keySet, err := db.GetKey(ctx, keyValue)
+			if err != nil {
+				b.Fatal(err)
+			}
+			result := PutBenchResult{Puts: b.N, Failed: int(failed.Load())}
+			result.LostPuts = result.Puts - result.Failed - keySet.Endpoints["bench"].PutCount
+			if result.LostPuts != 0 {
+				b.Fatalf("%d of %d puts lost, %d failed", result.LostPuts, result.Puts, result.Failed)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package database
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+// keyPepper is a server side secret mixed into every key id and hash, so a
+// copy of the keys table alone is not enough to brute force weak keys.
+var keyPepper []byte
+
+func SetKeyPepper(pepper string) {
+	keyPepper = []byte(pepper)
+}
+
+func pepperedHash(data string) string {
+	mac := hmac.New(sha256.New, keyPepper)
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// KeyID derives the short identifier a key is stored and looked up under. It
+// is a keyed hash of the whole key, so it can be shown to other keys and
+// written to logs only as long as the pepper stays secret: with the pepper,
+// guessed keys can be checked against it offline.
+func KeyID(keyValue string) string {
+	return pepperedHash(keyValue)[:16]
+}
+
+func newKeySalt() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashKey(keyValue string, salt string) string {
+	return pepperedHash(salt + keyValue)
+}
+
+// hashKeySet fills in the id, salt and hash of a new key from its KeyValue.
+func hashKeySet(keySet KeySet) (KeySet, error) {
+	salt, err := newKeySalt()
+	if err != nil {
+		return keySet, err
+	}
+	keySet.KeyID = KeyID(keySet.KeyValue)
+	keySet.KeySalt = salt
+	keySet.KeyHash = hashKey(keySet.KeyValue, salt)
+	return keySet, nil
+}
+
+// verifyKey checks a presented key against a stored key in constant time.
+func verifyKey(keyValue string, keySet KeySet) bool {
+	hash := hashKey(keyValue, keySet.KeySalt)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(keySet.KeyHash)) == 1
+}
@@ -2,24 +2,14 @@ package database
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"os"
-	"strconv"
-	"strings"
-	"sync"
+	"log/slog"
 	"time"
 
-	"github.com/jackc/pgx/v4"
+	uploadschema "github.com/lanelewis/rclone-proxy/schema"
 )
 
-type DB struct {
-	Conn *pgx.Conn
-	Lock sync.Mutex
-}
-
 type Endpoint struct {
 	GetCount   int
 	MaxMkcol   int
@@ -30,6 +20,23 @@ type Endpoint struct {
 	Path       string
 	PutCount   int
 	PutTypes   []string
+	// TotalBytes counts the bytes uploaded through the endpoint, up to
+	// MaxTotalBytes.
+	MaxTotalBytes int64
+	TotalBytes    int64
+	// Schema, if set, is checked against the contents of every PUT.
+	Schema *uploadschema.Schema `json:",omitempty"`
+	// NameTemplate, if set, names every PUT instead of the client, and
+	// OnCollision says what happens when that name is taken.
+	NameTemplate string `json:",omitempty"`
+	OnCollision  string `json:",omitempty"`
+	// Overwrite says whether existing files can be replaced, and
+	// OverwriteWindow for how many seconds after they were written under
+	// "deny-after".
+	Overwrite       string `json:",omitempty"`
+	OverwriteWindow int64  `json:",omitempty"`
+	// WebhookURL, if set, is notified of every successful PUT.
+	WebhookURL string `json:",omitempty"`
 
 	Copy     bool
 	Delete   bool
@@ -45,495 +52,336 @@ type Endpoint struct {
 	Unlock   bool
 }
 
+// KeySet is a key and its permissions. Only KeyID, KeyHash and KeySalt are
+// stored; KeyValue is filled in when a key is created or presented by a client.
+// ParentID is the id of the key that created it, empty for the admin key.
+// TotalBytes counts the bytes uploaded across all endpoints of the key.
 type KeySet struct {
 	CanCreateChild  bool
 	KeyValue        string
+	KeyID           string
+	ParentID        string
+	KeyHash         string `json:"-"`
+	KeySalt         string `json:"-"`
 	Endpoints       map[string]Endpoint
+	MaxTotalBytes   int64
+	TotalBytes      int64
 	InitiateExpire  string
 	ExpireDelta     int64
 	ExpireStarted   bool
 	ExpireStartTime int64
 }
 
-func AddKey(keyset KeySet, db *DB) (err error) {
-	err = PingReconnect(db)
-	if err != nil {
-		return err
-	}
-	db.Lock.Lock()
-	defer db.Lock.Unlock()
-	b, err := json.Marshal(keyset.Endpoints)
-	if err != nil {
-		return err
-	}
-	_, err = db.Conn.Exec(context.Background(), `INSERT INTO keys VALUES ($1,$2,$3,$4,$5,$6,$7)`, keyset.CanCreateChild, keyset.KeyValue, b, keyset.InitiateExpire, keyset.ExpireDelta, keyset.ExpireStarted, keyset.ExpireStartTime)
-	if err != nil {
-		return err
-	}
-	return nil
+var ErrKeyExists = errors.New("key already exists")
+var ErrKeyNotFound = errors.New("no key found in db")
+
+// KeyStore is the storage backend for keys. The handles package only talks to
+// keys through this interface so the backing database can be swapped out.
+// GetKey authenticates a presented key value; everything else addresses keys
+// by the KeyID of an already authenticated key.
+type KeyStore interface {
+	AddKey(ctx context.Context, keyset KeySet) error
+	GetKey(ctx context.Context, keyValue string) (KeySet, error)
+	// DeleteKey removes a key. With cascade its whole subtree goes with it,
+	// otherwise its children are handed to its parent.
+	DeleteKey(ctx context.Context, keyID string, cascade bool) error
+	// GetChildren returns the keys created by keyID, or with recursive every
+	// key descended from it.
+	GetChildren(ctx context.Context, keyID string, recursive bool) ([]KeySet, error)
+	GetEndpointNames(ctx context.Context, keyID string) ([]string, error)
+	GetBoolFieldAndPath(ctx context.Context, keyID string, endpoint string, field string) (path string, truth bool, err error)
+	// Reserve atomically checks that the key may perform field (Put, Get or
+	// Mkcol) on endpoint and takes one slot of that quota. Every successful
+	// Reserve must be followed by exactly one Commit or Release.
+	Reserve(ctx context.Context, keyID string, endpoint string, field string) (Endpoint, error)
+	// Commit keeps a reserved slot and starts the expiry timer if the key
+	// expires on field. The notifications are added to the webhook outbox in
+	// the same transaction, so they are sent exactly when the slot is kept.
+	Commit(ctx context.Context, keyID string, endpoint string, field string, notifications []Notification) error
+	// Release gives a reserved slot back after the backend failed.
+	Release(ctx context.Context, keyID string, endpoint string, field string) error
+	// ReserveBytes adds n to the TotalBytes of the endpoint and of the key,
+	// failing with ErrByteQuota if either would pass its MaxTotalBytes.
+	ReserveBytes(ctx context.Context, keyID string, endpoint string, n int64) error
+	// ReleaseBytes gives reserved bytes back.
+	ReleaseBytes(ctx context.Context, keyID string, endpoint string, n int64) error
+	// UpdateKey applies change to a stored key atomically. change is also
+	// given the key's parent, the zero KeySet for a root key, and its direct
+	// children, read in the same transaction so they cannot change under it.
+	// Only the permissions, counters and expiry of the key are written back.
+	UpdateKey(ctx context.Context, keyID string, change func(keySet *KeySet, parent KeySet, children []KeySet) error) error
+	// DeleteExpiredKeys removes every expired key and returns how many it
+	// removed.
+	DeleteExpiredKeys(ctx context.Context) (int64, error)
+	// CountKeys returns how many keys are stored, expired or not.
+	CountKeys(ctx context.Context) (int64, error)
+	// AddAuditEvent records event, filling in the ParentID and Lineage of its
+	// key. For a key that is already gone they are worked out from the
+	// event's ParentID.
+	AddAuditEvent(ctx context.Context, event AuditEvent) error
+	// AuditEvents returns the events of viewerID and its descendants that
+	// match filter, newest first. An empty viewerID sees every event.
+	AuditEvents(ctx context.Context, viewerID string, filter AuditFilter) ([]AuditEvent, error)
+	// EnqueueWebhook adds a notification to the outbox, due now.
+	EnqueueWebhook(ctx context.Context, url string, payload []byte) error
+	// ClaimWebhooks returns up to limit webhooks due at now and pushes them
+	// back to leaseUntil, so other workers leave them alone while they are
+	// delivered.
+	ClaimWebhooks(ctx context.Context, now int64, leaseUntil int64, limit int) ([]Webhook, error)
+	// DeleteWebhook removes a delivered webhook.
+	DeleteWebhook(ctx context.Context, id int64) error
+	// RetryWebhook records a failed attempt, due again at nextAttempt, or
+	// given up on if failed.
+	RetryWebhook(ctx context.Context, id int64, nextAttempt int64, failed bool, lastError string) error
+	Ping(ctx context.Context) error
+	Close() error
 }
 
-func GetKey(keyValue string, db *DB) (keySet KeySet, err error) {
-	err = PingReconnect(db)
-	if err != nil {
-		return keySet, err
-	}
-	db.Lock.Lock()
-	defer db.Lock.Unlock()
-	err = db.Conn.QueryRow(context.Background(), "select * from keys where KeyValue=$1;", keyValue).Scan(
-		&keySet.CanCreateChild,
-		&keySet.KeyValue,
-		&keySet.Endpoints,
-		&keySet.InitiateExpire,
-		&keySet.ExpireDelta,
-		&keySet.ExpireStarted,
-		&keySet.ExpireStartTime)
-	if err != nil {
-		return keySet, err
-	}
-	if keySet.KeyValue == "" {
-		return keySet, errors.New("no key found in db")
-	}
-	return keySet, nil
+// OpenStore builds the key store selected by driver. An empty driver defaults
+// to postgres so existing deployments keep working with only DATABASE_URL set.
+func OpenStore(driver string, url string) (KeyStore, error) {
+	switch driver {
+	case "", "postgres":
+		return BuildDB(url)
+	case "sqlite":
+		return BuildSQLite(url)
+	case "memory":
+		return NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown database driver %q", driver)
 }
 
-func DeleteKey(keyValue string, db *DB) (err error) {
-	err = PingReconnect(db)
-	if err != nil {
-		return err
-	}
-	db.Lock.Lock()
-	defer db.Lock.Unlock()
-	_, err = db.Conn.Exec(context.Background(), "DELETE from keys where KeyValue=$1;", keyValue)
-	if err != nil {
-		return err
-	}
-	return nil
+func isExpired(keySet KeySet) bool {
+	return keySet.ExpireStarted && time.Now().UnixMilli()-keySet.ExpireStartTime > keySet.ExpireDelta
 }
-func InitiateConnect(url string, timeOut time.Duration) (conn *pgx.Conn, err error) {
-	ticker := time.NewTicker(1 * time.Second)
-	defer ticker.Stop()
-	timeoutTriggered := time.After(timeOut)
-	for {
-		select {
-		case <-timeoutTriggered:
-			return nil, fmt.Errorf("db connection failed")
 
-		case <-ticker.C:
-			conn, err = pgx.Connect(context.Background(), url)
-			if err == nil {
-				return conn, nil
-			}
-			log.Println("failed to create connection", err)
-		}
-	}
+func endpointField(endpoint Endpoint, field string) bool {
+	switch field {
+	case "Copy":
+		return endpoint.Copy
+	case "Delete":
+		return endpoint.Delete
+	case "Get":
+		return endpoint.Get
+	case "Head":
+		return endpoint.Head
+	case "Lock":
+		return endpoint.Lock
+	case "Mkcol":
+		return endpoint.Mkcol
+	case "Options":
+		return endpoint.Options
+	case "Post":
+		return endpoint.Post
+	case "Propfind":
+		return endpoint.Propfind
+	case "Put":
+		return endpoint.Put
+	case "Trace":
+		return endpoint.Trace
+	case "Unlock":
+		return endpoint.Unlock
+	}
+	return false
 }
-func BuildDB(url string) (*DB, error) {
-	conn, err := InitiateConnect(url, 10*time.Minute)
-	if err != nil {
-		return nil, err
+
+// lookupEndpoint resolves an endpoint of a loaded key for stores that keep
+// keys as whole records rather than querying json fields directly.
+func lookupEndpoint(keySet KeySet, endpoint string) (Endpoint, error) {
+	if isExpired(keySet) {
+		return Endpoint{}, ErrKeyExpired
 	}
-	log.Println("connection created")
-	_, err = conn.Exec(context.Background(), `create table if not exists 
-	keys(CanCreateChild BOOLEAN,
-		KeyValue TEXT,
-		Endpoints JSONB,
-		InitiateExpire TEXT,
-		ExpireDelta BIGINT,
-		ExpireStarted BOOLEAN,
-		ExpireStartTime BIGINT,
-		PRIMARY KEY(KeyValue))`)
-	if err != nil {
-		return nil, err
+	e, ok := keySet.Endpoints[endpoint]
+	if !ok {
+		return Endpoint{}, errors.New("endpoint not in key")
 	}
-	return &DB{
-		Conn: conn,
-		Lock: sync.Mutex{},
-	}, nil
+	return e, nil
 }
 
-func DestroyDB(url string) error {
-	conn, err := pgx.Connect(context.Background(), url)
-	if err != nil {
-		return err
-	}
-	_, err = conn.Exec(context.Background(), "drop table keys")
-	if err != nil {
-		return err
-	}
-	return nil
+var ErrKeyExpired = errors.New("key is expired")
+var ErrByteQuota = errors.New("byte quota exceeded")
+var ErrNoAccess = errors.New("no access to method")
+
+type quotaField struct {
+	count string
+	max   string
 }
 
-func GetEndpointNames(keyValue string, db *DB) (names []string, err error) {
-	err = PingReconnect(db)
-	if err != nil {
-		return names, err
-	}
-	db.Lock.Lock()
-	defer db.Lock.Unlock()
-	err = db.Conn.QueryRow(context.Background(), "select ARRAY(select jsonb_object_keys(Endpoints) from keys where KeyValue=$1);", keyValue).Scan(&names)
-	if err != nil {
-		return names, err
-	}
-	return names, nil
+// quotaFields maps the methods that carry a quota to the Endpoint counter and
+// limit fields, named as they are in the stored json.
+var quotaFields = map[string]quotaField{
+	"Put":   {count: "PutCount", max: "MaxPut"},
+	"Get":   {count: "GetCount", max: "MaxGet"},
+	"Mkcol": {count: "MkcolCount", max: "MaxMkcol"},
 }
 
-// gets field and the path, if expired, deletes
-func GetBoolFieldAndPath(keyValue string, endpoint string, field string, db *DB) (path string, truth bool, err error) {
-	var expireStart int64
-	var expireDelta int64
-	var expireStarted bool
-	err = PingReconnect(db)
-	if err != nil {
-		return path, truth, err
-	}
-	db.Lock.Lock()
-	err = db.Conn.QueryRow(context.Background(), "select Endpoints -> $1 -> 'Path', Endpoints -> $1 -> $2, ExpireDelta, ExpireStartTime, ExpireStarted from keys where KeyValue=$3", endpoint, field, keyValue).Scan(
-		&path,
-		&truth,
-		&expireDelta,
-		&expireStart,
-		&expireStarted)
-	db.Lock.Unlock()
-	if expireStarted && int64(time.Now().UnixMilli())-(expireStart+expireDelta) > 0 {
-		err = DeleteKey(keyValue, db)
-		if err != nil {
-			return path, truth, err
-		}
-		return path, truth, errors.New("key is expired")
-	}
-	if err != nil {
-		return path, truth, err
-	}
-	return path, truth, nil
+func quotaCounter(e *Endpoint, field string) (count *int, max int, err error) {
+	switch field {
+	case "Put":
+		return &e.PutCount, e.MaxPut, nil
+	case "Get":
+		return &e.GetCount, e.MaxGet, nil
+	case "Mkcol":
+		return &e.MkcolCount, e.MaxMkcol, nil
+	}
+	return nil, 0, fmt.Errorf("no counter for %s", field)
 }
-func GetPutAndPath(keyValue string, endpoint string, db *DB) (path string, truth bool, putTypes []string, maxPutSize int64, err error) {
-	var expireStart int64
-	var expireDelta int64
-	var maxPut int
-	var putCount int
-	var expireStarted bool
-	err = PingReconnect(db)
+
+// reserveError explains why a reservation on a loaded key was refused.
+func reserveError(keySet KeySet, endpoint string, field string) error {
+	e, err := lookupEndpoint(keySet, endpoint)
 	if err != nil {
-		return path, truth, putTypes, maxPutSize, err
+		return err
 	}
-	db.Lock.Lock()
-	err = db.Conn.QueryRow(context.Background(), `
-		select Endpoints -> $1 -> 'Path',
-		Endpoints -> $1 -> 'Put',
-		ExpireDelta,
-		ExpireStartTime,
-		ExpireStarted,
-		Endpoints -> $1 -> 'MaxPut',
-		Endpoints -> $1 -> 'PutCount',
-		Endpoints -> $1 -> 'PutTypes',
-		Endpoints -> $1 -> 'MaxPutSize'
-		from keys where KeyValue=$2`, endpoint, keyValue).Scan(
-		&path,
-		&truth,
-		&expireDelta,
-		&expireStart,
-		&expireStarted,
-		&maxPut,
-		&putCount,
-		&putTypes,
-		&maxPutSize,
-	)
-	db.Lock.Unlock()
+	count, max, err := quotaCounter(&e, field)
 	if err != nil {
-		return path, truth, putTypes, maxPutSize, errors.New("error getting rows")
+		return err
 	}
-	if expireStarted && int64(time.Now().UnixMilli())-(expireStart+expireDelta) > 0 {
-		err = DeleteKey(keyValue, db)
-		if err != nil {
-			return path, truth, putTypes, maxPutSize, err
-		}
-		return path, truth, putTypes, maxPutSize, errors.New("key is expired")
+	if !endpointField(e, field) {
+		return ErrNoAccess
 	}
-	if putCount >= maxPut {
-		return path, truth, putTypes, maxPutSize, errors.New("putCount exceeds maxPut")
+	if *count >= max {
+		return fmt.Errorf("%s exceeds %s", quotaFields[field].count, quotaFields[field].max)
 	}
-	return path, truth, putTypes, maxPutSize, nil
+	return nil
 }
 
-func GetMkcolAndPath(keyValue string, endpoint string, db *DB) (path string, truth bool, err error) {
-	var expireStart int64
-	var expireDelta int64
-	var maxMkcol int
-	var mkcolCount int
-	var expireStarted bool
-	err = PingReconnect(db)
-	if err != nil {
-		return path, truth, err
-	}
-	db.Lock.Lock()
-	err = db.Conn.QueryRow(context.Background(), `
-		select Endpoints -> $1 -> 'Path',
-		Endpoints -> $1 -> 'Mkcol',
-		ExpireDelta,
-		ExpireStartTime,
-		ExpireStarted,
-		Endpoints -> $1 -> 'MaxMkcol',
-		Endpoints -> $1 -> 'MkcolCount'
-		from keys where KeyValue=$2`, endpoint, keyValue).Scan(&path, &truth, &expireDelta, &expireStart, &expireStarted, &maxMkcol, &mkcolCount)
-	db.Lock.Unlock()
+// reserveCounter takes a quota slot on a loaded key for stores that rewrite
+// whole records. The caller must hold the record lock.
+func reserveCounter(keySet *KeySet, endpoint string, field string) (Endpoint, error) {
+	err := reserveError(*keySet, endpoint, field)
 	if err != nil {
-		return path, truth, err
-	}
-	if expireStarted && int64(time.Now().UnixMilli())-(expireStart+expireDelta) > 0 {
-		err = DeleteKey(keyValue, db)
-		if err != nil {
-			return path, truth, err
-		}
-		return path, truth, errors.New("key is expired")
-	}
-	if mkcolCount >= maxMkcol {
-		return path, truth, errors.New("mkcolCount exceeds maxMkcol")
+		return Endpoint{}, err
 	}
-	return path, truth, nil
+	e := keySet.Endpoints[endpoint]
+	count, _, _ := quotaCounter(&e, field)
+	*count++
+	keySet.Endpoints[endpoint] = e
+	return e, nil
 }
 
-func GetAndPath(keyValue string, endpoint string, db *DB) (path string, truth bool, err error) {
-	var expireStart int64
-	var expireDelta int64
-	var maxGet int
-	var getCount int
-	var expireStarted bool
-	err = PingReconnect(db)
-	if err != nil {
-		return path, truth, err
+func releaseCounter(keySet *KeySet, endpoint string, field string) error {
+	e, ok := keySet.Endpoints[endpoint]
+	if !ok {
+		return errors.New("endpoint not in key")
 	}
-	db.Lock.Lock()
-	err = db.Conn.QueryRow(context.Background(), `
-		select Endpoints -> $1 -> 'Path',
-		Endpoints -> $1 -> 'Get',
-		ExpireDelta,
-		ExpireStartTime,
-		ExpireStarted,
-		Endpoints -> $1 -> 'MaxGet',
-		Endpoints -> $1 -> 'GetCount'
-		from keys where KeyValue=$2`, endpoint, keyValue).Scan(
-		&path,
-		&truth,
-		&expireDelta,
-		&expireStart,
-		&expireStarted,
-		&maxGet,
-		&getCount)
-	db.Lock.Unlock()
+	count, _, err := quotaCounter(&e, field)
 	if err != nil {
-		return path, truth, err
-	}
-	if expireStarted && int64(time.Now().UnixMilli())-(expireStart+expireDelta) > 0 {
-		err = DeleteKey(keyValue, db)
-		if err != nil {
-			return path, truth, err
-		}
-		return path, truth, errors.New("key is expired")
+		return err
 	}
-	if getCount >= maxGet {
-		return path, truth, errors.New("get exceeds maxGet")
+	if *count > 0 {
+		*count--
 	}
-	return path, truth, nil
+	keySet.Endpoints[endpoint] = e
+	return nil
 }
 
-func IteratePut(keyValue string, endpoint string, db *DB) error {
-	var expireStart int64
-	var initiateExpire string
-	var putCount int
-	var expireStarted bool
-	db.Lock.Lock()
-	err := db.Conn.QueryRow(context.Background(), `
-		select
-		ExpireStartTime,
-		InitiateExpire,
-		ExpireStarted,
-		Endpoints -> $2 -> 'PutCount'
-		from keys where KeyValue=$1`, keyValue, endpoint).Scan(&expireStart, &initiateExpire, &expireStarted, &putCount)
-	db.Lock.Unlock()
-	if err != nil {
-		return err
-	}
-	if initiateExpire == "Put" {
-		if !expireStarted {
-			command := `update keys set expirestarttime=$1, expireStarted=true, Endpoints=jsonb_set(Endpoints, '{` + endpoint + `, PutCount}', ($3::TEXT)::jsonb) where KeyValue=$2;`
-			_, err = db.Conn.Exec(context.Background(), command, int64(time.Now().UnixMilli()), keyValue, strconv.Itoa(putCount+1))
-			if err != nil {
-				return err
-			}
-			return nil
-		}
-	} else {
-		command := `update keys set Endpoints=jsonb_set(Endpoints, '{` + endpoint + `, PutCount}', ($2::TEXT)::jsonb) where KeyValue=$1;`
-		_, err = db.Conn.Exec(context.Background(), command, keyValue, strconv.Itoa(putCount+1))
-		if err != nil {
-			return err
-		}
-	}
+// reserveBytes charges n bytes to a loaded key for stores that rewrite whole
+// records. The caller must hold the record lock.
+func reserveBytes(keySet *KeySet, endpoint string, n int64) error {
+	e, ok := keySet.Endpoints[endpoint]
+	if !ok {
+		return errors.New("endpoint not in key")
+	}
+	// compared by subtraction so a large n cannot overflow
+	if e.TotalBytes > e.MaxTotalBytes-n || keySet.TotalBytes > keySet.MaxTotalBytes-n {
+		return ErrByteQuota
+	}
+	e.TotalBytes += n
+	keySet.TotalBytes += n
+	keySet.Endpoints[endpoint] = e
 	return nil
 }
 
-func IterateMkcol(keyValue string, endpoint string, db *DB) error {
-	var expireStart int64
-	var initiateExpire string
-	var mkcolCount int
-	var expireStarted bool
-	db.Lock.Lock()
-	err := db.Conn.QueryRow(context.Background(), `
-		select
-		ExpireStartTime,
-		InitiateExpire,
-		ExpireStarted,
-		Endpoints -> $2 -> 'MkcolCount'
-		from keys where KeyValue=$1`, keyValue, endpoint).Scan(&expireStart, &initiateExpire, &expireStarted, &mkcolCount)
-	db.Lock.Unlock()
-	if err != nil {
-		return err
+func releaseBytes(keySet *KeySet, endpoint string, n int64) error {
+	e, ok := keySet.Endpoints[endpoint]
+	if !ok {
+		return errors.New("endpoint not in key")
 	}
-	if initiateExpire == "Mkcol" {
-		if !expireStarted {
-			command := `update keys set expirestarttime=$1, expireStarted=true, Endpoints=jsonb_set(Endpoints, '{` + endpoint + `, MkcolCount}', ($3::TEXT)::jsonb) where KeyValue=$2;`
-			_, err = db.Conn.Exec(context.Background(), command, int64(time.Now().UnixMilli()), keyValue, strconv.Itoa(mkcolCount+1))
-			if err != nil {
-				return err
-			}
-			return nil
-		}
-	} else {
-		command := `update keys set Endpoints=jsonb_set(Endpoints, '{` + endpoint + `, MkcolCount}', ($2::TEXT)::jsonb) where KeyValue=$1;`
-		_, err = db.Conn.Exec(context.Background(), command, keyValue, strconv.Itoa(mkcolCount+1))
-		if err != nil {
-			return err
-		}
+	e.TotalBytes -= n
+	if e.TotalBytes < 0 {
+		e.TotalBytes = 0
 	}
-
+	keySet.TotalBytes -= n
+	if keySet.TotalBytes < 0 {
+		keySet.TotalBytes = 0
+	}
+	keySet.Endpoints[endpoint] = e
 	return nil
 }
 
-func IterateGet(keyValue string, endpoint string, db *DB) error {
-	var expireStart int64
-	var initiateExpire string
-	var getCount int
-	var expireStarted bool
-	err := PingReconnect(db)
-	if err != nil {
-		return err
+func commitCounter(keySet *KeySet, field string) {
+	if keySet.InitiateExpire == field && !keySet.ExpireStarted {
+		keySet.ExpireStarted = true
+		keySet.ExpireStartTime = time.Now().UnixMilli()
 	}
-	db.Lock.Lock()
-	err = db.Conn.QueryRow(context.Background(), `
-		select
-		ExpireStartTime,
-		InitiateExpire,
-		ExpireStarted,
-		Endpoints -> $2 -> 'GetCount'
-		from keys where KeyValue=$1`, keyValue, endpoint).Scan(&expireStart, &initiateExpire, &expireStarted, &getCount)
-	db.Lock.Unlock()
-	if err != nil {
-		return err
-	}
-	if initiateExpire == "Get" {
-		if !expireStarted {
-			command := `update keys set expirestarttime=$1, expireStarted=true, Endpoints=jsonb_set(Endpoints, '{` + endpoint + `, GetCount}', ($3::TEXT)::jsonb) where KeyValue=$2;`
-			_, err = db.Conn.Exec(context.Background(), command, int64(time.Now().UnixMilli()), keyValue, strconv.Itoa(getCount+1))
+}
+
+// ClearExpiredKeys deletes expired keys from db every interval until ctx is
+// done.
+func ClearExpiredKeys(ctx context.Context, db KeyStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			deleted, err := db.DeleteExpiredKeys(ctx)
 			if err != nil {
-				return err
+				expiredSweeps.WithLabelValues("error").Inc()
+				slog.Error("failed to delete expired keys", "err", err)
+			} else {
+				expiredSweeps.WithLabelValues("ok").Inc()
+				expiredKeysDeleted.Add(float64(deleted))
+				slog.Info("deleted expired keys", "count", deleted)
 			}
-			return nil
+		case <-ctx.Done():
+			return
 		}
-	} else {
-		command := `update keys set Endpoints=jsonb_set(Endpoints, '{` + endpoint + `, GetCount}', ($2::TEXT)::jsonb) where KeyValue=$1;`
-		_, err = db.Conn.Exec(context.Background(), command, keyValue, strconv.Itoa(getCount+1))
-		if err != nil {
-			return err
-		}
-
 	}
-	return nil
 }
-func ClearExpiredKeys(db *DB) {
-	ticker := time.NewTicker(5 * time.Hour)
-	quit := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				err := PingReconnect(db)
-				if err != nil {
-					log.Println("error when deleting expired keys:", err)
-				}
-				db.Lock.Lock()
-				_, err = db.Conn.Exec(context.Background(), "DELETE from keys where ExpireStarted=true AND ExpireStartTime+ExpireDelta < $1;", time.Now().UnixMilli())
-				db.Lock.Unlock()
-				if err != nil {
-					log.Println("error when deleting expired keys:", err)
-				} else {
-					log.Println("deleted expired keys")
-				}
-			case <-quit:
-				ticker.Stop()
-				return
-			}
-		}
-	}()
-}
-func AddAdmin(adminKey string, db *DB) (err error) {
+
+func AddAdmin(adminKey string, db KeyStore) (err error) {
 	baseKey := KeySet{
 		CanCreateChild: true,
 		KeyValue:       adminKey,
 		Endpoints: map[string]Endpoint{
 			"root": {
-				GetCount:   0,
-				MaxMkcol:   2147483647,
-				MaxPut:     2147483647,
-				MaxPutSize: 9223372036854775807,
-				MaxGet:     2147483647,
-				MkcolCount: 0,
-				Path:       "/",
-				PutCount:   0,
-				PutTypes:   []string{"any"},
-				Copy:       true,
-				Delete:     true,
-				Get:        true,
-				Head:       true,
-				Lock:       true,
-				Mkcol:      true,
-				Options:    true,
-				Post:       true,
-				Propfind:   true,
-				Put:        true,
-				Trace:      true,
-				Unlock:     true,
+				GetCount:      0,
+				MaxMkcol:      2147483647,
+				MaxPut:        2147483647,
+				MaxPutSize:    9223372036854775807,
+				MaxGet:        2147483647,
+				MkcolCount:    0,
+				Path:          "/",
+				PutCount:      0,
+				PutTypes:      []string{"any"},
+				MaxTotalBytes: 9223372036854775807,
+				Copy:          true,
+				Delete:        true,
+				Get:           true,
+				Head:          true,
+				Lock:          true,
+				Mkcol:         true,
+				Options:       true,
+				Post:          true,
+				Propfind:      true,
+				Put:           true,
+				Trace:         true,
+				Unlock:        true,
 			},
 		},
+		MaxTotalBytes:   9223372036854775807,
 		InitiateExpire:  "Never",
 		ExpireDelta:     9223372036854775807,
 		ExpireStarted:   false,
 		ExpireStartTime: 0,
 	}
-	err = PingReconnect(db)
-	if err != nil {
-		return err
-	}
-	err = AddKey(baseKey, db)
+	err = db.AddKey(context.Background(), baseKey)
 	if err != nil {
-		if strings.Contains(fmt.Sprint(err), "23505") {
+		if errors.Is(err, ErrKeyExists) {
 			return errors.New("admin key already exists")
 		}
 		return err
 	}
 	return nil
 }
-
-func PingReconnect(db *DB) error {
-	err := db.Conn.Ping(context.Background())
-	if err != nil {
-		log.Println("ping attempted")
-		conn, err := InitiateConnect(os.Getenv("DATABASE_URL"), 10*time.Second)
-		if err != nil {
-			return err
-		}
-		db.Conn = conn
-		log.Println("re-established connection")
-	}
-	return nil
-}
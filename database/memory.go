@@ -0,0 +1,423 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps keys in process memory. Nothing survives a restart, so it
+// is meant for tests and small deployments where the admin key is the only
+// long lived key.
+type MemoryStore struct {
+	lock     sync.Mutex
+	keys     map[string]KeySet
+	events   []AuditEvent
+	webhooks []Webhook
+	// lastEvent is the ID given to the last audit event
+	lastEvent int64
+	// lastWebhook is the ID given to the last enqueued webhook
+	lastWebhook int64
+}
+
+// memoryAuditEvents is how many audit events a MemoryStore keeps. Once there
+// are more, the oldest tenth is dropped.
+const memoryAuditEvents = 10000
+
+// memoryFailedWebhooks is how many given up webhooks a MemoryStore keeps for
+// inspection. Once there are more, the oldest is dropped.
+const memoryFailedWebhooks = 1000
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{keys: make(map[string]KeySet)}
+}
+
+func copyKeySet(keySet KeySet) KeySet {
+	endpoints := make(map[string]Endpoint, len(keySet.Endpoints))
+	for k, endpoint := range keySet.Endpoints {
+		endpoint.PutTypes = append([]string(nil), endpoint.PutTypes...)
+		endpoint.Schema = endpoint.Schema.Copy()
+		endpoints[k] = endpoint
+	}
+	keySet.Endpoints = endpoints
+	return keySet
+}
+
+func (db *MemoryStore) AddKey(ctx context.Context, keyset KeySet) error {
+	keyset, err := hashKeySet(keyset)
+	if err != nil {
+		return err
+	}
+	keyset.KeyValue = ""
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if _, ok := db.keys[keyset.KeyID]; ok {
+		return ErrKeyExists
+	}
+	db.keys[keyset.KeyID] = copyKeySet(keyset)
+	return nil
+}
+
+func (db *MemoryStore) GetKey(ctx context.Context, keyValue string) (KeySet, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	keySet, ok := db.keys[KeyID(keyValue)]
+	if !ok || !verifyKey(keyValue, keySet) {
+		return KeySet{}, ErrKeyNotFound
+	}
+	keySet = copyKeySet(keySet)
+	keySet.KeyValue = keyValue
+	return keySet, nil
+}
+
+// descendants returns the ids below keyID, children first. The caller must
+// hold the lock.
+func (db *MemoryStore) descendants(keyID string, recursive bool) []string {
+	var ids []string
+	parents := []string{keyID}
+	for len(parents) > 0 {
+		var next []string
+		for id, keySet := range db.keys {
+			for _, parent := range parents {
+				if keySet.ParentID == parent {
+					next = append(next, id)
+				}
+			}
+		}
+		ids = append(ids, next...)
+		if !recursive {
+			break
+		}
+		parents = next
+	}
+	return ids
+}
+
+// deleteKey removes a key, handing its children to its parent. The caller must
+// hold the lock.
+func (db *MemoryStore) deleteKey(keyID string) {
+	parentID := db.keys[keyID].ParentID
+	for _, id := range db.descendants(keyID, false) {
+		child := db.keys[id]
+		child.ParentID = parentID
+		db.keys[id] = child
+	}
+	delete(db.keys, keyID)
+}
+
+func (db *MemoryStore) DeleteKey(ctx context.Context, keyID string, cascade bool) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if cascade {
+		for _, id := range db.descendants(keyID, true) {
+			delete(db.keys, id)
+		}
+	}
+	db.deleteKey(keyID)
+	return nil
+}
+
+func (db *MemoryStore) GetChildren(ctx context.Context, keyID string, recursive bool) ([]KeySet, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	ids := db.descendants(keyID, recursive)
+	keys := make([]KeySet, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, copyKeySet(db.keys[id]))
+	}
+	return keys, nil
+}
+
+func (db *MemoryStore) UpdateKey(ctx context.Context, keyID string, change func(keySet *KeySet, parent KeySet, children []KeySet) error) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	stored, ok := db.keys[keyID]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if isExpired(stored) {
+		return ErrKeyExpired
+	}
+	var parent KeySet
+	if stored.ParentID != "" {
+		parent = copyKeySet(db.keys[stored.ParentID])
+	}
+	var children []KeySet
+	for _, id := range db.descendants(keyID, false) {
+		children = append(children, copyKeySet(db.keys[id]))
+	}
+	keySet := copyKeySet(stored)
+	err := change(&keySet, parent, children)
+	if err != nil {
+		return err
+	}
+	stored.CanCreateChild = keySet.CanCreateChild
+	stored.Endpoints = copyKeySet(keySet).Endpoints
+	stored.MaxTotalBytes = keySet.MaxTotalBytes
+	stored.TotalBytes = keySet.TotalBytes
+	stored.ExpireDelta = keySet.ExpireDelta
+	stored.ExpireStarted = keySet.ExpireStarted
+	stored.ExpireStartTime = keySet.ExpireStartTime
+	db.keys[keyID] = stored
+	return nil
+}
+
+func (db *MemoryStore) GetEndpointNames(ctx context.Context, keyID string) ([]string, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	keySet, ok := db.keys[keyID]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	names := make([]string, 0, len(keySet.Endpoints))
+	for k := range keySet.Endpoints {
+		names = append(names, k)
+	}
+	return names, nil
+}
+
+// endpoint loads a key's endpoint, deleting the key if it has expired.
+func (db *MemoryStore) endpoint(ctx context.Context, keyID string, endpoint string) (Endpoint, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	keySet, ok := db.keys[keyID]
+	if !ok {
+		return Endpoint{}, ErrKeyNotFound
+	}
+	if isExpired(keySet) {
+		db.deleteKey(keyID)
+	}
+	return lookupEndpoint(keySet, endpoint)
+}
+
+func (db *MemoryStore) GetBoolFieldAndPath(ctx context.Context, keyID string, endpoint string, field string) (path string, truth bool, err error) {
+	e, err := db.endpoint(ctx, keyID, endpoint)
+	if err != nil {
+		return path, truth, err
+	}
+	return e.Path, endpointField(e, field), nil
+}
+
+func (db *MemoryStore) Reserve(ctx context.Context, keyID string, endpoint string, field string) (Endpoint, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	keySet, ok := db.keys[keyID]
+	if !ok {
+		return Endpoint{}, ErrKeyNotFound
+	}
+	if isExpired(keySet) {
+		db.deleteKey(keyID)
+		return Endpoint{}, ErrKeyExpired
+	}
+	e, err := reserveCounter(&keySet, endpoint, field)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	db.keys[keyID] = keySet
+	e.PutTypes = append([]string(nil), e.PutTypes...)
+	e.Schema = e.Schema.Copy()
+	return e, nil
+}
+
+func (db *MemoryStore) Commit(ctx context.Context, keyID string, endpoint string, field string, notifications []Notification) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	keySet, ok := db.keys[keyID]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	commitCounter(&keySet, field)
+	db.keys[keyID] = keySet
+	for _, notification := range notifications {
+		db.enqueueWebhook(notification.URL, notification.Payload)
+	}
+	return nil
+}
+
+func (db *MemoryStore) Release(ctx context.Context, keyID string, endpoint string, field string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	keySet, ok := db.keys[keyID]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	err := releaseCounter(&keySet, endpoint, field)
+	if err != nil {
+		return err
+	}
+	db.keys[keyID] = keySet
+	return nil
+}
+
+func (db *MemoryStore) ReserveBytes(ctx context.Context, keyID string, endpoint string, n int64) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	keySet, ok := db.keys[keyID]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	err := reserveBytes(&keySet, endpoint, n)
+	if err != nil {
+		return err
+	}
+	db.keys[keyID] = keySet
+	return nil
+}
+
+func (db *MemoryStore) ReleaseBytes(ctx context.Context, keyID string, endpoint string, n int64) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	keySet, ok := db.keys[keyID]
+	if !ok {
+		return ErrKeyNotFound
+	}
+	err := releaseBytes(&keySet, endpoint, n)
+	if err != nil {
+		return err
+	}
+	db.keys[keyID] = keySet
+	return nil
+}
+
+func (db *MemoryStore) DeleteExpiredKeys(ctx context.Context) (deleted int64, err error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for k, keySet := range db.keys {
+		if isExpired(keySet) {
+			db.deleteKey(k)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (db *MemoryStore) CountKeys(ctx context.Context) (int64, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	return int64(len(db.keys)), nil
+}
+
+func (db *MemoryStore) AddAuditEvent(ctx context.Context, event AuditEvent) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.lastEvent++
+	event.ID = db.lastEvent
+	event.Lineage = ""
+	if keySet, ok := db.keys[event.KeyID]; ok {
+		event.ParentID = keySet.ParentID
+	}
+	_, known := db.keys[event.KeyID]
+	if _, ok := db.keys[event.ParentID]; ok || (known && event.ParentID == "") {
+		lineage := event.KeyID + "/"
+		for id := event.ParentID; id != ""; id = db.keys[id].ParentID {
+			lineage = id + "/" + lineage
+		}
+		event.Lineage = "/" + lineage
+	}
+	db.events = append(db.events, event)
+	if len(db.events) > memoryAuditEvents {
+		// copied so the dropped events can be freed
+		db.events = append([]AuditEvent(nil), db.events[len(db.events)-memoryAuditEvents*9/10:]...)
+	}
+	return nil
+}
+
+func (db *MemoryStore) AuditEvents(ctx context.Context, viewerID string, filter AuditFilter) (events []AuditEvent, err error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for i := len(db.events) - 1; i >= 0 && len(events) < filter.Limit; i-- {
+		if auditMatches(db.events[i], viewerID, filter) {
+			events = append(events, db.events[i])
+		}
+	}
+	return events, nil
+}
+
+func (db *MemoryStore) EnqueueWebhook(ctx context.Context, url string, payload []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.enqueueWebhook(url, payload)
+	return nil
+}
+
+// enqueueWebhook adds a webhook to the outbox. db.lock must be held.
+func (db *MemoryStore) enqueueWebhook(url string, payload []byte) {
+	db.lastWebhook++
+	now := time.Now().UnixMilli()
+	db.webhooks = append(db.webhooks, Webhook{ID: db.lastWebhook, URL: url, Payload: append([]byte(nil), payload...), NextAttempt: now, CreatedAt: now})
+}
+
+func (db *MemoryStore) ClaimWebhooks(ctx context.Context, now int64, leaseUntil int64, limit int) (webhooks []Webhook, err error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for i := range db.webhooks {
+		if len(webhooks) == limit {
+			break
+		}
+		if !db.webhooks[i].Failed && db.webhooks[i].NextAttempt <= now {
+			db.webhooks[i].NextAttempt = leaseUntil
+			webhooks = append(webhooks, db.webhooks[i])
+		}
+	}
+	return webhooks, nil
+}
+
+func (db *MemoryStore) DeleteWebhook(ctx context.Context, id int64) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for i := range db.webhooks {
+		if db.webhooks[i].ID == id {
+			db.removeWebhook(i)
+			return nil
+		}
+	}
+	return nil
+}
+
+// removeWebhook drops the webhook at index i of the outbox, clearing the slot
+// it leaves at the end so its payload can be freed. db.lock must be held.
+func (db *MemoryStore) removeWebhook(i int) {
+	last := len(db.webhooks) - 1
+	copy(db.webhooks[i:], db.webhooks[i+1:])
+	db.webhooks[last] = Webhook{}
+	db.webhooks = db.webhooks[:last]
+}
+
+func (db *MemoryStore) RetryWebhook(ctx context.Context, id int64, nextAttempt int64, failed bool, lastError string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for i := range db.webhooks {
+		if db.webhooks[i].ID == id {
+			db.webhooks[i].Attempts++
+			db.webhooks[i].NextAttempt = nextAttempt
+			db.webhooks[i].Failed = failed
+			db.webhooks[i].LastError = lastError
+			break
+		}
+	}
+	if !failed {
+		return nil
+	}
+	oldest, count := -1, 0
+	for i := range db.webhooks {
+		if db.webhooks[i].Failed {
+			if oldest < 0 {
+				oldest = i
+			}
+			count++
+		}
+	}
+	// the outbox is in ID order, so the first failed webhook is the oldest
+	if count > memoryFailedWebhooks {
+		db.removeWebhook(oldest)
+	}
+	return nil
+}
+
+func (db *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (db *MemoryStore) Close() error {
+	return nil
+}
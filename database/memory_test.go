@@ -0,0 +1,70 @@
+package database
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMemoryStoreCapsAuditEvents(t *testing.T) {
+	db := NewMemoryStore()
+	ctx := context.Background()
+	total := memoryAuditEvents + memoryAuditEvents/2
+	for i := 0; i < total; i++ {
+		err := db.AddAuditEvent(ctx, AuditEvent{KeyID: "k", Action: "GET"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(db.events) > memoryAuditEvents {
+		t.Errorf("kept %d audit events, want at most %d", len(db.events), memoryAuditEvents)
+	}
+	events, err := db.AuditEvents(ctx, "", AuditFilter{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].ID != int64(total) {
+		t.Errorf("newest event %+v, want ID %d", events, total)
+	}
+	for i := 1; i < len(db.events); i++ {
+		if db.events[i].ID != db.events[i-1].ID+1 {
+			t.Fatalf("event IDs %d and %d are not consecutive", db.events[i-1].ID, db.events[i].ID)
+		}
+	}
+}
+
+func TestMemoryStorePrunesWebhooks(t *testing.T) {
+	db := NewMemoryStore()
+	ctx := context.Background()
+	total := memoryFailedWebhooks + 10
+	for i := 0; i < total+1; i++ {
+		err := db.EnqueueWebhook(ctx, "https://hooks.example.org/", []byte(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the first is delivered, the rest given up on
+	err := db.DeleteWebhook(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := int64(2); id <= int64(total)+1; id++ {
+		err = db.RetryWebhook(ctx, id, 0, true, "refused")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(db.webhooks) != memoryFailedWebhooks {
+		t.Fatalf("kept %d webhooks, want the %d newest failed ones", len(db.webhooks), memoryFailedWebhooks)
+	}
+	if first := db.webhooks[0].ID; first != int64(total-memoryFailedWebhooks)+2 {
+		t.Errorf("oldest kept webhook %d, want %d", first, total-memoryFailedWebhooks+2)
+	}
+	for _, webhook := range db.webhooks {
+		if webhook.ID == 1 || !webhook.Failed {
+			t.Fatalf("kept webhook %+v", webhook)
+		}
+	}
+	if spare := db.webhooks[:cap(db.webhooks)]; len(spare) > len(db.webhooks) && spare[len(db.webhooks)].Payload != nil {
+		t.Error("removed webhook still referenced past the end of the outbox")
+	}
+}
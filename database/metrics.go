@@ -0,0 +1,208 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "exius_db_query_duration_seconds",
+		Help:    "Time taken by key store operations.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"operation", "result"})
+	expiredSweeps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exius_expired_key_sweeps_total",
+		Help: "Sweeps for expired keys, by result.",
+	}, []string{"result"})
+	expiredKeysDeleted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "exius_expired_keys_deleted_total",
+		Help: "Expired keys removed by sweeps.",
+	})
+)
+
+// RegisterKeyCount exposes the number of keys in db as a gauge, counted on
+// every scrape.
+func RegisterKeyCount(db KeyStore) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "exius_keys",
+		Help: "Keys in the key store, including expired keys not yet swept.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		count, err := db.CountKeys(ctx)
+		if err != nil {
+			slog.Error("failed to count keys", "err", err)
+			return math.NaN()
+		}
+		return float64(count)
+	})
+}
+
+// InstrumentedStore times every operation of the KeyStore it wraps.
+type InstrumentedStore struct {
+	KeyStore
+}
+
+func observe(operation string, start time.Time, err error) {
+	result := "ok"
+	if errors.Is(err, ErrKeyNotFound) {
+		result = "not_found"
+	} else if err != nil {
+		result = "error"
+	}
+	queryDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+func (db InstrumentedStore) AddKey(ctx context.Context, keyset KeySet) error {
+	start := time.Now()
+	err := db.KeyStore.AddKey(ctx, keyset)
+	observe("AddKey", start, err)
+	return err
+}
+
+func (db InstrumentedStore) GetKey(ctx context.Context, keyValue string) (KeySet, error) {
+	start := time.Now()
+	result, err := db.KeyStore.GetKey(ctx, keyValue)
+	observe("GetKey", start, err)
+	return result, err
+}
+
+func (db InstrumentedStore) DeleteKey(ctx context.Context, keyID string, cascade bool) error {
+	start := time.Now()
+	err := db.KeyStore.DeleteKey(ctx, keyID, cascade)
+	observe("DeleteKey", start, err)
+	return err
+}
+
+func (db InstrumentedStore) GetChildren(ctx context.Context, keyID string, recursive bool) ([]KeySet, error) {
+	start := time.Now()
+	result, err := db.KeyStore.GetChildren(ctx, keyID, recursive)
+	observe("GetChildren", start, err)
+	return result, err
+}
+
+func (db InstrumentedStore) GetEndpointNames(ctx context.Context, keyID string) ([]string, error) {
+	start := time.Now()
+	result, err := db.KeyStore.GetEndpointNames(ctx, keyID)
+	observe("GetEndpointNames", start, err)
+	return result, err
+}
+
+func (db InstrumentedStore) GetBoolFieldAndPath(ctx context.Context, keyID string, endpoint string, field string) (string, bool, error) {
+	start := time.Now()
+	path, truth, err := db.KeyStore.GetBoolFieldAndPath(ctx, keyID, endpoint, field)
+	observe("GetBoolFieldAndPath", start, err)
+	return path, truth, err
+}
+
+func (db InstrumentedStore) Reserve(ctx context.Context, keyID string, endpoint string, field string) (Endpoint, error) {
+	start := time.Now()
+	result, err := db.KeyStore.Reserve(ctx, keyID, endpoint, field)
+	observe("Reserve", start, err)
+	return result, err
+}
+
+func (db InstrumentedStore) Commit(ctx context.Context, keyID string, endpoint string, field string, notifications []Notification) error {
+	start := time.Now()
+	err := db.KeyStore.Commit(ctx, keyID, endpoint, field, notifications)
+	observe("Commit", start, err)
+	return err
+}
+
+func (db InstrumentedStore) Release(ctx context.Context, keyID string, endpoint string, field string) error {
+	start := time.Now()
+	err := db.KeyStore.Release(ctx, keyID, endpoint, field)
+	observe("Release", start, err)
+	return err
+}
+
+func (db InstrumentedStore) ReserveBytes(ctx context.Context, keyID string, endpoint string, n int64) error {
+	start := time.Now()
+	err := db.KeyStore.ReserveBytes(ctx, keyID, endpoint, n)
+	observe("ReserveBytes", start, err)
+	return err
+}
+
+func (db InstrumentedStore) ReleaseBytes(ctx context.Context, keyID string, endpoint string, n int64) error {
+	start := time.Now()
+	err := db.KeyStore.ReleaseBytes(ctx, keyID, endpoint, n)
+	observe("ReleaseBytes", start, err)
+	return err
+}
+
+func (db InstrumentedStore) UpdateKey(ctx context.Context, keyID string, change func(keySet *KeySet, parent KeySet, children []KeySet) error) error {
+	start := time.Now()
+	err := db.KeyStore.UpdateKey(ctx, keyID, change)
+	observe("UpdateKey", start, err)
+	return err
+}
+
+func (db InstrumentedStore) DeleteExpiredKeys(ctx context.Context) (int64, error) {
+	start := time.Now()
+	result, err := db.KeyStore.DeleteExpiredKeys(ctx)
+	observe("DeleteExpiredKeys", start, err)
+	return result, err
+}
+
+func (db InstrumentedStore) CountKeys(ctx context.Context) (int64, error) {
+	start := time.Now()
+	result, err := db.KeyStore.CountKeys(ctx)
+	observe("CountKeys", start, err)
+	return result, err
+}
+
+func (db InstrumentedStore) AddAuditEvent(ctx context.Context, event AuditEvent) error {
+	start := time.Now()
+	err := db.KeyStore.AddAuditEvent(ctx, event)
+	observe("AddAuditEvent", start, err)
+	return err
+}
+
+func (db InstrumentedStore) AuditEvents(ctx context.Context, viewerID string, filter AuditFilter) ([]AuditEvent, error) {
+	start := time.Now()
+	result, err := db.KeyStore.AuditEvents(ctx, viewerID, filter)
+	observe("AuditEvents", start, err)
+	return result, err
+}
+
+func (db InstrumentedStore) EnqueueWebhook(ctx context.Context, url string, payload []byte) error {
+	start := time.Now()
+	err := db.KeyStore.EnqueueWebhook(ctx, url, payload)
+	observe("EnqueueWebhook", start, err)
+	return err
+}
+
+func (db InstrumentedStore) ClaimWebhooks(ctx context.Context, now int64, leaseUntil int64, limit int) ([]Webhook, error) {
+	start := time.Now()
+	result, err := db.KeyStore.ClaimWebhooks(ctx, now, leaseUntil, limit)
+	observe("ClaimWebhooks", start, err)
+	return result, err
+}
+
+func (db InstrumentedStore) DeleteWebhook(ctx context.Context, id int64) error {
+	start := time.Now()
+	err := db.KeyStore.DeleteWebhook(ctx, id)
+	observe("DeleteWebhook", start, err)
+	return err
+}
+
+func (db InstrumentedStore) RetryWebhook(ctx context.Context, id int64, nextAttempt int64, failed bool, lastError string) error {
+	start := time.Now()
+	err := db.KeyStore.RetryWebhook(ctx, id, nextAttempt, failed, lastError)
+	observe("RetryWebhook", start, err)
+	return err
+}
+
+func (db InstrumentedStore) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := db.KeyStore.Ping(ctx)
+	observe("Ping", start, err)
+	return err
+}
@@ -0,0 +1,271 @@
+package database
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations live in migrations/<dialect>/NNNN_name.up.sql with an optional
+// NNNN_name.down.sql, and are applied in version order.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationState struct {
+	Migration
+	Applied bool
+	// AppliedAt is in unix milliseconds, like the expiry times of keys.
+	AppliedAt int64
+	// Legacy is set on applied migrations that the keys table reflects but
+	// schema_migrations does not record yet, because it predates it. The next
+	// MigrateUp records them without running them again.
+	Legacy bool
+}
+
+var ErrIrreversible = errors.New("migration has no down step")
+
+// Migrator is implemented by the stores that keep a schema.
+type Migrator interface {
+	MigrationStatus(ctx context.Context) ([]MigrationState, error)
+	MigrateUp(ctx context.Context) ([]Migration, error)
+	MigrateDown(ctx context.Context, steps int) ([]Migration, error)
+	Close() error
+}
+
+// OpenMigrator connects to the store selected by driver without applying any
+// migrations, for the migrate subcommand.
+func OpenMigrator(driver string, url string) (Migrator, error) {
+	switch driver {
+	case "", "postgres":
+		return ConnectDB(url)
+	case "sqlite":
+		return OpenSQLite(url)
+	case "memory":
+		return nil, errors.New("the memory store has no schema to migrate")
+	}
+	return nil, fmt.Errorf("unknown database driver %q", driver)
+}
+
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		direction := ""
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected migration file %s", name)
+		}
+		base := strings.TrimSuffix(name, "."+direction+".sql")
+		prefix, migrationName, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration file %s has no version", name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration file %s has no version", name)
+		}
+		b, err := migrationFiles.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: migrationName}
+			byVersion[version] = m
+		}
+		if m.Name != migrationName {
+			return nil, fmt.Errorf("migration %d has two names, %s and %s", version, m.Name, migrationName)
+		}
+		if direction == "up" {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d has no up step", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// schema is one store's view of its schema_migrations table. Every call is
+// made while the store's migration lock is held.
+type schema interface {
+	migrationsTableExists(ctx context.Context) (bool, error)
+	createMigrationsTable(ctx context.Context) error
+	// legacyVersion works out which migration an unversioned keys table,
+	// created before schema_migrations existed, corresponds to.
+	legacyVersion(ctx context.Context) (int, error)
+	applied(ctx context.Context) (map[int]int64, error)
+	record(ctx context.Context, m Migration) error
+	apply(ctx context.Context, m Migration, up bool) error
+}
+
+// legacyVersionFromColumns maps the columns of an unversioned keys table, in
+// lower case, to the migration that produces them.
+func legacyVersionFromColumns(columns map[string]bool) int {
+	switch {
+	case len(columns) == 0:
+		return 0
+	case columns["keyvalue"]:
+		return 1
+	case columns["parentid"]:
+		return 3
+	}
+	return 2
+}
+
+// prepareSchema makes sure schema_migrations exists and, the first time it is
+// created on an existing database, marks the migrations the keys table already
+// reflects as applied.
+func prepareSchema(ctx context.Context, s schema, migrations []Migration) (map[int]int64, error) {
+	err := s.createMigrationsTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+	done, err := s.applied(ctx)
+	if err != nil || len(done) > 0 {
+		return done, err
+	}
+	legacy, err := s.legacyVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range migrations {
+		if m.Version > legacy {
+			break
+		}
+		err = s.record(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.applied(ctx)
+}
+
+// migrationStatus reports which migrations are applied without changing the
+// database. Those an unversioned keys table reflects are reported as Legacy
+// rather than recorded the way prepareSchema would.
+func migrationStatus(ctx context.Context, s schema, migrations []Migration) ([]MigrationState, error) {
+	exists, err := s.migrationsTableExists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	done := map[int]int64{}
+	if exists {
+		done, err = s.applied(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	legacy := 0
+	if len(done) == 0 {
+		legacy, err = s.legacyVersion(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		appliedAt, ok := done[m.Version]
+		isLegacy := !ok && m.Version <= legacy
+		states = append(states, MigrationState{Migration: m, Applied: ok || isLegacy, AppliedAt: appliedAt, Legacy: isLegacy})
+	}
+	return states, nil
+}
+
+func checkKnownVersions(done map[int]int64, migrations []Migration) error {
+	known := make(map[int]bool, len(migrations))
+	for _, m := range migrations {
+		known[m.Version] = true
+	}
+	for version := range done {
+		if !known[version] {
+			return fmt.Errorf("database has migration %d applied, which this build does not know about", version)
+		}
+	}
+	return nil
+}
+
+func migrateUp(ctx context.Context, s schema, migrations []Migration) (applied []Migration, err error) {
+	done, err := prepareSchema(ctx, s, migrations)
+	if err != nil {
+		return nil, err
+	}
+	err = checkKnownVersions(done, migrations)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range migrations {
+		if _, ok := done[m.Version]; ok {
+			continue
+		}
+		err = s.apply(ctx, m, true)
+		if err != nil {
+			return applied, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// migrateDown reverts the last steps applied migrations, newest first. Nothing
+// is reverted if any of them has no down step.
+func migrateDown(ctx context.Context, s schema, migrations []Migration, steps int) (reverted []Migration, err error) {
+	done, err := prepareSchema(ctx, s, migrations)
+	if err != nil {
+		return nil, err
+	}
+	err = checkKnownVersions(done, migrations)
+	if err != nil {
+		return nil, err
+	}
+	var plan []Migration
+	for i := len(migrations) - 1; i >= 0 && len(plan) < steps; i-- {
+		if _, ok := done[migrations[i].Version]; ok {
+			plan = append(plan, migrations[i])
+		}
+	}
+	for _, m := range plan {
+		if m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, ErrIrreversible)
+		}
+	}
+	for _, m := range plan {
+		err = s.apply(ctx, m, false)
+		if err != nil {
+			return reverted, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		reverted = append(reverted, m)
+	}
+	return reverted, nil
+}
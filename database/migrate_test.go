@@ -0,0 +1,62 @@
+package database
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrationStatusIsReadOnly(t *testing.T) {
+	ctx := context.Background()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "keys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	migrations, err := loadMigrations("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a keys table from before schema_migrations existed
+	_, err = db.Conn.ExecContext(ctx, migrations[0].Up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		states, err := db.MigrationStatus(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(states) != len(migrations) {
+			t.Fatalf("status of %d migrations, want %d", len(states), len(migrations))
+		}
+		for _, state := range states {
+			legacy := state.Version == 1
+			if state.Applied != legacy || state.Legacy != legacy {
+				t.Errorf("%04d_%s: applied %v, legacy %v", state.Version, state.Name, state.Applied, state.Legacy)
+			}
+		}
+		var tables int
+		err = db.Conn.QueryRowContext(ctx, `SELECT count(*) FROM sqlite_master WHERE name='schema_migrations'`).Scan(&tables)
+		if err != nil || tables != 0 {
+			t.Fatalf("status created schema_migrations: %d, %v", tables, err)
+		}
+	}
+
+	applied, err := db.MigrateUp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations)-1 || applied[0].Version != 2 {
+		t.Errorf("up applied %v, want every migration after the legacy one", applied)
+	}
+	states, err := db.MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range states {
+		if !state.Applied || state.Legacy || state.AppliedAt == 0 {
+			t.Errorf("%04d_%s after up: %+v", state.Version, state.Name, state)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+CREATE TABLE keys(
+	CanCreateChild BOOLEAN,
+	KeyValue TEXT,
+	Endpoints JSONB,
+	InitiateExpire TEXT,
+	ExpireDelta BIGINT,
+	ExpireStarted BOOLEAN,
+	ExpireStartTime BIGINT,
+	PRIMARY KEY(KeyValue));
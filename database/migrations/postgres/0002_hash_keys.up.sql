@@ -0,0 +1,13 @@
+-- Replaces the plaintext KeyValue column with its id, salt and hash, computed
+-- the same way as hash.go. The pepper is read from the exius.key_pepper
+-- setting of the transaction. There is no down migration: the plaintext keys
+-- are gone once this has run.
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+ALTER TABLE keys ADD COLUMN KeyID TEXT, ADD COLUMN KeyHash TEXT, ADD COLUMN KeySalt TEXT;
+UPDATE keys SET KeySalt=encode(gen_random_bytes(16), 'hex');
+UPDATE keys SET
+	KeyID=substr(encode(hmac(KeyValue, current_setting('exius.key_pepper'), 'sha256'), 'hex'), 1, 16),
+	KeyHash=encode(hmac(KeySalt || KeyValue, current_setting('exius.key_pepper'), 'sha256'), 'hex');
+ALTER TABLE keys DROP CONSTRAINT keys_pkey;
+ALTER TABLE keys DROP COLUMN KeyValue;
+ALTER TABLE keys ADD PRIMARY KEY (KeyID), ALTER COLUMN KeyHash SET NOT NULL, ALTER COLUMN KeySalt SET NOT NULL;
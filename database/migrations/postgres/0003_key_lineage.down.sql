@@ -0,0 +1,2 @@
+DROP INDEX keys_parent;
+ALTER TABLE keys DROP COLUMN ParentID;
@@ -0,0 +1,4 @@
+UPDATE keys SET Endpoints=COALESCE((
+	SELECT jsonb_object_agg(name, endpoint - 'MaxTotalBytes' - 'TotalBytes')
+	FROM jsonb_each(Endpoints) AS e(name, endpoint)), '{}'::jsonb);
+ALTER TABLE keys DROP COLUMN MaxTotalBytes, DROP COLUMN TotalBytes;
@@ -0,0 +1,6 @@
+-- Existing keys and endpoints get an unlimited byte quota.
+ALTER TABLE keys ADD COLUMN MaxTotalBytes BIGINT NOT NULL DEFAULT 9223372036854775807,
+	ADD COLUMN TotalBytes BIGINT NOT NULL DEFAULT 0;
+UPDATE keys SET Endpoints=COALESCE((
+	SELECT jsonb_object_agg(name, '{"MaxTotalBytes": 9223372036854775807, "TotalBytes": 0}'::jsonb || endpoint)
+	FROM jsonb_each(Endpoints) AS e(name, endpoint)), '{}'::jsonb);
@@ -0,0 +1,21 @@
+-- Replaces the plaintext KeyValue column with its id, salt and hash using the
+-- exius_key_* functions registered on every connection. There is no down
+-- migration: the plaintext keys are gone once this has run.
+ALTER TABLE keys ADD COLUMN KeySalt TEXT;
+UPDATE keys SET KeySalt=exius_key_salt();
+ALTER TABLE keys RENAME TO keys_plaintext;
+CREATE TABLE keys(
+	KeyID TEXT,
+	KeyHash TEXT NOT NULL,
+	KeySalt TEXT NOT NULL,
+	CanCreateChild BOOLEAN,
+	Endpoints TEXT,
+	InitiateExpire TEXT,
+	ExpireDelta BIGINT,
+	ExpireStarted BOOLEAN,
+	ExpireStartTime BIGINT,
+	PRIMARY KEY(KeyID));
+INSERT INTO keys (KeyID, KeyHash, KeySalt, CanCreateChild, Endpoints, InitiateExpire, ExpireDelta, ExpireStarted, ExpireStartTime)
+	SELECT exius_key_id(KeyValue), exius_key_hash(KeyValue, KeySalt), KeySalt, CanCreateChild, Endpoints, InitiateExpire, ExpireDelta, ExpireStarted, ExpireStartTime
+	FROM keys_plaintext;
+DROP TABLE keys_plaintext;
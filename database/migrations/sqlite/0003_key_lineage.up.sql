@@ -0,0 +1,2 @@
+ALTER TABLE keys ADD COLUMN ParentID TEXT;
+CREATE INDEX keys_parent ON keys(ParentID);
@@ -0,0 +1,5 @@
+UPDATE keys SET Endpoints=COALESCE((
+	SELECT json_group_object(e.key, json_remove(e.value, '$.MaxTotalBytes', '$.TotalBytes'))
+	FROM json_each(keys.Endpoints) AS e), '{}');
+ALTER TABLE keys DROP COLUMN MaxTotalBytes;
+ALTER TABLE keys DROP COLUMN TotalBytes;
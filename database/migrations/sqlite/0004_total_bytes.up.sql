@@ -0,0 +1,6 @@
+-- Existing keys and endpoints get an unlimited byte quota.
+ALTER TABLE keys ADD COLUMN MaxTotalBytes BIGINT NOT NULL DEFAULT 9223372036854775807;
+ALTER TABLE keys ADD COLUMN TotalBytes BIGINT NOT NULL DEFAULT 0;
+UPDATE keys SET Endpoints=COALESCE((
+	SELECT json_group_object(e.key, json_patch('{"MaxTotalBytes": 9223372036854775807, "TotalBytes": 0}', e.value))
+	FROM json_each(keys.Endpoints) AS e), '{}');
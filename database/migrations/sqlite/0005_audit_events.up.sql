@@ -0,0 +1,17 @@
+CREATE TABLE audit_events(
+	ID INTEGER PRIMARY KEY AUTOINCREMENT,
+	Time BIGINT NOT NULL,
+	KeyID TEXT NOT NULL,
+	ParentID TEXT NOT NULL,
+	Action TEXT NOT NULL,
+	Endpoint TEXT NOT NULL,
+	Path TEXT NOT NULL,
+	TargetKeyID TEXT NOT NULL,
+	Status INTEGER NOT NULL,
+	RequestBytes BIGINT NOT NULL,
+	ResponseBytes BIGINT NOT NULL,
+	ContentType TEXT NOT NULL,
+	ClientIP TEXT NOT NULL,
+	Lineage TEXT NOT NULL);
+CREATE INDEX audit_events_time ON audit_events(Time);
+CREATE INDEX audit_events_key ON audit_events(KeyID);
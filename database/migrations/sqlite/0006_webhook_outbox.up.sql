@@ -0,0 +1,10 @@
+CREATE TABLE webhook_outbox(
+	ID INTEGER PRIMARY KEY AUTOINCREMENT,
+	URL TEXT NOT NULL,
+	Payload TEXT NOT NULL,
+	Attempts INTEGER NOT NULL DEFAULT 0,
+	NextAttempt BIGINT NOT NULL,
+	CreatedAt BIGINT NOT NULL,
+	LastError TEXT NOT NULL DEFAULT '',
+	Failed BOOLEAN NOT NULL DEFAULT FALSE);
+CREATE INDEX webhook_outbox_due ON webhook_outbox(NextAttempt) WHERE NOT Failed;
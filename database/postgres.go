@@ -0,0 +1,700 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// connectTimeout is how long ConnectDB keeps retrying a database that is not
+// up yet, and queryTimeout bounds each query of the stores it returns.
+var (
+	connectTimeout = 10 * time.Minute
+	queryTimeout   = 5 * time.Second
+)
+
+// SetTimeouts sets how long postgres stores opened from now on wait for the
+// database to come up and for each query.
+func SetTimeouts(connect time.Duration, query time.Duration) {
+	connectTimeout, queryTimeout = connect, query
+}
+
+// PostgresStore keeps keys in postgres. Queries run on a connection pool, so
+// concurrent requests do not wait on each other, and each query is bounded by
+// QueryTimeout on top of whatever deadline the caller's context carries.
+type PostgresStore struct {
+	Pool         *pgxpool.Pool
+	QueryTimeout time.Duration
+}
+
+func (db *PostgresStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, db.QueryTimeout)
+}
+
+const postgresKeyColumns = `KeyID, ParentID, KeyHash, KeySalt, CanCreateChild, Endpoints, MaxTotalBytes, TotalBytes, InitiateExpire, ExpireDelta, ExpireStarted, ExpireStartTime`
+
+func scanPostgresKey(row pgx.Row) (keySet KeySet, err error) {
+	var parentID *string
+	err = row.Scan(
+		&keySet.KeyID,
+		&parentID,
+		&keySet.KeyHash,
+		&keySet.KeySalt,
+		&keySet.CanCreateChild,
+		&keySet.Endpoints,
+		&keySet.MaxTotalBytes,
+		&keySet.TotalBytes,
+		&keySet.InitiateExpire,
+		&keySet.ExpireDelta,
+		&keySet.ExpireStarted,
+		&keySet.ExpireStartTime)
+	if parentID != nil {
+		keySet.ParentID = *parentID
+	}
+	return keySet, err
+}
+
+func (db *PostgresStore) AddKey(ctx context.Context, keyset KeySet) (err error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	keyset, err = hashKeySet(keyset)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(keyset.Endpoints)
+	if err != nil {
+		return err
+	}
+	_, err = db.Pool.Exec(ctx, `INSERT INTO keys (`+postgresKeyColumns+`) VALUES ($1,NULLIF($2,''),$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)`, keyset.KeyID, keyset.ParentID, keyset.KeyHash, keyset.KeySalt, keyset.CanCreateChild, b, keyset.MaxTotalBytes, keyset.TotalBytes, keyset.InitiateExpire, keyset.ExpireDelta, keyset.ExpireStarted, keyset.ExpireStartTime)
+	if err != nil {
+		// 23505 is unique_violation, the KeyID is already taken
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrKeyExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (db *PostgresStore) keyByID(ctx context.Context, keyID string) (keySet KeySet, err error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	keySet, err = scanPostgresKey(db.Pool.QueryRow(ctx, `select `+postgresKeyColumns+` from keys where KeyID=$1`, keyID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return keySet, ErrKeyNotFound
+	}
+	return keySet, err
+}
+
+func (db *PostgresStore) GetKey(ctx context.Context, keyValue string) (keySet KeySet, err error) {
+	keySet, err = db.keyByID(ctx, KeyID(keyValue))
+	if err != nil {
+		return keySet, err
+	}
+	if !verifyKey(keyValue, keySet) {
+		return KeySet{}, ErrKeyNotFound
+	}
+	keySet.KeyValue = keyValue
+	return keySet, nil
+}
+
+func (db *PostgresStore) DeleteKey(ctx context.Context, keyID string, cascade bool) (err error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	if cascade {
+		_, err = db.Pool.Exec(ctx, `WITH RECURSIVE tree(KeyID) AS (
+			SELECT $1::TEXT UNION SELECT k.KeyID FROM keys k JOIN tree t ON k.ParentID=t.KeyID)
+			DELETE FROM keys WHERE KeyID IN (SELECT KeyID FROM tree)`, keyID)
+		return err
+	}
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `UPDATE keys SET ParentID=(SELECT p.ParentID FROM keys p WHERE p.KeyID=$1) WHERE ParentID=$1`, keyID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "DELETE from keys where KeyID=$1;", keyID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (db *PostgresStore) GetChildren(ctx context.Context, keyID string, recursive bool) (keys []KeySet, err error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	query := `select ` + postgresKeyColumns + ` from keys where ParentID=$1`
+	if recursive {
+		query = `WITH RECURSIVE tree(KeyID) AS (
+			SELECT KeyID FROM keys WHERE ParentID=$1 UNION SELECT k.KeyID FROM keys k JOIN tree t ON k.ParentID=t.KeyID)
+			select ` + postgresKeyColumns + ` from keys where KeyID IN (SELECT KeyID FROM tree)`
+	}
+	rows, err := db.Pool.Query(ctx, query, keyID)
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		keySet, err := scanPostgresKey(rows)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, keySet)
+	}
+	return keys, rows.Err()
+}
+
+// UpdateKey locks the key's row for the length of the change, so quota
+// reservations made meanwhile are not overwritten. Its parent and children
+// are locked for share, the parent first as every update locks rows from the
+// top of the tree down, so an update of one of them waits rather than checking
+// against limits that are about to change.
+func (db *PostgresStore) UpdateKey(ctx context.Context, keyID string, change func(keySet *KeySet, parent KeySet, children []KeySet) error) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	parent, err := scanPostgresKey(tx.QueryRow(ctx, `select `+postgresKeyColumns+` from keys where KeyID=(select ParentID from keys where KeyID=$1) for share`, keyID))
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	keySet, err := scanPostgresKey(tx.QueryRow(ctx, `select `+postgresKeyColumns+` from keys where KeyID=$1 for update`, keyID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if isExpired(keySet) {
+		return ErrKeyExpired
+	}
+	if keySet.ParentID != parent.KeyID {
+		return errors.New("key was moved to another parent during the update")
+	}
+	rows, err := tx.Query(ctx, `select `+postgresKeyColumns+` from keys where ParentID=$1 for share`, keyID)
+	if err != nil {
+		return err
+	}
+	var children []KeySet
+	for rows.Next() {
+		child, err := scanPostgresKey(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		children = append(children, child)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	err = change(&keySet, parent, children)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(keySet.Endpoints)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `update keys set CanCreateChild=$2, Endpoints=$3, MaxTotalBytes=$4, TotalBytes=$5, ExpireDelta=$6, ExpireStarted=$7, ExpireStartTime=$8 where KeyID=$1`,
+		keyID, keySet.CanCreateChild, b, keySet.MaxTotalBytes, keySet.TotalBytes, keySet.ExpireDelta, keySet.ExpireStarted, keySet.ExpireStartTime)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// DeleteExpiredKeys removes every expired key. Children of expired keys are
+// first handed up past any chain of expired ancestors so lineage survives.
+func (db *PostgresStore) DeleteExpiredKeys(ctx context.Context) (int64, error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	now := time.Now().UnixMilli()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	for {
+		tag, err := tx.Exec(ctx, `UPDATE keys c SET ParentID=p.ParentID FROM keys p
+			WHERE c.ParentID=p.KeyID AND p.ExpireStarted AND p.ExpireDelta < $1-p.ExpireStartTime`, now)
+		if err != nil {
+			return 0, err
+		}
+		if tag.RowsAffected() == 0 {
+			break
+		}
+	}
+	tag, err := tx.Exec(ctx, "DELETE from keys where ExpireStarted=true AND ExpireDelta < $1-ExpireStartTime;", now)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), tx.Commit(ctx)
+}
+
+func (db *PostgresStore) CountKeys(ctx context.Context) (count int64, err error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err = db.Pool.QueryRow(ctx, `SELECT count(*) FROM keys`).Scan(&count)
+	return count, err
+}
+
+func (db *PostgresStore) Ping(ctx context.Context) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	return db.Pool.Ping(ctx)
+}
+
+func (db *PostgresStore) Close() error {
+	db.Pool.Close()
+	return nil
+}
+
+func InitiateConnect(url string, timeOut time.Duration) (pool *pgxpool.Pool, err error) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	timeoutTriggered := time.After(timeOut)
+	for {
+		select {
+		case <-timeoutTriggered:
+			return nil, fmt.Errorf("db connection failed")
+
+		case <-ticker.C:
+			pool, err = pgxpool.Connect(context.Background(), url)
+			if err == nil {
+				err = pool.Ping(context.Background())
+			}
+			if err == nil {
+				return pool, nil
+			}
+			if pool != nil {
+				pool.Close()
+			}
+			slog.Warn("failed to create connection", "err", err)
+		}
+	}
+}
+
+// postgresMigrationLock is the advisory lock key held while migrating, so
+// replicas starting together apply each migration once.
+const postgresMigrationLock = 0x657869757300
+
+type postgresSchema struct {
+	conn *pgxpool.Conn
+}
+
+func (s postgresSchema) migrationsTableExists(ctx context.Context) (bool, error) {
+	var exists bool
+	err := s.conn.QueryRow(ctx, `select exists (select 1 from information_schema.tables
+		where table_schema=current_schema() AND table_name='schema_migrations')`).Scan(&exists)
+	return exists, err
+}
+
+func (s postgresSchema) createMigrationsTable(ctx context.Context) error {
+	_, err := s.conn.Exec(ctx, `create table if not exists
+	schema_migrations(Version BIGINT,
+		Name TEXT NOT NULL,
+		AppliedAt BIGINT NOT NULL,
+		PRIMARY KEY(Version))`)
+	return err
+}
+
+func (s postgresSchema) legacyVersion(ctx context.Context) (int, error) {
+	rows, err := s.conn.Query(ctx, `select column_name from information_schema.columns
+		where table_schema=current_schema() AND table_name='keys'`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var column string
+		err = rows.Scan(&column)
+		if err != nil {
+			return 0, err
+		}
+		columns[strings.ToLower(column)] = true
+	}
+	return legacyVersionFromColumns(columns), rows.Err()
+}
+
+func (s postgresSchema) applied(ctx context.Context) (map[int]int64, error) {
+	rows, err := s.conn.Query(ctx, `select Version, AppliedAt from schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	done := make(map[int]int64)
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		done[version] = appliedAt
+	}
+	return done, rows.Err()
+}
+
+func (s postgresSchema) record(ctx context.Context, m Migration) error {
+	_, err := s.conn.Exec(ctx, `insert into schema_migrations (Version, Name, AppliedAt) values ($1,$2,$3)`, m.Version, m.Name, time.Now().UnixMilli())
+	return err
+}
+
+// apply runs one migration and records it in the same transaction. The pepper
+// is exposed to the migration as the exius.key_pepper setting.
+func (s postgresSchema) apply(ctx context.Context, m Migration, up bool) error {
+	tx, err := s.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `select set_config('exius.key_pepper', $1, true)`, string(keyPepper))
+	if err != nil {
+		return err
+	}
+	if up {
+		_, err = tx.Exec(ctx, m.Up)
+		if err == nil {
+			_, err = tx.Exec(ctx, `insert into schema_migrations (Version, Name, AppliedAt) values ($1,$2,$3)`, m.Version, m.Name, time.Now().UnixMilli())
+		}
+	} else {
+		_, err = tx.Exec(ctx, m.Down)
+		if err == nil {
+			_, err = tx.Exec(ctx, `delete from schema_migrations where Version=$1`, m.Version)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// withSchema runs f while holding the migration advisory lock.
+func (db *PostgresStore) withSchema(ctx context.Context, f func(s schema, migrations []Migration) error) error {
+	migrations, err := loadMigrations("postgres")
+	if err != nil {
+		return err
+	}
+	conn, err := db.Pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	_, err = conn.Exec(ctx, `select pg_advisory_lock($1)`, postgresMigrationLock)
+	if err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), `select pg_advisory_unlock($1)`, postgresMigrationLock)
+	return f(postgresSchema{conn: conn}, migrations)
+}
+
+func (db *PostgresStore) MigrationStatus(ctx context.Context) (states []MigrationState, err error) {
+	err = db.withSchema(ctx, func(s schema, migrations []Migration) error {
+		states, err = migrationStatus(ctx, s, migrations)
+		return err
+	})
+	return states, err
+}
+
+func (db *PostgresStore) MigrateUp(ctx context.Context) (applied []Migration, err error) {
+	err = db.withSchema(ctx, func(s schema, migrations []Migration) error {
+		applied, err = migrateUp(ctx, s, migrations)
+		return err
+	})
+	return applied, err
+}
+
+func (db *PostgresStore) MigrateDown(ctx context.Context, steps int) (reverted []Migration, err error) {
+	err = db.withSchema(ctx, func(s schema, migrations []Migration) error {
+		reverted, err = migrateDown(ctx, s, migrations, steps)
+		return err
+	})
+	return reverted, err
+}
+
+// ConnectDB connects to postgres without touching the schema.
+func ConnectDB(url string) (*PostgresStore, error) {
+	pool, err := InitiateConnect(url, connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("connection created")
+	return &PostgresStore{
+		Pool:         pool,
+		QueryTimeout: queryTimeout,
+	}, nil
+}
+
+// BuildDB connects to postgres and brings the schema up to date.
+func BuildDB(url string) (*PostgresStore, error) {
+	db, err := ConnectDB(url)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := db.MigrateUp(context.Background())
+	for _, m := range applied {
+		slog.Info("applied migration", "version", m.Version, "name", m.Name)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func DestroyDB(url string) error {
+	conn, err := pgx.Connect(context.Background(), url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	_, err = conn.Exec(context.Background(), "drop table keys")
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(context.Background(), "drop table if exists schema_migrations")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (db *PostgresStore) GetEndpointNames(ctx context.Context, keyID string) (names []string, err error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err = db.Pool.QueryRow(ctx, "select ARRAY(select jsonb_object_keys(Endpoints) from keys where KeyID=$1);", keyID).Scan(&names)
+	if err != nil {
+		return names, err
+	}
+	return names, nil
+}
+
+// gets field and the path, if expired, deletes
+func (db *PostgresStore) GetBoolFieldAndPath(ctx context.Context, keyID string, endpoint string, field string) (path string, truth bool, err error) {
+	var expireStart int64
+	var expireDelta int64
+	var expireStarted bool
+	queryCtx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err = db.Pool.QueryRow(queryCtx, "select Endpoints -> $1 -> 'Path', Endpoints -> $1 -> $2, ExpireDelta, ExpireStartTime, ExpireStarted from keys where KeyID=$3", endpoint, field, keyID).Scan(
+		&path,
+		&truth,
+		&expireDelta,
+		&expireStart,
+		&expireStarted)
+	if expireStarted && time.Now().UnixMilli()-expireStart > expireDelta {
+		err = db.DeleteKey(ctx, keyID, false)
+		if err != nil {
+			return path, truth, err
+		}
+		return path, truth, ErrKeyExpired
+	}
+	if err != nil {
+		return path, truth, err
+	}
+	return path, truth, nil
+}
+
+// Reserve takes a quota slot with a single conditional update, so two
+// requests racing for the last slot cannot both get it. When no row is updated
+// the key is read back to explain why.
+func (db *PostgresStore) Reserve(ctx context.Context, keyID string, endpoint string, field string) (e Endpoint, err error) {
+	quota, ok := quotaFields[field]
+	if !ok {
+		return e, fmt.Errorf("no counter for %s", field)
+	}
+	queryCtx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	err = db.Pool.QueryRow(queryCtx, `
+		update keys set
+		Endpoints=jsonb_set(Endpoints, ARRAY[$2::TEXT, $3::TEXT], to_jsonb((Endpoints -> $2 ->> $3)::BIGINT + 1))
+		where KeyID=$1
+		AND (Endpoints -> $2 ->> $4)::BOOLEAN
+		AND (Endpoints -> $2 ->> $3)::BIGINT < (Endpoints -> $2 ->> $5)::BIGINT
+		AND NOT (ExpireStarted AND ExpireDelta < $6-ExpireStartTime)
+		returning Endpoints -> $2`, keyID, endpoint, quota.count, field, quota.max, time.Now().UnixMilli()).Scan(&e)
+	if err == nil {
+		return e, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return e, err
+	}
+	keySet, err := db.keyByID(ctx, keyID)
+	if err != nil {
+		return e, err
+	}
+	if isExpired(keySet) {
+		err = db.DeleteKey(ctx, keyID, false)
+		if err != nil {
+			return e, err
+		}
+		return e, ErrKeyExpired
+	}
+	err = reserveError(keySet, endpoint, field)
+	if err == nil {
+		// the slot was freed between the update and the read
+		return e, errors.New("quota changed during reservation")
+	}
+	return e, err
+}
+
+func (db *PostgresStore) Commit(ctx context.Context, keyID string, endpoint string, field string, notifications []Notification) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	tx, err := db.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	now := time.Now().UnixMilli()
+	_, err = tx.Exec(ctx, `
+		update keys set ExpireStartTime=$2, ExpireStarted=true
+		where KeyID=$1 AND InitiateExpire=$3 AND NOT ExpireStarted`, keyID, now, field)
+	if err != nil {
+		return err
+	}
+	for _, notification := range notifications {
+		_, err = tx.Exec(ctx, `INSERT INTO webhook_outbox (URL, Payload, NextAttempt, CreatedAt) VALUES ($1, $2, $3, $3)`, notification.URL, string(notification.Payload), now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+func (db *PostgresStore) Release(ctx context.Context, keyID string, endpoint string, field string) error {
+	quota, ok := quotaFields[field]
+	if !ok {
+		return fmt.Errorf("no counter for %s", field)
+	}
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	_, err := db.Pool.Exec(ctx, `
+		update keys set
+		Endpoints=jsonb_set(Endpoints, ARRAY[$2::TEXT, $3::TEXT], to_jsonb(GREATEST((Endpoints -> $2 ->> $3)::BIGINT - 1, 0)))
+		where KeyID=$1 AND Endpoints ? $2`, keyID, endpoint, quota.count)
+	return err
+}
+
+// ReserveBytes charges the endpoint and the key in one conditional update, so
+// concurrent uploads cannot together pass either limit.
+func (db *PostgresStore) ReserveBytes(ctx context.Context, keyID string, endpoint string, n int64) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	tag, err := db.Pool.Exec(ctx, `
+		update keys set
+		TotalBytes=TotalBytes+$3,
+		Endpoints=jsonb_set(Endpoints, ARRAY[$2::TEXT, 'TotalBytes'], to_jsonb((Endpoints -> $2 ->> 'TotalBytes')::BIGINT + $3))
+		where KeyID=$1 AND Endpoints ? $2
+		AND TotalBytes <= MaxTotalBytes-$3
+		AND (Endpoints -> $2 ->> 'TotalBytes')::BIGINT <= (Endpoints -> $2 ->> 'MaxTotalBytes')::BIGINT-$3`, keyID, endpoint, n)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrByteQuota
+	}
+	return nil
+}
+
+func (db *PostgresStore) ReleaseBytes(ctx context.Context, keyID string, endpoint string, n int64) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	_, err := db.Pool.Exec(ctx, `
+		update keys set
+		TotalBytes=GREATEST(TotalBytes-$3, 0),
+		Endpoints=jsonb_set(Endpoints, ARRAY[$2::TEXT, 'TotalBytes'], to_jsonb(GREATEST((Endpoints -> $2 ->> 'TotalBytes')::BIGINT - $3, 0)))
+		where KeyID=$1 AND Endpoints ? $2`, keyID, endpoint, n)
+	return err
+}
+
+func (db *PostgresStore) AddAuditEvent(ctx context.Context, event AuditEvent) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	_, err := db.Pool.Exec(ctx, `INSERT INTO audit_events (Time, KeyID, ParentID, Action, Endpoint, Path, TargetKeyID, Status, RequestBytes, ResponseBytes, ContentType, ClientIP, Lineage)
+		VALUES ($2, $1, COALESCE((SELECT ParentID FROM keys WHERE KeyID=$1), $12), $3, $4, $5, $6, $7, $8, $9, $10, $11,
+			COALESCE((`+fmt.Sprintf(auditLineage, "$1")+`), (`+fmt.Sprintf(auditLineage, "$12")+`) || $1 || '/', ''))`,
+		event.KeyID, event.Time, event.Action, event.Endpoint, event.Path, event.TargetKeyID, event.Status, event.RequestBytes, event.ResponseBytes, event.ContentType, event.ClientIP, event.ParentID)
+	return err
+}
+
+func (db *PostgresStore) AuditEvents(ctx context.Context, viewerID string, filter AuditFilter) (events []AuditEvent, err error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	where, args := auditWhere(viewerID, filter, func(n int) string { return fmt.Sprintf("$%d", n) })
+	args = append(args, filter.Limit)
+	rows, err := db.Pool.Query(ctx, `SELECT `+auditColumns+` FROM audit_events`+where+fmt.Sprintf(` ORDER BY ID DESC LIMIT $%d`, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event AuditEvent
+		err = rows.Scan(&event.ID, &event.Time, &event.KeyID, &event.ParentID, &event.Action, &event.Endpoint, &event.Path, &event.TargetKeyID, &event.Status, &event.RequestBytes, &event.ResponseBytes, &event.ContentType, &event.ClientIP, &event.Lineage)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (db *PostgresStore) EnqueueWebhook(ctx context.Context, url string, payload []byte) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	now := time.Now().UnixMilli()
+	_, err := db.Pool.Exec(ctx, `INSERT INTO webhook_outbox (URL, Payload, NextAttempt, CreatedAt) VALUES ($1, $2, $3, $3)`, url, string(payload), now)
+	return err
+}
+
+func (db *PostgresStore) ClaimWebhooks(ctx context.Context, now int64, leaseUntil int64, limit int) (webhooks []Webhook, err error) {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	rows, err := db.Pool.Query(ctx, `UPDATE webhook_outbox SET NextAttempt=$1 WHERE ID IN (
+		SELECT ID FROM webhook_outbox WHERE NOT Failed AND NextAttempt<=$2 ORDER BY NextAttempt LIMIT $3 FOR UPDATE SKIP LOCKED)
+		RETURNING `+webhookColumns, leaseUntil, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (db *PostgresStore) DeleteWebhook(ctx context.Context, id int64) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	_, err := db.Pool.Exec(ctx, `DELETE FROM webhook_outbox WHERE ID=$1`, id)
+	return err
+}
+
+func (db *PostgresStore) RetryWebhook(ctx context.Context, id int64, nextAttempt int64, failed bool, lastError string) error {
+	ctx, cancel := db.withTimeout(ctx)
+	defer cancel()
+	_, err := db.Pool.Exec(ctx, `UPDATE webhook_outbox SET Attempts=Attempts+1, NextAttempt=$2, Failed=$3, LastError=$4 WHERE ID=$1`, id, nextAttempt, failed, lastError)
+	return err
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// testStores opens an empty store of each kind that runs without a server.
+func testStores(t *testing.T) map[string]KeyStore {
+	db, err := BuildSQLite(filepath.Join(t.TempDir(), "keys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return map[string]KeyStore{"memory": NewMemoryStore(), "sqlite": db}
+}
+
+func putCount(t *testing.T, db KeyStore, keyValue string) int {
+	t.Helper()
+	keySet, err := db.GetKey(context.Background(), keyValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keySet.Endpoints["bench"].PutCount
+}
+
+func TestConcurrentReserveTakesOneSlot(t *testing.T) {
+	for name, db := range testStores(t) {
+		ctx := context.Background()
+		keyValue, err := addBenchKey(ctx, db, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyID := KeyID(keyValue)
+		var reserved atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < 32; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := db.Reserve(ctx, keyID, "bench", "Put")
+				if err == nil {
+					reserved.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := reserved.Load(); n != 1 {
+			t.Errorf("%s: %d of 32 concurrent reservations of MaxPut 1 succeeded", name, n)
+		}
+		if n := putCount(t, db, keyValue); n != 1 {
+			t.Errorf("%s: PutCount %d after the race, want 1", name, n)
+		}
+	}
+}
+
+func TestReleaseReturnsSlot(t *testing.T) {
+	for name, db := range testStores(t) {
+		ctx := context.Background()
+		keyValue, err := addBenchKey(ctx, db, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyID := KeyID(keyValue)
+		_, err = db.Reserve(ctx, keyID, "bench", "Put")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		_, err = db.Reserve(ctx, keyID, "bench", "Put")
+		if err == nil {
+			t.Errorf("%s: second reservation of MaxPut 1 succeeded", name)
+		}
+		err = db.Release(ctx, keyID, "bench", "Put")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if n := putCount(t, db, keyValue); n != 0 {
+			t.Errorf("%s: PutCount %d after release, want 0", name, n)
+		}
+		_, err = db.Reserve(ctx, keyID, "bench", "Put")
+		if err != nil {
+			t.Errorf("%s: released slot not reusable: %v", name, err)
+		}
+		// a release without a reservation leaves the count at zero
+		for i := 0; i < 2; i++ {
+			err = db.Release(ctx, keyID, "bench", "Put")
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		if n := putCount(t, db, keyValue); n != 0 {
+			t.Errorf("%s: PutCount %d after releasing twice, want 0", name, n)
+		}
+		err = db.Release(ctx, keyID, "missing", "Put")
+		if err == nil {
+			t.Errorf("%s: release of an unknown endpoint succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,600 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteStore keeps keys in an embedded sqlite file. Endpoints are stored as a
+// json document and updated by rewriting the row inside an immediate
+// transaction, which sqlite serializes for us.
+type SQLiteStore struct {
+	Conn *sql.DB
+}
+
+func sqliteDSN(path string) string {
+	params := "_txlock=immediate&_busy_timeout=5000"
+	if strings.Contains(path, "?") {
+		return "file:" + path + "&" + params
+	}
+	return "file:" + path + "?" + params
+}
+
+func init() {
+	// exposes key hashing to sql so existing rows can be migrated in place
+	sql.Register("sqlite3_exius", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			err := conn.RegisterFunc("exius_key_id", KeyID, true)
+			if err != nil {
+				return err
+			}
+			err = conn.RegisterFunc("exius_key_hash", hashKey, true)
+			if err != nil {
+				return err
+			}
+			return conn.RegisterFunc("exius_key_salt", newKeySalt, false)
+		},
+	})
+}
+
+type sqliteSchema struct {
+	tx *sql.Tx
+}
+
+func (s sqliteSchema) migrationsTableExists(ctx context.Context) (bool, error) {
+	var n int
+	err := s.tx.QueryRowContext(ctx, `SELECT count(*) FROM sqlite_master WHERE type='table' AND name='schema_migrations'`).Scan(&n)
+	return n > 0, err
+}
+
+func (s sqliteSchema) createMigrationsTable(ctx context.Context) error {
+	_, err := s.tx.ExecContext(ctx, `create table if not exists
+	schema_migrations(Version INTEGER,
+		Name TEXT NOT NULL,
+		AppliedAt BIGINT NOT NULL,
+		PRIMARY KEY(Version))`)
+	return err
+}
+
+func (s sqliteSchema) legacyVersion(ctx context.Context) (int, error) {
+	rows, err := s.tx.QueryContext(ctx, `SELECT name FROM pragma_table_info('keys')`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var column string
+		err = rows.Scan(&column)
+		if err != nil {
+			return 0, err
+		}
+		columns[strings.ToLower(column)] = true
+	}
+	return legacyVersionFromColumns(columns), rows.Err()
+}
+
+func (s sqliteSchema) applied(ctx context.Context) (map[int]int64, error) {
+	rows, err := s.tx.QueryContext(ctx, `SELECT Version, AppliedAt FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	done := make(map[int]int64)
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		done[version] = appliedAt
+	}
+	return done, rows.Err()
+}
+
+func (s sqliteSchema) record(ctx context.Context, m Migration) error {
+	_, err := s.tx.ExecContext(ctx, `INSERT INTO schema_migrations (Version, Name, AppliedAt) VALUES (?,?,?)`, m.Version, m.Name, time.Now().UnixMilli())
+	return err
+}
+
+func (s sqliteSchema) apply(ctx context.Context, m Migration, up bool) error {
+	if !up {
+		_, err := s.tx.ExecContext(ctx, m.Down)
+		if err != nil {
+			return err
+		}
+		_, err = s.tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE Version=?`, m.Version)
+		return err
+	}
+	_, err := s.tx.ExecContext(ctx, m.Up)
+	if err != nil {
+		return err
+	}
+	return s.record(ctx, m)
+}
+
+// withSchema runs f inside one immediate transaction, which locks out other
+// writers for the whole run and rolls every migration back if one fails.
+func (db *SQLiteStore) withSchema(ctx context.Context, f func(s schema, migrations []Migration) error) error {
+	migrations, err := loadMigrations("sqlite")
+	if err != nil {
+		return err
+	}
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = f(sqliteSchema{tx: tx}, migrations)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *SQLiteStore) MigrationStatus(ctx context.Context) (states []MigrationState, err error) {
+	err = db.withSchema(ctx, func(s schema, migrations []Migration) error {
+		states, err = migrationStatus(ctx, s, migrations)
+		return err
+	})
+	return states, err
+}
+
+func (db *SQLiteStore) MigrateUp(ctx context.Context) (applied []Migration, err error) {
+	err = db.withSchema(ctx, func(s schema, migrations []Migration) error {
+		applied, err = migrateUp(ctx, s, migrations)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+func (db *SQLiteStore) MigrateDown(ctx context.Context, steps int) (reverted []Migration, err error) {
+	err = db.withSchema(ctx, func(s schema, migrations []Migration) error {
+		reverted, err = migrateDown(ctx, s, migrations, steps)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reverted, nil
+}
+
+// OpenSQLite opens the sqlite file without touching the schema.
+func OpenSQLite(path string) (*SQLiteStore, error) {
+	if path == "" {
+		return nil, errors.New("no sqlite path given")
+	}
+	conn, err := sql.Open("sqlite3_exius", sqliteDSN(path))
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteStore{Conn: conn}, nil
+}
+
+// BuildSQLite opens the sqlite file and brings the schema up to date.
+func BuildSQLite(path string) (*SQLiteStore, error) {
+	db, err := OpenSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := db.MigrateUp(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, m := range applied {
+		slog.Info("applied migration", "version", m.Version, "name", m.Name)
+	}
+	slog.Info("sqlite store opened")
+	return db, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSQLiteKey(row rowScanner) (keySet KeySet, err error) {
+	var endpoints string
+	var parentID sql.NullString
+	err = row.Scan(
+		&keySet.KeyID,
+		&parentID,
+		&keySet.KeyHash,
+		&keySet.KeySalt,
+		&keySet.CanCreateChild,
+		&endpoints,
+		&keySet.MaxTotalBytes,
+		&keySet.TotalBytes,
+		&keySet.InitiateExpire,
+		&keySet.ExpireDelta,
+		&keySet.ExpireStarted,
+		&keySet.ExpireStartTime)
+	if err != nil {
+		return keySet, err
+	}
+	keySet.ParentID = parentID.String
+	err = json.Unmarshal([]byte(endpoints), &keySet.Endpoints)
+	return keySet, err
+}
+
+const sqliteKeyColumns = `KeyID, ParentID, KeyHash, KeySalt, CanCreateChild, Endpoints, MaxTotalBytes, TotalBytes, InitiateExpire, ExpireDelta, ExpireStarted, ExpireStartTime`
+
+func (db *SQLiteStore) AddKey(ctx context.Context, keyset KeySet) error {
+	keyset, err := hashKeySet(keyset)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(keyset.Endpoints)
+	if err != nil {
+		return err
+	}
+	_, err = db.Conn.ExecContext(ctx, `INSERT INTO keys (`+sqliteKeyColumns+`) VALUES (?,?,?,?,?,?,?,?,?,?,?,?)`, keyset.KeyID, sql.NullString{String: keyset.ParentID, Valid: keyset.ParentID != ""}, keyset.KeyHash, keyset.KeySalt, keyset.CanCreateChild, string(b), keyset.MaxTotalBytes, keyset.TotalBytes, keyset.InitiateExpire, keyset.ExpireDelta, keyset.ExpireStarted, keyset.ExpireStartTime)
+	if err != nil {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			return ErrKeyExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (db *SQLiteStore) GetKey(ctx context.Context, keyValue string) (KeySet, error) {
+	keySet, err := scanSQLiteKey(db.Conn.QueryRowContext(ctx, `SELECT `+sqliteKeyColumns+` FROM keys WHERE KeyID=?`, KeyID(keyValue)))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !verifyKey(keyValue, keySet)) {
+		return KeySet{}, ErrKeyNotFound
+	}
+	keySet.KeyValue = keyValue
+	return keySet, err
+}
+
+const sqliteReparentChildren = `UPDATE keys SET ParentID=(SELECT p.ParentID FROM keys p WHERE p.KeyID=keys.ParentID) WHERE ParentID=?`
+
+func (db *SQLiteStore) DeleteKey(ctx context.Context, keyID string, cascade bool) error {
+	if cascade {
+		_, err := db.Conn.ExecContext(ctx, `WITH RECURSIVE tree(KeyID) AS (
+			SELECT ? UNION SELECT k.KeyID FROM keys k JOIN tree t ON k.ParentID=t.KeyID)
+			DELETE FROM keys WHERE KeyID IN tree`, keyID)
+		return err
+	}
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, sqliteReparentChildren, keyID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `DELETE FROM keys WHERE KeyID=?`, keyID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *SQLiteStore) GetChildren(ctx context.Context, keyID string, recursive bool) (keys []KeySet, err error) {
+	query := `SELECT ` + sqliteKeyColumns + ` FROM keys WHERE ParentID=?`
+	if recursive {
+		query = `WITH RECURSIVE tree(KeyID) AS (
+			SELECT KeyID FROM keys WHERE ParentID=? UNION SELECT k.KeyID FROM keys k JOIN tree t ON k.ParentID=t.KeyID)
+			SELECT ` + sqliteKeyColumns + ` FROM keys WHERE KeyID IN tree`
+	}
+	rows, err := db.Conn.QueryContext(ctx, query, keyID)
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		keySet, err := scanSQLiteKey(rows)
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, keySet)
+	}
+	return keys, rows.Err()
+}
+
+func (db *SQLiteStore) GetEndpointNames(ctx context.Context, keyID string) ([]string, error) {
+	keySet, err := db.keyByID(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(keySet.Endpoints))
+	for k := range keySet.Endpoints {
+		names = append(names, k)
+	}
+	return names, nil
+}
+
+func (db *SQLiteStore) keyByID(ctx context.Context, keyID string) (KeySet, error) {
+	keySet, err := scanSQLiteKey(db.Conn.QueryRowContext(ctx, `SELECT `+sqliteKeyColumns+` FROM keys WHERE KeyID=?`, keyID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return keySet, ErrKeyNotFound
+	}
+	return keySet, err
+}
+
+// endpoint loads a key's endpoint, deleting the key if it has expired.
+func (db *SQLiteStore) endpoint(ctx context.Context, keyID string, endpoint string) (Endpoint, error) {
+	keySet, err := db.keyByID(ctx, keyID)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	if isExpired(keySet) {
+		err = db.DeleteKey(ctx, keyID, false)
+		if err != nil {
+			return Endpoint{}, err
+		}
+	}
+	return lookupEndpoint(keySet, endpoint)
+}
+
+func (db *SQLiteStore) GetBoolFieldAndPath(ctx context.Context, keyID string, endpoint string, field string) (path string, truth bool, err error) {
+	e, err := db.endpoint(ctx, keyID, endpoint)
+	if err != nil {
+		return path, truth, err
+	}
+	return e.Path, endpointField(e, field), nil
+}
+
+// update loads a key inside an immediate transaction, applies change to it and
+// writes the endpoints and expiry back.
+func (db *SQLiteStore) update(ctx context.Context, keyID string, change func(keySet *KeySet) error) error {
+	return db.updateAndNotify(ctx, keyID, change, nil)
+}
+
+// updateAndNotify is update that also adds notifications to the webhook
+// outbox, in the same transaction.
+func (db *SQLiteStore) updateAndNotify(ctx context.Context, keyID string, change func(keySet *KeySet) error, notifications []Notification) error {
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	keySet, err := scanSQLiteKey(tx.QueryRowContext(ctx, `SELECT `+sqliteKeyColumns+` FROM keys WHERE KeyID=?`, keyID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = change(&keySet)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(keySet.Endpoints)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE keys SET CanCreateChild=?, Endpoints=?, MaxTotalBytes=?, TotalBytes=?, ExpireDelta=?, ExpireStarted=?, ExpireStartTime=? WHERE KeyID=?`,
+		keySet.CanCreateChild, string(b), keySet.MaxTotalBytes, keySet.TotalBytes, keySet.ExpireDelta, keySet.ExpireStarted, keySet.ExpireStartTime, keyID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixMilli()
+	for _, notification := range notifications {
+		_, err = tx.ExecContext(ctx, `INSERT INTO webhook_outbox (URL, Payload, NextAttempt, CreatedAt) VALUES (?, ?, ?, ?)`, notification.URL, string(notification.Payload), now, now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *SQLiteStore) UpdateKey(ctx context.Context, keyID string, change func(keySet *KeySet, parent KeySet, children []KeySet) error) error {
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	keySet, err := scanSQLiteKey(tx.QueryRowContext(ctx, `SELECT `+sqliteKeyColumns+` FROM keys WHERE KeyID=?`, keyID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if isExpired(keySet) {
+		return ErrKeyExpired
+	}
+	var parent KeySet
+	if keySet.ParentID != "" {
+		parent, err = scanSQLiteKey(tx.QueryRowContext(ctx, `SELECT `+sqliteKeyColumns+` FROM keys WHERE KeyID=?`, keySet.ParentID))
+		if err != nil {
+			return err
+		}
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT `+sqliteKeyColumns+` FROM keys WHERE ParentID=?`, keyID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var children []KeySet
+	for rows.Next() {
+		child, err := scanSQLiteKey(rows)
+		if err != nil {
+			return err
+		}
+		children = append(children, child)
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	err = change(&keySet, parent, children)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(keySet.Endpoints)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE keys SET CanCreateChild=?, Endpoints=?, MaxTotalBytes=?, TotalBytes=?, ExpireDelta=?, ExpireStarted=?, ExpireStartTime=? WHERE KeyID=?`,
+		keySet.CanCreateChild, string(b), keySet.MaxTotalBytes, keySet.TotalBytes, keySet.ExpireDelta, keySet.ExpireStarted, keySet.ExpireStartTime, keyID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *SQLiteStore) Reserve(ctx context.Context, keyID string, endpoint string, field string) (e Endpoint, err error) {
+	expired := false
+	err = db.update(ctx, keyID, func(keySet *KeySet) error {
+		if isExpired(*keySet) {
+			expired = true
+			return ErrKeyExpired
+		}
+		e, err = reserveCounter(keySet, endpoint, field)
+		return err
+	})
+	if expired {
+		db.DeleteKey(ctx, keyID, false)
+	}
+	return e, err
+}
+
+func (db *SQLiteStore) Commit(ctx context.Context, keyID string, endpoint string, field string, notifications []Notification) error {
+	return db.updateAndNotify(ctx, keyID, func(keySet *KeySet) error {
+		commitCounter(keySet, field)
+		return nil
+	}, notifications)
+}
+
+func (db *SQLiteStore) Release(ctx context.Context, keyID string, endpoint string, field string) error {
+	return db.update(ctx, keyID, func(keySet *KeySet) error {
+		return releaseCounter(keySet, endpoint, field)
+	})
+}
+
+func (db *SQLiteStore) ReserveBytes(ctx context.Context, keyID string, endpoint string, n int64) error {
+	return db.update(ctx, keyID, func(keySet *KeySet) error {
+		return reserveBytes(keySet, endpoint, n)
+	})
+}
+
+func (db *SQLiteStore) ReleaseBytes(ctx context.Context, keyID string, endpoint string, n int64) error {
+	return db.update(ctx, keyID, func(keySet *KeySet) error {
+		return releaseBytes(keySet, endpoint, n)
+	})
+}
+
+// DeleteExpiredKeys removes every expired key. Children of expired keys are
+// first handed up past any chain of expired ancestors so lineage survives.
+func (db *SQLiteStore) DeleteExpiredKeys(ctx context.Context) (int64, error) {
+	now := time.Now().UnixMilli()
+	tx, err := db.Conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for {
+		res, err := tx.ExecContext(ctx, `UPDATE keys SET ParentID=(SELECT p.ParentID FROM keys p WHERE p.KeyID=keys.ParentID)
+			WHERE ParentID IN (SELECT KeyID FROM keys WHERE ExpireStarted AND ExpireDelta < ?-ExpireStartTime)`, now)
+		if err != nil {
+			return 0, err
+		}
+		reparented, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if reparented == 0 {
+			break
+		}
+	}
+	res, err := tx.ExecContext(ctx, `DELETE FROM keys WHERE ExpireStarted AND ExpireDelta < ?-ExpireStartTime`, now)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return deleted, tx.Commit()
+}
+
+func (db *SQLiteStore) CountKeys(ctx context.Context) (count int64, err error) {
+	err = db.Conn.QueryRowContext(ctx, `SELECT count(*) FROM keys`).Scan(&count)
+	return count, err
+}
+
+func (db *SQLiteStore) AddAuditEvent(ctx context.Context, event AuditEvent) error {
+	_, err := db.Conn.ExecContext(ctx, `INSERT INTO audit_events (Time, KeyID, ParentID, Action, Endpoint, Path, TargetKeyID, Status, RequestBytes, ResponseBytes, ContentType, ClientIP, Lineage)
+		VALUES (?2, ?1, COALESCE((SELECT ParentID FROM keys WHERE KeyID=?1), ?12), ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11,
+			COALESCE((`+fmt.Sprintf(auditLineage, "?1")+`), (`+fmt.Sprintf(auditLineage, "?12")+`) || ?1 || '/', ''))`,
+		event.KeyID, event.Time, event.Action, event.Endpoint, event.Path, event.TargetKeyID, event.Status, event.RequestBytes, event.ResponseBytes, event.ContentType, event.ClientIP, event.ParentID)
+	return err
+}
+
+func (db *SQLiteStore) AuditEvents(ctx context.Context, viewerID string, filter AuditFilter) (events []AuditEvent, err error) {
+	where, args := auditWhere(viewerID, filter, func(n int) string { return "?" })
+	args = append(args, filter.Limit)
+	rows, err := db.Conn.QueryContext(ctx, `SELECT `+auditColumns+` FROM audit_events`+where+` ORDER BY ID DESC LIMIT ?`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event AuditEvent
+		err = rows.Scan(&event.ID, &event.Time, &event.KeyID, &event.ParentID, &event.Action, &event.Endpoint, &event.Path, &event.TargetKeyID, &event.Status, &event.RequestBytes, &event.ResponseBytes, &event.ContentType, &event.ClientIP, &event.Lineage)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (db *SQLiteStore) EnqueueWebhook(ctx context.Context, url string, payload []byte) error {
+	now := time.Now().UnixMilli()
+	_, err := db.Conn.ExecContext(ctx, `INSERT INTO webhook_outbox (URL, Payload, NextAttempt, CreatedAt) VALUES (?, ?, ?, ?)`, url, string(payload), now, now)
+	return err
+}
+
+func (db *SQLiteStore) ClaimWebhooks(ctx context.Context, now int64, leaseUntil int64, limit int) (webhooks []Webhook, err error) {
+	rows, err := db.Conn.QueryContext(ctx, `UPDATE webhook_outbox SET NextAttempt=? WHERE ID IN (
+		SELECT ID FROM webhook_outbox WHERE NOT Failed AND NextAttempt<=? ORDER BY NextAttempt LIMIT ?)
+		RETURNING `+webhookColumns, leaseUntil, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (db *SQLiteStore) DeleteWebhook(ctx context.Context, id int64) error {
+	_, err := db.Conn.ExecContext(ctx, `DELETE FROM webhook_outbox WHERE ID=?`, id)
+	return err
+}
+
+func (db *SQLiteStore) RetryWebhook(ctx context.Context, id int64, nextAttempt int64, failed bool, lastError string) error {
+	_, err := db.Conn.ExecContext(ctx, `UPDATE webhook_outbox SET Attempts=Attempts+1, NextAttempt=?, Failed=?, LastError=? WHERE ID=?`, nextAttempt, failed, lastError, id)
+	return err
+}
+
+func (db *SQLiteStore) Ping(ctx context.Context) error {
+	return db.Conn.PingContext(ctx)
+}
+
+func (db *SQLiteStore) Close() error {
+	return db.Conn.Close()
+}
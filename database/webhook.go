@@ -0,0 +1,30 @@
+package database
+
+// Webhook is a notification waiting in the outbox. Times are in unix
+// milliseconds. A webhook is deleted once delivered, and kept with Failed set
+// once its attempts run out.
+type Webhook struct {
+	ID          int64
+	URL         string
+	Payload     []byte
+	Attempts    int
+	NextAttempt int64
+	CreatedAt   int64
+	LastError   string
+	Failed      bool
+}
+
+// Notification is a webhook to add to the outbox.
+type Notification struct {
+	URL     string
+	Payload []byte
+}
+
+const webhookColumns = `ID, URL, Payload, Attempts, NextAttempt, CreatedAt, LastError, Failed`
+
+func scanWebhook(row rowScanner) (webhook Webhook, err error) {
+	var payload string
+	err = row.Scan(&webhook.ID, &webhook.URL, &payload, &webhook.Attempts, &webhook.NextAttempt, &webhook.CreatedAt, &webhook.LastError, &webhook.Failed)
+	webhook.Payload = []byte(payload)
+	return webhook, err
+}
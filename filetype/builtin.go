@@ -0,0 +1,186 @@
+package filetype
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+)
+
+// sniffedTypes are the types http.DetectContentType can tell apart. They were
+// the only ones endpoints could name before the registry existed.
+var sniffedTypes = []string{"application/octet-stream", "application/pdf",
+	"application/postscript", "text/plain", "image/x-icon", "image/bmp",
+	"image/gif", "image/webp", "image/png", "image/jpeg", "audio/basic",
+	"audio/aiff", "audio/mpeg", "application/ogg", "audio/midi", "video/avi",
+	"audio/wave", "video/webm", "application/vnd.ms-fontobject", "font/ttf",
+	"font/otf", "font/collection", "font/woff", "font/woff2", "application/x-gzip",
+	"application/zip", "application/x-rar-compressed",
+	"application/wasm", "text/html", "video/mp4"}
+
+func init() {
+	for _, name := range sniffedTypes {
+		Register(Type{Name: name})
+	}
+	Register(Type{
+		Name:        "text/csv",
+		Extensions:  []string{".csv", ".tsv"},
+		Text:        true,
+		CheckParams: checkCSVParams,
+		Validate:    validateCSV,
+	})
+	Register(Type{
+		Name:       "application/json",
+		Extensions: []string{".json"},
+		Text:       true,
+		Validate:   validateJSON,
+	})
+	Register(Type{
+		Name:       "application/vnd.apache.parquet",
+		Extensions: []string{".parquet"},
+		Signatures: []Signature{{Magic: []byte("PAR1")}},
+		Validate:   validateParquet,
+	})
+	Register(Type{
+		Name:       "application/x-hdf5",
+		Extensions: []string{".h5", ".hdf5", ".he5"},
+		Signatures: []Signature{{Magic: []byte("\x89HDF\r\n\x1a\n")}},
+	})
+	Register(Type{
+		Name:       "application/x-edf",
+		Extensions: []string{".edf", ".bdf"},
+		// the version field of an EDF header, or of a BDF one
+		Signatures: []Signature{{Magic: []byte("0       ")}, {Magic: []byte("\xffBIOSEMI")}},
+	})
+	Register(Type{
+		Name:       "application/x-nifti",
+		Extensions: []string{".nii"},
+		// NIfTI-1 and NIfTI-2 single file magic
+		Signatures: []Signature{{Offset: 344, Magic: []byte("n+1\x00")}, {Offset: 4, Magic: []byte("n+2\x00")}},
+	})
+	Register(Type{
+		Name:       "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		Extensions: []string{".xlsx"},
+		Signatures: []Signature{{Magic: []byte("PK\x03\x04")}},
+		Validate:   validateXLSX,
+	})
+}
+
+// checkCSVParams accepts columns, the exact number of fields every record must
+// have, and delimiter, a single character or "tab".
+func checkCSVParams(params map[string]string) error {
+	for k, v := range params {
+		switch k {
+		case "columns":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return fmt.Errorf("columns must be a positive number")
+			}
+		case "delimiter":
+			if v != "tab" && utf8.RuneCountInString(v) != 1 {
+				return fmt.Errorf("delimiter must be a single character or tab")
+			}
+		default:
+			return fmt.Errorf("unknown parameter %s", k)
+		}
+	}
+	return nil
+}
+
+func validateCSV(file File, params map[string]string) error {
+	r := csv.NewReader(file)
+	r.ReuseRecord = true
+	switch delimiter := params["delimiter"]; delimiter {
+	case "":
+	case "tab":
+		r.Comma = '\t'
+	default:
+		r.Comma, _ = utf8.DecodeRuneInString(delimiter)
+	}
+	// records may differ in length unless columns is given
+	r.FieldsPerRecord = -1
+	if columns, ok := params["columns"]; ok {
+		r.FieldsPerRecord, _ = strconv.Atoi(columns)
+	}
+	records := 0
+	for {
+		_, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		records++
+	}
+	if records == 0 {
+		return errors.New("file has no records")
+	}
+	return nil
+}
+
+func validateJSON(file File, params map[string]string) error {
+	dec := json.NewDecoder(file)
+	var v json.RawMessage
+	err := dec.Decode(&v)
+	if err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("file holds more than one json document")
+	}
+	return nil
+}
+
+func fileSize(file File) (int64, error) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return size, err
+}
+
+// validateParquet checks for the magic number parquet files also end with,
+// after their footer.
+func validateParquet(file File, params map[string]string) error {
+	size, err := fileSize(file)
+	if err != nil {
+		return err
+	}
+	if size < 12 {
+		return errors.New("file is too short")
+	}
+	tail := make([]byte, 4)
+	_, err = file.ReadAt(tail, size-4)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(tail, []byte("PAR1")) {
+		return errors.New("file does not end in a parquet footer")
+	}
+	return nil
+}
+
+// validateXLSX tells spreadsheets apart from other zip based formats.
+func validateXLSX(file File, params map[string]string) error {
+	size, err := fileSize(file)
+	if err != nil {
+		return err
+	}
+	archive, err := zip.NewReader(file, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range archive.File {
+		if f.Name == "xl/workbook.xml" {
+			return nil
+		}
+	}
+	return errors.New("archive has no workbook")
+}
@@ -0,0 +1,269 @@
+// Package filetype decides whether an upload is one of the types an endpoint
+// accepts. Types are looked up by name in a registry, so new formats can be
+// added without touching the PUT path.
+package filetype
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// HeadSize is how much of an upload is peeked at for detection.
+const HeadSize = 512
+
+// Any accepts every upload.
+const Any = "any"
+
+// Signature is a run of magic bytes at a fixed offset from the start of a file.
+type Signature struct {
+	Offset int
+	Magic  []byte
+}
+
+// File is a whole upload, spooled so validators can read it more than once.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// Type is one entry of the registry, named in an endpoint's PutTypes.
+type Type struct {
+	Name string
+	// Extensions, lower case and with the dot, that the uploaded file name
+	// must end in. Empty allows any name.
+	Extensions []string
+	// Signatures of which one must match the head of the file.
+	Signatures []Signature
+	// Text types have no signature and match any head that is utf-8 text.
+	// Types with neither signatures nor Text are matched by
+	// http.DetectContentType.
+	Text bool
+	// CheckParams rejects parameters of a PutTypes entry, such as columns in
+	// "text/csv; columns=3", that the type does not understand. Types
+	// without it take no parameters.
+	CheckParams func(params map[string]string) error
+	// Validate, if set, checks the whole file once the head has matched.
+	Validate func(file File, params map[string]string) error
+}
+
+var lock sync.RWMutex
+var registry = map[string]Type{}
+
+// Register adds a type to the registry, replacing any type of the same name.
+func Register(t Type) {
+	lock.Lock()
+	defer lock.Unlock()
+	registry[t.Name] = t
+}
+
+func Lookup(name string) (Type, bool) {
+	lock.RLock()
+	defer lock.RUnlock()
+	t, ok := registry[name]
+	return t, ok
+}
+
+// Names lists every registered type, sorted.
+func Names() []string {
+	lock.RLock()
+	defer lock.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Spec is a parsed PutTypes entry, a type name with optional parameters.
+type Spec struct {
+	Type   Type
+	Params map[string]string
+}
+
+// ParseSpec parses a PutTypes entry such as "text/csv; columns=3".
+func ParseSpec(entry string) (Spec, error) {
+	name, params, err := mime.ParseMediaType(entry)
+	if err != nil {
+		return Spec{}, fmt.Errorf("invalid put type %q: %w", entry, err)
+	}
+	t, ok := Lookup(name)
+	if !ok {
+		return Spec{}, fmt.Errorf("unknown put type %q", name)
+	}
+	if t.CheckParams != nil {
+		err = t.CheckParams(params)
+		if err != nil {
+			return Spec{}, fmt.Errorf("put type %q: %w", name, err)
+		}
+	} else if len(params) > 0 {
+		return Spec{}, fmt.Errorf("put type %q takes no parameters", name)
+	}
+	return Spec{Type: t, Params: params}, nil
+}
+
+// ParseSpecs parses an endpoint's PutTypes, reporting separately whether they
+// include "any".
+func ParseSpecs(entries []string) (specs []Spec, anyType bool, err error) {
+	for _, entry := range entries {
+		if entry == Any {
+			anyType = true
+			continue
+		}
+		spec, err := ParseSpec(entry)
+		if err != nil {
+			return nil, false, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, anyType, nil
+}
+
+// Valid reports whether every PutTypes entry names a registered type with
+// parameters it accepts.
+func Valid(entries []string) error {
+	_, _, err := ParseSpecs(entries)
+	return err
+}
+
+// Within reports whether the child PutTypes accept nothing the parent's do
+// not. A child entry is within a parent entry of the same type that has a
+// subset of its parameters.
+func Within(childEntries []string, parentEntries []string) bool {
+	parents, parentAny, err := ParseSpecs(parentEntries)
+	if err != nil {
+		return false
+	}
+	if parentAny {
+		return true
+	}
+	children, childAny, err := ParseSpecs(childEntries)
+	if err != nil || childAny {
+		return false
+	}
+	for _, child := range children {
+		within := false
+		for _, parent := range parents {
+			if child.Type.Name == parent.Type.Name && paramsWithin(child.Params, parent.Params) {
+				within = true
+				break
+			}
+		}
+		if !within {
+			return false
+		}
+	}
+	return true
+}
+
+func paramsWithin(child map[string]string, parent map[string]string) bool {
+	for k, v := range parent {
+		if child[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func isText(head []byte) bool {
+	if bytes.IndexByte(head, 0) >= 0 {
+		return false
+	}
+	// the head may cut a multi-byte rune in half
+	for i := 0; i < utf8.UTFMax && len(head) > 0; i++ {
+		if utf8.Valid(head) {
+			return true
+		}
+		head = head[:len(head)-1]
+	}
+	return utf8.Valid(head)
+}
+
+// matchHead reports whether the name and head of an upload fit the type,
+// before any validator runs.
+func (t Type) matchHead(filename string, head []byte) bool {
+	if len(t.Extensions) > 0 {
+		name := strings.ToLower(path.Base(filename))
+		matched := false
+		for _, e := range t.Extensions {
+			if strings.HasSuffix(name, e) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(t.Signatures) > 0 {
+		for _, s := range t.Signatures {
+			if len(head) >= s.Offset+len(s.Magic) && bytes.Equal(head[s.Offset:s.Offset+len(s.Magic)], s.Magic) {
+				return true
+			}
+		}
+		return false
+	}
+	if t.Text {
+		return isText(head)
+	}
+	return strings.Split(http.DetectContentType(head), ";")[0] == t.Name
+}
+
+// Match returns the specs whose type fits the name and head of an upload, in
+// PutTypes order.
+func Match(specs []Spec, filename string, head []byte) (matched []Spec) {
+	for _, spec := range specs {
+		if spec.Type.matchHead(filename, head) {
+			matched = append(matched, spec)
+		}
+	}
+	return matched
+}
+
+// NeedsFile reports whether any of the specs has a validator, so the whole
+// upload must be seen before it can be accepted.
+func NeedsFile(specs []Spec) bool {
+	for _, spec := range specs {
+		if spec.Type.Validate != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateFile runs the validators of the matched specs on the whole upload
+// and succeeds if any of them accepts it. The error of the first spec is
+// returned otherwise.
+func ValidateFile(specs []Spec, file File) error {
+	var first error
+	for _, spec := range specs {
+		if spec.Type.Validate == nil {
+			return nil
+		}
+		_, err := file.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		err = spec.Type.Validate(file, spec.Params)
+		if err == nil {
+			return nil
+		}
+		if first == nil {
+			first = fmt.Errorf("not a valid %s: %w", spec.Type.Name, err)
+		}
+	}
+	if first == nil {
+		first = errors.New("file type not accepted")
+	}
+	return first
+}
@@ -0,0 +1,232 @@
+package filetype
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// zipWith returns a zip archive holding empty files of the given names.
+func zipWith(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range names {
+		_, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// at returns a head of HeadSize bytes with magic written at offset.
+func at(offset int, magic string) []byte {
+	head := make([]byte, HeadSize)
+	copy(head[offset:], magic)
+	return head
+}
+
+func parquet(body string) []byte {
+	return []byte("PAR1" + body + "PAR1")
+}
+
+// accepted reports whether an upload named filename passes both the head
+// match and the validator of entry.
+func accepted(t *testing.T, entry string, filename string, content []byte) bool {
+	t.Helper()
+	spec, err := ParseSpec(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := content
+	if len(head) > HeadSize {
+		head = head[:HeadSize]
+	}
+	matched := Match([]Spec{spec}, filename, head)
+	if len(matched) == 0 {
+		return false
+	}
+	return ValidateFile(matched, bytes.NewReader(content)) == nil
+}
+
+func TestBuiltinTypes(t *testing.T) {
+	xlsx := zipWith(t, "[Content_Types].xml", "xl/workbook.xml")
+	for _, tt := range []struct {
+		entry    string
+		filename string
+		content  []byte
+		want     bool
+	}{
+		{"text/csv", "a.csv", []byte("a,b\n1,2\n"), true},
+		{"text/csv", "a.TSV", []byte("a\tb\n"), true},
+		{"text/csv", "a.txt", []byte("a,b\n1,2\n"), false},
+		{"text/csv", "a.csv", []byte("a,\"b\n"), false},
+		{"text/csv", "a.csv", []byte{}, false},
+		{"text/csv", "a.csv", xlsx, false},
+		{"application/json", "a.json", []byte(`{"a": [1, 2]}`), true},
+		{"application/json", "a.json", []byte(`{"a": 1} {"b": 2}`), false},
+		{"application/json", "a.json", []byte(`{"a": `), false},
+		{"application/vnd.apache.parquet", "a.parquet", parquet("footer.."), true},
+		{"application/vnd.apache.parquet", "a.parquet", []byte("PAR1footer..PAR2"), false},
+		{"application/vnd.apache.parquet", "a.parquet", []byte("PAR1PAR1"), false},
+		{"application/vnd.apache.parquet", "a.csv", parquet("footer.."), false},
+		{"application/x-hdf5", "a.h5", []byte("\x89HDF\r\n\x1a\nrest"), true},
+		{"application/x-hdf5", "a.hdf5", []byte("\x89HDF\r\n\x1a"), false},
+		{"application/x-edf", "a.edf", []byte("0       patient"), true},
+		{"application/x-edf", "a.bdf", []byte("\xffBIOSEMIpatient"), true},
+		{"application/x-edf", "a.edf", []byte("1       patient"), false},
+		{"application/x-nifti", "a.nii", at(344, "n+1\x00"), true},
+		{"application/x-nifti", "a.nii", at(4, "n+2\x00"), true},
+		{"application/x-nifti", "a.nii", at(0, "n+1\x00"), false},
+		{"application/x-nifti", "a.nii", at(344, "n+1")[:346], false},
+		{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "a.xlsx", xlsx, true},
+		{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "a.xlsx", zipWith(t, "word/document.xml"), false},
+		{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "a.xlsx", []byte("PK\x03\x04not a zip"), false},
+		{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "a.zip", xlsx, false},
+		{"image/png", "a.png", []byte("\x89PNG\r\n\x1a\nrest"), true},
+		{"image/png", "a.png", []byte("GIF89a"), false},
+		{"application/pdf", "a", []byte("%PDF-1.7"), true},
+		{"application/pdf", "a", []byte("%!PS-Adobe"), false},
+	} {
+		if got := accepted(t, tt.entry, tt.filename, tt.content); got != tt.want {
+			t.Errorf("%s as %s: accepted %v, want %v", tt.filename, tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestEveryTypeRegistered(t *testing.T) {
+	for _, name := range Names() {
+		spec, err := ParseSpec(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if spec.Type.Name != name {
+			t.Errorf("%s parsed to %s", name, spec.Type.Name)
+		}
+	}
+	if _, ok := Lookup("application/x-unknown"); ok {
+		t.Error("unknown type found")
+	}
+}
+
+func TestIsText(t *testing.T) {
+	rune3 := "€"
+	for head, want := range map[string]bool{
+		"plain":                           true,
+		"":                                true,
+		"cut " + rune3[:1]:                true,
+		"cut " + rune3[:2]:                true,
+		"bad \xff in the middle " + rune3: false,
+		"nul \x00":                        false,
+		"bad tail \xff\xff\xff\xff\xff":   false,
+		strings.Repeat("é", HeadSize/2-1) + "\xc3": true,
+	} {
+		if got := isText([]byte(head)); got != want {
+			t.Errorf("isText(%q) = %v, want %v", head, got, want)
+		}
+	}
+}
+
+func TestParseSpec(t *testing.T) {
+	for entry, ok := range map[string]bool{
+		"text/csv":                           true,
+		"text/csv; columns=3":                true,
+		"text/csv; delimiter=tab":            true,
+		"text/csv; delimiter=;":              false,
+		`text/csv; delimiter=";"`:            true,
+		`text/csv; delimiter="|"; columns=2`: true,
+		"text/csv; delimiter=ab":             false,
+		"text/csv; columns=0":                false,
+		"text/csv; columns=x":                false,
+		"text/csv; rows=3":                   false,
+		"application/json; columns=3":        false,
+		"image/png; q=1":                     false,
+		"application/x-unknown":              false,
+		"not a type":                         false,
+	} {
+		if _, err := ParseSpec(entry); (err == nil) != ok {
+			t.Errorf("ParseSpec(%q) = %v", entry, err)
+		}
+	}
+	if err := Valid([]string{"any", "text/csv; columns=2"}); err != nil {
+		t.Errorf("Valid: %v", err)
+	}
+	if err := Valid([]string{"text/csv", "image/nope"}); err == nil {
+		t.Error("Valid accepted an unknown type")
+	}
+}
+
+func TestCSVParams(t *testing.T) {
+	for _, tt := range []struct {
+		entry   string
+		content string
+		want    bool
+	}{
+		{"text/csv; columns=2", "a,b\n1,2\n", true},
+		{"text/csv; columns=2", "a,b\n1,2,3\n", false},
+		{"text/csv; columns=3", "a,b\n1,2\n", false},
+		{"text/csv", "a,b\n1,2,3\n", true},
+		{"text/csv; delimiter=tab; columns=2", "a\tb\n1\t2\n", true},
+		{"text/csv; delimiter=tab; columns=2", "a,b\n1,2\n", false},
+		{`text/csv; delimiter=";"; columns=2`, "a;b\n1;2\n", true},
+		{`text/csv; delimiter=";"; columns=2`, "a,b\n1,2\n", false},
+		{`text/csv; delimiter="§"; columns=2`, "a§b\n", true},
+	} {
+		if got := accepted(t, tt.entry, "a.csv", []byte(tt.content)); got != tt.want {
+			t.Errorf("%q as %s: accepted %v, want %v", tt.content, tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestWithin(t *testing.T) {
+	for _, tt := range []struct {
+		child  []string
+		parent []string
+		want   bool
+	}{
+		{[]string{"text/csv"}, []string{"any"}, true},
+		{[]string{"any"}, []string{"any"}, true},
+		{[]string{"any"}, []string{"text/csv"}, false},
+		{[]string{"text/csv"}, []string{"text/csv", "image/png"}, true},
+		{[]string{"image/gif"}, []string{"text/csv", "image/png"}, false},
+		{[]string{"text/csv; columns=3"}, []string{"text/csv"}, true},
+		{[]string{"text/csv"}, []string{"text/csv; columns=3"}, false},
+		{[]string{"text/csv; columns=4"}, []string{"text/csv; columns=3"}, false},
+		{[]string{"text/csv; columns=3; delimiter=tab"}, []string{"text/csv; delimiter=tab"}, true},
+		{[]string{"text/csv; columns=3"}, []string{"text/csv; delimiter=tab"}, false},
+		{nil, []string{"text/csv"}, true},
+		{[]string{"image/nope"}, []string{"image/png"}, false},
+		{[]string{"text/csv"}, []string{"image/nope"}, false},
+	} {
+		if got := Within(tt.child, tt.parent); got != tt.want {
+			t.Errorf("Within(%q, %q) = %v, want %v", tt.child, tt.parent, got, tt.want)
+		}
+	}
+}
+
+func TestValidateFileTriesEveryMatch(t *testing.T) {
+	specs, _, err := ParseSpecs([]string{"text/csv; columns=3", "text/csv; columns=2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !NeedsFile(specs) {
+		t.Error("csv specs need no file")
+	}
+	if err := ValidateFile(specs, bytes.NewReader([]byte("a,b\n"))); err != nil {
+		t.Errorf("second spec not tried: %v", err)
+	}
+	err = ValidateFile(specs, bytes.NewReader([]byte("a\n")))
+	if err == nil || !strings.Contains(err.Error(), "not a valid text/csv") {
+		t.Errorf("ValidateFile = %v", err)
+	}
+	png, _, _ := ParseSpecs([]string{"image/png"})
+	if NeedsFile(png) {
+		t.Error("image/png needs the file")
+	}
+}
@@ -9,23 +9,30 @@ import (
 	"time"
 
 	"github.com/lanelewis/rclone-proxy/database"
+	"github.com/lanelewis/rclone-proxy/filetype"
+	"github.com/lanelewis/rclone-proxy/schema"
 
 	_ "github.com/go-playground/validator/v10"
 	"github.com/sethvargo/go-password/password"
 )
 
-//file size limit and addition of read and mkcol
+// file size limit and addition of read and mkcol
 type ClientJson struct {
 	CanCreateChild bool
 	KeyValue       string
 	Endpoints      map[string]json.RawMessage
+	MaxTotalBytes  int64
 	InitiateExpire string
 	ExpireDelta    uint64
+	// WebhookURL is used by every endpoint that does not set its own.
+	WebhookURL string
 }
 type ClientKeySet struct {
 	CanCreateChild bool
 	KeyValue       string
+	KeyID          string
 	Endpoints      map[string]ClientEndpoint
+	MaxTotalBytes  int64
 	InitiateExpire string
 	ExpireDelta    uint64
 }
@@ -36,6 +43,22 @@ type ClientEndpoint struct {
 	MaxGet     uint
 	Path       string
 	PutTypes   []string
+	// MaxTotalBytes caps the bytes uploaded through the endpoint over the
+	// life of the key. A negative value inherits the parent's limit.
+	MaxTotalBytes int64
+	// Schema is checked against the contents of uploads. Left out, a child
+	// inherits its parent's.
+	Schema *schema.Schema
+	// NameTemplate and OnCollision are left out to inherit the parent's, see
+	// handles/naming.go.
+	NameTemplate string
+	OnCollision  string
+	// Overwrite and OverwriteWindow are left out to inherit the parent's,
+	// see handles/overwrite.go.
+	Overwrite       string
+	OverwriteWindow int64
+	// WebhookURL is left out to inherit the parent's, see handles/webhook.go.
+	WebhookURL string
 
 	Copy     bool
 	Delete   bool
@@ -51,56 +74,57 @@ type ClientEndpoint struct {
 	Unlock   bool
 }
 
-func getClientEndpoint(keyValue string, db *database.DB) (clientKey ClientKeySet, err error) {
-	key, err := database.GetKey(keyValue, db)
-	if err != nil {
-		return clientKey, err
-	}
+// toClientKey converts a stored key to its client form. Endpoint paths stay
+// absolute, as ValidateChildKey expects of a parent.
+func toClientKey(key database.KeySet) ClientKeySet {
 	clientKeyMap := make(map[string]ClientEndpoint)
 	for k, endpoint := range key.Endpoints {
 		clientEndpoint := ClientEndpoint{
-			MaxMkcol:   uint(endpoint.MaxMkcol),
-			MaxPut:     uint(endpoint.MaxPut),
-			MaxPutSize: int64(endpoint.MaxPutSize),
-			MaxGet:     uint(endpoint.MaxGet),
-			Path:       endpoint.Path,
-			PutTypes:   endpoint.PutTypes,
-			Copy:       endpoint.Copy,
-			Delete:     endpoint.Delete,
-			Get:        endpoint.Get,
-			Head:       endpoint.Head,
-			Lock:       endpoint.Lock,
-			Mkcol:      endpoint.Mkcol,
-			Options:    endpoint.Options,
-			Post:       endpoint.Post,
-			Put:        endpoint.Put,
-			Trace:      endpoint.Trace,
-			Unlock:     endpoint.Unlock,
+			MaxMkcol:        uint(endpoint.MaxMkcol),
+			MaxPut:          uint(endpoint.MaxPut),
+			MaxPutSize:      int64(endpoint.MaxPutSize),
+			MaxGet:          uint(endpoint.MaxGet),
+			Path:            endpoint.Path,
+			PutTypes:        endpoint.PutTypes,
+			MaxTotalBytes:   endpoint.MaxTotalBytes,
+			Schema:          endpoint.Schema.Copy(),
+			NameTemplate:    endpoint.NameTemplate,
+			OnCollision:     endpoint.OnCollision,
+			Overwrite:       endpoint.Overwrite,
+			OverwriteWindow: endpoint.OverwriteWindow,
+			WebhookURL:      endpoint.WebhookURL,
+			Copy:            endpoint.Copy,
+			Delete:          endpoint.Delete,
+			Get:             endpoint.Get,
+			Head:            endpoint.Head,
+			Lock:            endpoint.Lock,
+			Mkcol:           endpoint.Mkcol,
+			Options:         endpoint.Options,
+			Post:            endpoint.Post,
+			Propfind:        endpoint.Propfind,
+			Put:             endpoint.Put,
+			Trace:           endpoint.Trace,
+			Unlock:          endpoint.Unlock,
 		}
 		clientKeyMap[k] = clientEndpoint
 	}
-	clientKey = ClientKeySet{
+	return ClientKeySet{
 		CanCreateChild: key.CanCreateChild,
 		KeyValue:       key.KeyValue,
+		KeyID:          key.KeyID,
 		Endpoints:      clientKeyMap,
+		MaxTotalBytes:  key.MaxTotalBytes,
 		InitiateExpire: key.InitiateExpire,
 		ExpireDelta:    uint64(key.ExpireDelta),
 	}
-	return clientKey, nil
 }
 
-func AddKeyHandle(db *database.DB, w http.ResponseWriter, r *http.Request) (err error) {
-	_, key, ok := r.BasicAuth()
-	if !ok {
-		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return errors.New("no authorization passed")
-	}
-	parentClientKeySet, err := getClientEndpoint(key, db)
+func AddKeyHandle(db database.KeyStore, w http.ResponseWriter, r *http.Request) (err error) {
+	parentKey, err := requireKey(w, r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return errors.New("invalid parent key")
+		return err
 	}
+	parentClientKeySet := toClientKey(parentKey)
 	childClientKeySet, err := parseClientJson(r)
 	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -111,11 +135,12 @@ func AddKeyHandle(db *database.DB, w http.ResponseWriter, r *http.Request) (err
 		http.Error(w, fmt.Sprint("Invalid json body: ", err), http.StatusBadRequest)
 		return errors.New("invalid child parameters")
 	}
-	err = database.AddKey(childKeySet, db)
+	err = db.AddKey(r.Context(), childKeySet)
 	if err != nil {
 		http.Error(w, "", http.StatusInternalServerError)
 		return errors.New("unable to add key to database")
 	}
+	auditTarget(r, childKeySet.KeyID)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	// obscure absolute path field for user
@@ -127,8 +152,33 @@ func AddKeyHandle(db *database.DB, w http.ResponseWriter, r *http.Request) (err
 	return nil
 }
 
+// defaultClientEndpoint is what an endpoint in a request body starts from
+// before its json is applied.
+func defaultClientEndpoint() ClientEndpoint {
+	return ClientEndpoint{
+		MaxMkcol:      2147483647,
+		MaxPut:        2147483647,
+		MaxPutSize:    9223372036854775807,
+		MaxGet:        2147483647,
+		Path:          "",
+		PutTypes:      []string{"any"},
+		MaxTotalBytes: -1,
+		Copy:          false,
+		Delete:        false,
+		Get:           false,
+		Head:          false,
+		Lock:          false,
+		Mkcol:         false,
+		Options:       false,
+		Post:          false,
+		Propfind:      false,
+		Put:           false,
+		Trace:         false,
+		Unlock:        false}
+}
+
 func parseClientJson(r *http.Request) (keyset ClientKeySet, err error) {
-	defaultClientJson := ClientJson{CanCreateChild: false, KeyValue: "", Endpoints: make(map[string]json.RawMessage), InitiateExpire: "Creation", ExpireDelta: uint64(time.Hour / time.Millisecond)}
+	defaultClientJson := ClientJson{CanCreateChild: false, KeyValue: "", Endpoints: make(map[string]json.RawMessage), MaxTotalBytes: -1, InitiateExpire: "Creation", ExpireDelta: uint64(time.Hour / time.Millisecond)}
 	dec := json.NewDecoder(r.Body)
 	dec.DisallowUnknownFields()
 	err = dec.Decode(&defaultClientJson)
@@ -139,41 +189,35 @@ func parseClientJson(r *http.Request) (keyset ClientKeySet, err error) {
 	if !validInitiateExpire {
 		return keyset, errors.New("invalid value for initiate expire")
 	}
-	clientKeySet := ClientKeySet{CanCreateChild: defaultClientJson.CanCreateChild, KeyValue: defaultClientJson.KeyValue, Endpoints: make(map[string]ClientEndpoint), InitiateExpire: defaultClientJson.InitiateExpire, ExpireDelta: defaultClientJson.ExpireDelta}
+	clientKeySet := ClientKeySet{CanCreateChild: defaultClientJson.CanCreateChild, KeyValue: defaultClientJson.KeyValue, Endpoints: make(map[string]ClientEndpoint), MaxTotalBytes: defaultClientJson.MaxTotalBytes, InitiateExpire: defaultClientJson.InitiateExpire, ExpireDelta: defaultClientJson.ExpireDelta}
 	for k, v := range defaultClientJson.Endpoints {
-		defaultEndpoint := ClientEndpoint{
-			MaxMkcol:   2147483647,
-			MaxPut:     2147483647,
-			MaxPutSize: 9223372036854775807,
-			MaxGet:     2147483647,
-			Path:       "",
-			PutTypes:   []string{"any"},
-			Copy:       false,
-			Delete:     false,
-			Get:        false,
-			Head:       false,
-			Lock:       false,
-			Mkcol:      false,
-			Options:    false,
-			Post:       false,
-			Propfind:   false,
-			Put:        false,
-			Trace:      false,
-			Unlock:     false}
+		defaultEndpoint := defaultClientEndpoint()
 		err = json.Unmarshal(v, &defaultEndpoint)
 		if err != nil {
 			return keyset, err
 		}
-		possibleTypes := []string{"any", "application/octet-stream", "application/pdf",
-			"application/postscript", "text/plain", "image/x-icon", "image/bmp",
-			"image/gif", "image/webp", "image/png", "image/jpeg", "audio/basic",
-			"audio/aiff", "audio/mpeg", "application/ogg", "audio/midi", "video/avi",
-			"audio/wave", "video/webm", "application/vnd.ms-fontobject", "font/ttf",
-			"font/otf", "font/collection", "font/woff", "font/woff2", "application/x-gzip",
-			"application/zip", "application/x-rar-compressed", "application/x-rar-compressed",
-			"application/wasm", "text/html", "video/mp4"}
-		if !IsArraySubset(possibleTypes, defaultEndpoint.PutTypes) {
-			return keyset, errors.New("invalid put type")
+		err = filetype.Valid(defaultEndpoint.PutTypes)
+		if err != nil {
+			return keyset, err
+		}
+		err = defaultEndpoint.Schema.Check()
+		if err != nil {
+			return keyset, err
+		}
+		err = checkNaming(defaultEndpoint)
+		if err != nil {
+			return keyset, err
+		}
+		err = checkOverwrite(defaultEndpoint)
+		if err != nil {
+			return keyset, err
+		}
+		if defaultEndpoint.WebhookURL == "" {
+			defaultEndpoint.WebhookURL = defaultClientJson.WebhookURL
+		}
+		err = checkWebhookURL(defaultEndpoint.WebhookURL)
+		if err != nil {
+			return keyset, err
 		}
 		clientKeySet.Endpoints[k] = defaultEndpoint
 	}
@@ -222,72 +266,133 @@ func areProtocolsValid(childEndpoint ClientEndpoint, parentEndpoint ClientEndpoi
 	return false
 }
 
-func ValidateChildKey(childKey ClientKeySet, parentKey ClientKeySet) (validKey database.KeySet, err error) {
-	if childKey.ExpireDelta > parentKey.ExpireDelta {
-		return validKey, errors.New("timeDelta of child exceeds parent")
-	}
-	if !parentKey.CanCreateChild{
-		return validKey, errors.New("parent key does not have the ability to create children")
-	}
+// validateChildEndpoints checks that every endpoint of childKey, whose paths
+// are relative to parentKey's endpoint names, stays within parentKey, and
+// returns them with absolute paths and fresh counters.
+func validateChildEndpoints(childKey ClientKeySet, parentKey ClientKeySet) (map[string]database.Endpoint, error) {
 	validKeyMap := make(map[string]database.Endpoint)
 	parentKeyNames := getMapKeys(parentKey.Endpoints)
 	for k, endpoint := range childKey.Endpoints {
 		childPathArr := strings.Split(strings.Trim(endpoint.Path, "/"), "/")
 		_, isChildEndpoint := contains(parentKeyNames, childPathArr[0])
 		if !isChildEndpoint {
-			return validKey, errors.New("child key endpoint not in parent")
+			return nil, errors.New("child key endpoint not in parent")
 		}
 		parentKeyEndpoint := parentKey.Endpoints[childPathArr[0]]
-		absoluteChildPath := parentKeyEndpoint.Path + strings.Join(childPathArr[1:], "/")
-		_, isParentAllType := contains(parentKeyEndpoint.PutTypes, "any")
-		if !isParentAllType {
-			if IsArraySubset(parentKeyEndpoint.PutTypes, endpoint.PutTypes) {
-				return validKey, errors.New("child key put types not in parent")
-			}
+		absoluteChildPath, err := confine(parentKeyEndpoint.Path, strings.Join(childPathArr[1:], "/"))
+		if err != nil {
+			return nil, fmt.Errorf("child key endpoint path: %w", err)
+		}
+		if !filetype.Within(endpoint.PutTypes, parentKeyEndpoint.PutTypes) {
+			return nil, errors.New("child key put types not in parent")
 		}
 		childTypes := endpoint.PutTypes
-		_, isChildAllType := contains(endpoint.PutTypes, "any")
+		_, isChildAllType := contains(endpoint.PutTypes, filetype.Any)
 		if isChildAllType {
-			childTypes = []string{"any"}
+			childTypes = []string{filetype.Any}
 		}
 		if endpoint.MaxGet > parentKeyEndpoint.MaxGet {
-			return validKey, errors.New("child key maxGet exceeds parent maxGet")
+			return nil, errors.New("child key maxGet exceeds parent maxGet")
 		}
 		if endpoint.MaxPutSize > parentKeyEndpoint.MaxPutSize {
-			return validKey, errors.New("child key maxPutSize exceeds parent maxPutSize")
+			return nil, errors.New("child key maxPutSize exceeds parent maxPutSize")
 		}
 		if endpoint.MaxMkcol > parentKeyEndpoint.MaxMkcol {
-			return validKey, errors.New("child key maxMkcol exceeds parent maxMkcol")
+			return nil, errors.New("child key maxMkcol exceeds parent maxMkcol")
 		}
 		if endpoint.MaxPut > parentKeyEndpoint.MaxPut {
-			return validKey, errors.New("child key maxPut exceeds parent maxPut")
+			return nil, errors.New("child key maxPut exceeds parent maxPut")
+		}
+		if endpoint.MaxTotalBytes < 0 {
+			endpoint.MaxTotalBytes = parentKeyEndpoint.MaxTotalBytes
+		}
+		if endpoint.MaxTotalBytes > parentKeyEndpoint.MaxTotalBytes {
+			return nil, errors.New("child key maxTotalBytes exceeds parent maxTotalBytes")
+		}
+		if endpoint.Schema == nil {
+			endpoint.Schema = parentKeyEndpoint.Schema
+		}
+		if !endpoint.Schema.Within(parentKeyEndpoint.Schema) {
+			return nil, errors.New("child key schema not within parent schema")
+		}
+		if endpoint.NameTemplate == "" {
+			endpoint.NameTemplate = parentKeyEndpoint.NameTemplate
+		}
+		if parentKeyEndpoint.NameTemplate != "" && endpoint.NameTemplate != parentKeyEndpoint.NameTemplate {
+			return nil, errors.New("child key nameTemplate differs from parent")
+		}
+		if endpoint.OnCollision == "" {
+			endpoint.OnCollision = parentKeyEndpoint.OnCollision
+		}
+		if !collisionWithin(endpoint.OnCollision, parentKeyEndpoint.OnCollision) {
+			return nil, errors.New("child key onCollision would overwrite files parent protects")
+		}
+		if endpoint.Overwrite == "" {
+			endpoint.Overwrite = parentKeyEndpoint.Overwrite
+			endpoint.OverwriteWindow = parentKeyEndpoint.OverwriteWindow
+		}
+		if !overwriteWithin(endpoint, parentKeyEndpoint) {
+			return nil, errors.New("child key overwrite policy is looser than parent")
+		}
+		if endpoint.WebhookURL == "" {
+			endpoint.WebhookURL = parentKeyEndpoint.WebhookURL
+		}
+		if parentKeyEndpoint.WebhookURL != "" && endpoint.WebhookURL != parentKeyEndpoint.WebhookURL {
+			return nil, errors.New("child key webhookURL differs from parent")
 		}
 		if !areProtocolsValid(endpoint, parentKeyEndpoint) {
-			return validKey, errors.New("child key has protocols that exceed parent")
+			return nil, errors.New("child key has protocols that exceed parent")
 		}
 		validEndpoint := database.Endpoint{
-			MaxMkcol:   int(endpoint.MaxMkcol),
-			MaxPut:     int(endpoint.MaxPut),
-			MaxPutSize: int64(endpoint.MaxPutSize),
-			MaxGet:     int(endpoint.MaxGet),
-			MkcolCount: 0,
-			Path:       absoluteChildPath,
-			PutCount:   0,
-			PutTypes:   childTypes,
-			Copy:       endpoint.Copy,
-			Delete:     endpoint.Delete,
-			Get:        endpoint.Get,
-			Head:       endpoint.Head,
-			Lock:       endpoint.Lock,
-			Mkcol:      endpoint.Mkcol,
-			Options:    endpoint.Options,
-			Propfind:   endpoint.Propfind,
-			Put:        endpoint.Put,
-			Trace:      endpoint.Trace,
-			Unlock:     endpoint.Unlock,
+			MaxMkcol:        int(endpoint.MaxMkcol),
+			MaxPut:          int(endpoint.MaxPut),
+			MaxPutSize:      int64(endpoint.MaxPutSize),
+			MaxGet:          int(endpoint.MaxGet),
+			MkcolCount:      0,
+			Path:            absoluteChildPath,
+			PutCount:        0,
+			PutTypes:        childTypes,
+			MaxTotalBytes:   endpoint.MaxTotalBytes,
+			Schema:          endpoint.Schema,
+			NameTemplate:    endpoint.NameTemplate,
+			OnCollision:     endpoint.OnCollision,
+			Overwrite:       endpoint.Overwrite,
+			OverwriteWindow: endpoint.OverwriteWindow,
+			WebhookURL:      endpoint.WebhookURL,
+			Copy:            endpoint.Copy,
+			Delete:          endpoint.Delete,
+			Get:             endpoint.Get,
+			Head:            endpoint.Head,
+			Lock:            endpoint.Lock,
+			Mkcol:           endpoint.Mkcol,
+			Options:         endpoint.Options,
+			Propfind:        endpoint.Propfind,
+			Put:             endpoint.Put,
+			Trace:           endpoint.Trace,
+			Unlock:          endpoint.Unlock,
 		}
 		validKeyMap[k] = validEndpoint
 	}
+	return validKeyMap, nil
+}
+
+func ValidateChildKey(childKey ClientKeySet, parentKey ClientKeySet) (validKey database.KeySet, err error) {
+	if childKey.ExpireDelta > parentKey.ExpireDelta {
+		return validKey, errors.New("timeDelta of child exceeds parent")
+	}
+	if !parentKey.CanCreateChild {
+		return validKey, errors.New("parent key does not have the ability to create children")
+	}
+	if childKey.MaxTotalBytes < 0 {
+		childKey.MaxTotalBytes = parentKey.MaxTotalBytes
+	}
+	if childKey.MaxTotalBytes > parentKey.MaxTotalBytes {
+		return validKey, errors.New("child key maxTotalBytes exceeds parent maxTotalBytes")
+	}
+	validKeyMap, err := validateChildEndpoints(childKey, parentKey)
+	if err != nil {
+		return validKey, err
+	}
 	childKeyValue, err := password.Generate(64, 10, 0, false, true)
 	if err != nil {
 		return validKey, errors.New("key could not be generated")
@@ -295,7 +400,10 @@ func ValidateChildKey(childKey ClientKeySet, parentKey ClientKeySet) (validKey d
 	validKey = database.KeySet{
 		CanCreateChild:  childKey.CanCreateChild,
 		KeyValue:        childKeyValue,
+		KeyID:           database.KeyID(childKeyValue),
+		ParentID:        parentKey.KeyID,
 		Endpoints:       validKeyMap,
+		MaxTotalBytes:   childKey.MaxTotalBytes,
 		InitiateExpire:  childKey.InitiateExpire,
 		ExpireDelta:     int64(childKey.ExpireDelta),
 		ExpireStarted:   false,
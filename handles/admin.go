@@ -2,31 +2,43 @@ package handles
 
 import (
 	"errors"
-	"fmt"
-	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
+	"strings"
 
 	"github.com/lanelewis/rclone-proxy/database"
 )
 
-const adminURL = "http://localhost:8082"
+// adminURL is the rclone rc server /admin/ is served from.
+var adminURL = "http://localhost:8082"
 
-func AdminHandle(db *database.DB, w http.ResponseWriter, r *http.Request) (err error) {
-	_, key, ok := r.BasicAuth()
-	if !ok {
-		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return errors.New("no authorization passed")
-	}
-	keySet, err := database.GetKey(key, db)
+// adminKey is the value of the admin key, which sees every key's audit
+// events and may use /admin/ and /metrics.
+var adminKey string
+
+// SetAdminKey sets the value of the admin key.
+func SetAdminKey(key string) {
+	adminKey = key
+}
+
+// isAdmin reports whether keySet is the admin key.
+func isAdmin(keySet database.KeySet) bool {
+	return keySet.KeyID == database.KeyID(adminKey)
+}
+
+// SetBackendURLs sets the rclone WebDAV and rc servers requests are proxied
+// to.
+func SetBackendURLs(webdav string, admin string) {
+	proxyURL, adminURL = strings.TrimSuffix(webdav, "/"), strings.TrimSuffix(admin, "/")
+}
+
+func AdminHandle(db database.KeyStore, w http.ResponseWriter, r *http.Request) (err error) {
+	keySet, err := requireKey(w, r)
 	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return errors.New("invalid key")
+		return err
 	}
-	if !(keySet.KeyValue == os.Getenv("ADMINKEY")) {
+	if !isAdmin(keySet) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return errors.New("invalid key")
 	}
@@ -35,12 +47,12 @@ func AdminHandle(db *database.DB, w http.ResponseWriter, r *http.Request) (err e
 }
 func adminProxy(res http.ResponseWriter, req *http.Request) {
 	url, _ := url.Parse(adminURL)
-	originalURL := fmt.Sprint(req.URL)
+	originalURL := *req.URL
 	proxy := httputil.NewSingleHostReverseProxy(url)
 	req.URL.Host = url.Host
 	req.URL.Scheme = url.Scheme
 	req.Header.Set("X-Forwarded-Host", req.Header.Get("Host"))
 	req.Host = url.Host
-	log.Println("reverse-proxy: ", originalURL, " -> ", req.URL)
+	requestLogger(req).Debug("reverse-proxy", "url", originalURL, "backend", req.URL)
 	proxy.ServeHTTP(res, req)
 }
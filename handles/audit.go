@@ -0,0 +1,264 @@
+package handles
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lanelewis/rclone-proxy/database"
+)
+
+const auditContextKey contextKey = 1
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditRecord collects what handlers learn about a request while it is served.
+// It is written to the audit log once the response is done.
+type auditRecord struct {
+	lock     sync.Mutex
+	keyID    string
+	parentID string
+	endpoint string
+	path     string
+	target   string
+}
+
+func requestAudit(r *http.Request) *auditRecord {
+	record, _ := r.Context().Value(auditContextKey).(*auditRecord)
+	return record
+}
+
+// auditKey notes the key a request was made with.
+func auditKey(r *http.Request, keyID string, parentID string) {
+	if record := requestAudit(r); record != nil {
+		record.lock.Lock()
+		record.keyID, record.parentID = keyID, parentID
+		record.lock.Unlock()
+	}
+}
+
+// auditPath notes the endpoint a file request named and the file it resolved
+// to, as its /files/ URL so the backend layout stays hidden.
+func auditPath(r *http.Request, endpoint string, path string) {
+	if record := requestAudit(r); record != nil {
+		record.lock.Lock()
+		record.endpoint, record.path = endpoint, path
+		record.lock.Unlock()
+	}
+}
+
+// auditTarget notes the key a request created, changed or deleted.
+func auditTarget(r *http.Request, keyID string) {
+	if record := requestAudit(r); record != nil {
+		record.lock.Lock()
+		record.target = keyID
+		record.lock.Unlock()
+	}
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// responseRecorder records the status and size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Flush lets proxied responses stream through.
+func (w *responseRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response cannot be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// auditAction names what a request did: its method for file requests and the
+// route otherwise, e.g. "PUT" or "addKey".
+func auditAction(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/files/") {
+		return r.Method
+	}
+	segments := strings.Split(r.URL.Path, "/")
+	return segments[1]
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Audit writes every request it wraps to the audit log of db, with the key
+// that made it, what it touched and how it went. It goes in front of
+// Authenticate so refused requests are recorded too.
+func Audit(db database.KeyStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			record := &auditRecord{}
+			body := &countingBody{ReadCloser: r.Body}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = body
+			}
+			writer := &responseRecorder{ResponseWriter: w}
+			action := auditAction(r)
+			contentType := r.Header.Get("Content-Type")
+			next.ServeHTTP(writer, r.WithContext(context.WithValue(r.Context(), auditContextKey, record)))
+			if body.n == 0 {
+				contentType = writer.Header().Get("Content-Type")
+			}
+			if writer.status == 0 {
+				// nothing written means net/http sends a bare 200
+				writer.status = http.StatusOK
+			}
+			record.lock.Lock()
+			event := database.AuditEvent{
+				Time:          start.UnixMilli(),
+				KeyID:         record.keyID,
+				ParentID:      record.parentID,
+				Action:        action,
+				Endpoint:      record.endpoint,
+				Path:          record.path,
+				TargetKeyID:   record.target,
+				Status:        writer.status,
+				RequestBytes:  body.n,
+				ResponseBytes: writer.n,
+				ContentType:   contentType,
+				ClientIP:      clientIP(r),
+			}
+			record.lock.Unlock()
+			// the request context is done once the client has gone
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			err := db.AddAuditEvent(ctx, event)
+			if err != nil {
+				requestLogger(r).Error("failed to write audit event", "path", r.URL.Path, "err", err)
+			}
+		})
+	}
+}
+
+// AuditPage is the body returned by /audit. Next is the Before to pass for the
+// following page, or 0 on the last one.
+type AuditPage struct {
+	Events []database.AuditEvent
+	Next   int64
+}
+
+func parseAuditFilter(query map[string][]string) (filter database.AuditFilter, err error) {
+	get := func(name string) string {
+		if values := query[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	number := func(name string) int64 {
+		if err != nil || get(name) == "" {
+			return 0
+		}
+		var n int64
+		n, err = strconv.ParseInt(get(name), 10, 64)
+		if err == nil && n < 0 {
+			err = errors.New(name + " must not be negative")
+		}
+		return n
+	}
+	filter = database.AuditFilter{
+		KeyID:    get("key"),
+		Action:   get("action"),
+		Endpoint: get("endpoint"),
+		Status:   int(number("status")),
+		Since:    number("since"),
+		Until:    number("until"),
+		Before:   number("before"),
+		Limit:    int(number("limit")),
+	}
+	if filter.Limit == 0 {
+		filter.Limit = defaultAuditLimit
+	}
+	if filter.Limit > maxAuditLimit {
+		filter.Limit = maxAuditLimit
+	}
+	return filter, err
+}
+
+// AuditHandle returns the audit events of the access key and of every key
+// below it, newest first. The admin key sees every event, including requests
+// that resolved no key.
+func AuditHandle(db database.KeyStore, w http.ResponseWriter, r *http.Request) (err error) {
+	keySet, err := requireKey(w, r)
+	if err != nil {
+		return err
+	}
+	filter, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return err
+	}
+	viewerID := keySet.KeyID
+	if isAdmin(keySet) {
+		viewerID = ""
+	}
+	events, err := db.AuditEvents(r.Context(), viewerID, filter)
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return errors.New("unable to read audit events")
+	}
+	page := AuditPage{Events: events}
+	if page.Events == nil {
+		page.Events = []database.AuditEvent{}
+	}
+	if len(events) == filter.Limit {
+		page.Next = events[len(events)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+	return nil
+}
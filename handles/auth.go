@@ -0,0 +1,99 @@
+package handles
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/lanelewis/rclone-proxy/database"
+)
+
+type contextKey int
+
+const keySetContextKey contextKey = 0
+
+// keyHeader is an alternative to the Authorization header for clients that
+// find it awkward to set.
+const keyHeader = "X-Exius-Key"
+
+var errNoCredentials = errors.New("no authorization passed")
+var errConflictingCredentials = errors.New("different keys passed by different schemes")
+
+// presentedKey extracts the key a request carries, from the password of Basic
+// auth (the username is ignored), a Bearer token or the X-Exius-Key header.
+// Passing different keys in more than one of them is an error.
+func presentedKey(r *http.Request) (string, error) {
+	var keys []string
+	if _, password, ok := r.BasicAuth(); ok {
+		keys = append(keys, password)
+	}
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if strings.EqualFold(scheme, "Bearer") {
+		keys = append(keys, strings.TrimSpace(token))
+	}
+	if key := r.Header.Get(keyHeader); key != "" {
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return "", errNoCredentials
+	}
+	for _, key := range keys[1:] {
+		if key != keys[0] {
+			return "", errConflictingCredentials
+		}
+	}
+	return keys[0], nil
+}
+
+// Authenticate resolves the key of every request and attaches it to the
+// request context for handlers to pick up with RequestKey. Presigned requests
+// carry no key and are passed through to be verified by AuthenticateAndRoute.
+func Authenticate(db database.KeyStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isPresigned(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key, err := presentedKey(r)
+			if err == errNoCredentials {
+				authFailures.WithLabelValues(authNoCredentials).Inc()
+				w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+			} else if err != nil {
+				authFailures.WithLabelValues(authConflictingCredentials).Inc()
+			}
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				requestLogger(r).Warn("failed to authenticate", "path", r.URL.Path, "err", err)
+				return
+			}
+			keySet, err := db.GetKey(r.Context(), key)
+			if err != nil {
+				authFailures.WithLabelValues(authInvalidKey).Inc()
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				requestLogger(r).Warn("failed to authenticate", "path", r.URL.Path, "err", "invalid key")
+				return
+			}
+			auditKey(r, keySet.KeyID, keySet.ParentID)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), keySetContextKey, keySet)))
+		})
+	}
+}
+
+// RequestKey returns the key Authenticate resolved for a request.
+func RequestKey(r *http.Request) (database.KeySet, bool) {
+	keySet, ok := r.Context().Value(keySetContextKey).(database.KeySet)
+	return keySet, ok
+}
+
+// requireKey returns the request's key, answering 401 if it has none.
+func requireKey(w http.ResponseWriter, r *http.Request) (database.KeySet, error) {
+	keySet, ok := RequestKey(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return keySet, errNoCredentials
+	}
+	return keySet, nil
+}
@@ -0,0 +1,82 @@
+package handles
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var errPathEscapes = errors.New("path escapes its endpoint")
+var errInvalidPath = errors.New("path has an invalid segment")
+
+// cleanRelative resolves rel, a slash separated path from a request or a
+// child key, relative to an endpoint root. "." and empty segments are dropped
+// and ".." steps back up, but never past the root. Segments that would still
+// mean something to a backend that decodes or splits them again, such as an
+// encoded "..", a backslash or a NUL, are rejected outright. A trailing slash
+// is kept, since WebDAV uses it to mark collections.
+func cleanRelative(rel string) (string, error) {
+	var segments []string
+	for _, segment := range strings.Split(rel, "/") {
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			if len(segments) == 0 {
+				return "", errPathEscapes
+			}
+			segments = segments[:len(segments)-1]
+			continue
+		}
+		if !safeSegment(segment) {
+			return "", errInvalidPath
+		}
+		segments = append(segments, segment)
+	}
+	cleaned := strings.Join(segments, "/")
+	if strings.HasSuffix(rel, "/") && cleaned != "" {
+		cleaned += "/"
+	}
+	return cleaned, nil
+}
+
+// joinBelow puts a path cleaned by cleanRelative under root.
+func joinBelow(root string, cleaned string) string {
+	joined := path.Join("/", root, cleaned)
+	if strings.HasSuffix(cleaned, "/") && joined != "/" {
+		joined += "/"
+	}
+	return joined
+}
+
+// filesPath is the URL a file below an endpoint is served under, the form
+// paths are shown to clients in.
+func filesPath(endpoint string, cleaned string) string {
+	return "/files/" + endpoint + "/" + cleaned
+}
+
+// confine resolves rel below root, failing if it would leave root.
+func confine(root string, rel string) (string, error) {
+	cleaned, err := cleanRelative(rel)
+	if err != nil {
+		return "", err
+	}
+	return joinBelow(root, cleaned), nil
+}
+
+func safeSegment(segment string) bool {
+	if strings.ContainsAny(segment, "\\\x00") {
+		return false
+	}
+	// the segment has already been decoded once, so anything still encoded
+	// was encoded twice
+	decoded, err := url.PathUnescape(segment)
+	if err != nil {
+		return true
+	}
+	if decoded == "." || decoded == ".." || strings.ContainsAny(decoded, "/\\\x00") {
+		return false
+	}
+	return decoded == segment || safeSegment(decoded)
+}
@@ -0,0 +1,207 @@
+package handles
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lanelewis/rclone-proxy/database"
+)
+
+// traversals are paths below an endpoint that try to reach outside it, with
+// what cleanRelative makes of them. An empty want means it must refuse.
+var traversals = []struct {
+	name string
+	rel  string
+	want string
+}{
+	{"plain", "a/b.txt", "a/b.txt"},
+	{"dot segments", "./a/./b.txt", "a/b.txt"},
+	{"dotdot inside", "a/../b.txt", "b.txt"},
+	{"collection", "a/b/", "a/b/"},
+	{"absolute segment", "/etc/passwd", "etc/passwd"},
+	{"doubled slashes", "a//..//etc/passwd", "etc/passwd"},
+	{"raw dotdot", "../secret", ""},
+	{"dotdot past root", "a/../../secret", ""},
+	{"encoded dotdot", "%2e%2e/secret", ""},
+	{"mixed case encoding", "%2E%2e/secret", ""},
+	{"half encoded dotdot", ".%2e/secret", ""},
+	{"double encoded dotdot", "%252e%252e/secret", ""},
+	{"encoded slash", "a%2f..%2f..%2fsecret", ""},
+	{"backslash", `..\secret`, ""},
+	{"backslash inside", `a\..\..\secret`, ""},
+	{"encoded backslash", "a%5c..%5csecret", ""},
+	{"nul", "a\x00.txt", ""},
+	{"encoded nul", "a%00.txt", ""},
+}
+
+func TestCleanRelative(t *testing.T) {
+	for _, tt := range traversals {
+		got, err := cleanRelative(tt.rel)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: cleanRelative(%q) = %q, want an error", tt.name, tt.rel, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: cleanRelative(%q) = %q, %v, want %q", tt.name, tt.rel, got, err, tt.want)
+		}
+	}
+}
+
+func TestSafeSegment(t *testing.T) {
+	for segment, want := range map[string]bool{
+		"file.txt":       true,
+		"100%":           true,
+		"a%20b":          true,
+		"%2e%2e":         false,
+		"%252e%252e":     false,
+		"%25252e%25252e": false,
+		"a%2fb":          false,
+		`a\b`:            false,
+		"a\x00b":         false,
+	} {
+		if got := safeSegment(segment); got != want {
+			t.Errorf("safeSegment(%q) = %v, want %v", segment, got, want)
+		}
+	}
+}
+
+func TestJoinBelow(t *testing.T) {
+	for _, tt := range []struct{ root, cleaned, want string }{
+		{"/", "", "/"},
+		{"/", "a.txt", "/a.txt"},
+		{"/base", "a/b.txt", "/base/a/b.txt"},
+		{"base/", "a/", "/base/a/"},
+		{"/base", "", "/base"},
+	} {
+		if got := joinBelow(tt.root, tt.cleaned); got != tt.want {
+			t.Errorf("joinBelow(%q, %q) = %q, want %q", tt.root, tt.cleaned, got, tt.want)
+		}
+	}
+}
+
+func confineParent() ClientKeySet {
+	return ClientKeySet{
+		CanCreateChild: true,
+		KeyID:          "parent",
+		MaxTotalBytes:  1 << 40,
+		ExpireDelta:    1 << 40,
+		Endpoints: map[string]ClientEndpoint{
+			"root": {
+				Path:          "/base",
+				PutTypes:      []string{"any"},
+				MaxGet:        10,
+				MaxPut:        10,
+				MaxPutSize:    1 << 30,
+				MaxTotalBytes: 1 << 40,
+				Get:           true,
+				Put:           true,
+			},
+		},
+	}
+}
+
+func TestValidateChildKeyConfinesPath(t *testing.T) {
+	for _, tt := range traversals {
+		child := ClientKeySet{
+			MaxTotalBytes: -1,
+			Endpoints: map[string]ClientEndpoint{
+				"child": {Path: "root/" + tt.rel, PutTypes: []string{"any"}, MaxTotalBytes: -1, Get: true},
+			},
+		}
+		key, err := ValidateChildKey(child, confineParent())
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: child path %q accepted as %q", tt.name, child.Endpoints["child"].Path, key.Endpoints["child"].Path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: child path %q refused: %v", tt.name, child.Endpoints["child"].Path, err)
+			continue
+		}
+		want := strings.TrimSuffix("/base/"+tt.want, "/")
+		if got := key.Endpoints["child"].Path; got != want {
+			t.Errorf("%s: child path %q stored as %q, want %q", tt.name, child.Endpoints["child"].Path, got, want)
+		}
+	}
+	child := ClientKeySet{
+		MaxTotalBytes: -1,
+		Endpoints: map[string]ClientEndpoint{
+			"child": {Path: "root/../secret", PutTypes: []string{"any"}, MaxTotalBytes: -1},
+		},
+	}
+	_, err := ValidateChildKey(child, confineParent())
+	if err == nil {
+		t.Error(`child path "root/../secret" accepted`)
+	}
+}
+
+// backendPaths stands in for the rclone backend and records the paths it is
+// asked for.
+type backendPaths struct {
+	lock  sync.Mutex
+	paths []string
+}
+
+func (b *backendPaths) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.lock.Lock()
+	b.paths = append(b.paths, r.URL.Path)
+	b.lock.Unlock()
+	w.Write([]byte("ok"))
+}
+
+func TestAuthenticateAndRouteConfinesPath(t *testing.T) {
+	backend := &backendPaths{}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+	oldProxy := proxyURL
+	proxyURL = server.URL
+	defer func() { proxyURL = oldProxy }()
+
+	db := database.NewMemoryStore()
+	err := db.AddKey(context.Background(), database.KeySet{
+		KeyValue:    "confine-test-key",
+		ExpireDelta: 1 << 40,
+		Endpoints: map[string]database.Endpoint{
+			"root": {Path: "/base", PutTypes: []string{"any"}, MaxGet: 1000, Get: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := Authenticate(db)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AuthenticateAndRoute("Get", db, w, r)
+	}))
+	for _, tt := range traversals {
+		// percent encoding is left for the request parser to decode once, as
+		// it would be for a real client
+		target := "/files/root/" + strings.ReplaceAll(strings.ReplaceAll(tt.rel, "\x00", "%00"), `\`, "%5c")
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.SetBasicAuth("", "confine-test-key")
+		res := httptest.NewRecorder()
+		backend.lock.Lock()
+		backend.paths = nil
+		backend.lock.Unlock()
+		handler.ServeHTTP(res, req)
+
+		backend.lock.Lock()
+		paths := backend.paths
+		backend.lock.Unlock()
+		if tt.want == "" {
+			if res.Code != http.StatusUnauthorized || len(paths) > 0 {
+				t.Errorf("%s: GET %s answered %d and reached the backend at %v", tt.name, target, res.Code, paths)
+			}
+			continue
+		}
+		want := joinBelow("/base", tt.want)
+		if res.Code != http.StatusOK || len(paths) != 1 || paths[0] != want {
+			t.Errorf("%s: GET %s answered %d and reached the backend at %v, want %s", tt.name, target, res.Code, paths, want)
+		}
+	}
+}
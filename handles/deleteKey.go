@@ -1,20 +1,51 @@
 package handles
 
 import (
+	"context"
 	"errors"
 	"net/http"
 
 	"github.com/lanelewis/rclone-proxy/database"
 )
 
-func DeleteKeyHandle(db *database.DB, w http.ResponseWriter, r *http.Request) (err error) {
-	_, keyValue, ok := r.BasicAuth()
-	if !ok {
-		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return errors.New("no authorization passed")
+// isDescendant reports whether keyID was created, directly or further down the
+// line, by the key with id ancestorID.
+func isDescendant(ctx context.Context, db database.KeyStore, ancestorID string, keyID string) (bool, error) {
+	descendants, err := db.GetChildren(ctx, ancestorID, true)
+	if err != nil {
+		return false, err
+	}
+	for _, keySet := range descendants {
+		if keySet.KeyID == keyID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DeleteKeyHandle deletes the access key, or with ?id= one of its descendants.
+// ?cascade=true also deletes every key below the deleted one; otherwise they
+// are handed up to the deleted key's parent.
+func DeleteKeyHandle(db database.KeyStore, w http.ResponseWriter, r *http.Request) (err error) {
+	keySet, err := requireKey(w, r)
+	if err != nil {
+		return err
+	}
+	keyID := keySet.KeyID
+	if id := r.URL.Query().Get("id"); id != "" && id != keySet.KeyID {
+		descendant, err := isDescendant(r.Context(), db, keySet.KeyID, id)
+		if err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+			return errors.New("unable to list child keys")
+		}
+		if !descendant {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return errors.New("key is not a descendant")
+		}
+		keyID = id
 	}
-	err = database.DeleteKey(keyValue, db)
+	auditTarget(r, keyID)
+	err = db.DeleteKey(r.Context(), keyID, r.URL.Query().Get("cascade") == "true")
 	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return errors.New("invalid key")
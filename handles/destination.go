@@ -0,0 +1,164 @@
+package handles
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/lanelewis/rclone-proxy/database"
+	"github.com/lanelewis/rclone-proxy/filetype"
+	"github.com/lanelewis/rclone-proxy/logging"
+)
+
+// destinationFits reports whether anything that could have been put in the
+// source endpoint could also have been put in the destination, so COPY and
+// MOVE cannot carry a file past the destination's upload rules.
+func destinationFits(source database.Endpoint, destination database.Endpoint) bool {
+	return filetype.Within(source.PutTypes, destination.PutTypes) &&
+		source.MaxPutSize <= destination.MaxPutSize &&
+		source.Schema.Within(destination.Schema)
+}
+
+// scopeDestination maps the Destination header of a COPY or MOVE through the
+// key's endpoints, the same way the request path is, and rewrites it for the
+// backend. Writing to the destination counts as a Put: the key needs Put on
+// the destination endpoint, one of its Put slots is reserved, the size of the
+// source is charged to its byte quota, and the destination's webhook is told
+// of the copy or move. Collections, whose size is not known up front, cannot
+// be copied into an endpoint or with a key that has a byte limit. Endpoints
+// that name their own uploads cannot be copied into, and ones that protect
+// existing files from collisions or overwrites are sent Overwrite: F.
+func scopeDestination(db database.KeyStore, keySet database.KeySet, source string, sourcePath string, r *http.Request) (reserved *reservation, status int, err error) {
+	raw := r.Header.Get("Destination")
+	if raw == "" {
+		return nil, http.StatusBadRequest, errors.New("no Destination header")
+	}
+	destination, err := url.Parse(raw)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid Destination header: %w", err)
+	}
+	if destination.Host != "" && destination.Host != r.Host {
+		return nil, http.StatusBadGateway, errors.New("Destination is on another server")
+	}
+	segments := strings.Split(destination.Path, "/")
+	if len(segments) < 3 || segments[0] != "" || segments[1] != "files" {
+		return nil, http.StatusUnauthorized, errors.New("Destination is not a file")
+	}
+	name := segments[2]
+	filePath, err := cleanRelative(strings.Join(segments[3:], "/"))
+	if err != nil {
+		return nil, http.StatusUnauthorized, fmt.Errorf("Destination: %w", err)
+	}
+	sourceEndpoint, ok := keySet.Endpoints[source]
+	if !ok {
+		return nil, http.StatusUnauthorized, errors.New("endpoint not in key")
+	}
+	endpoint, err := db.Reserve(r.Context(), keySet.KeyID, name, "Put")
+	if err != nil {
+		return nil, http.StatusUnauthorized, fmt.Errorf("no put access to Destination: %w", err)
+	}
+	reserved = &reservation{db: db, logger: requestLogger(r), keyID: keySet.KeyID, endpoint: name, field: "Put"}
+	if name != source && !destinationFits(sourceEndpoint, endpoint) {
+		reserved.finish(false)
+		return nil, http.StatusUnauthorized, errors.New("Destination accepts less than the source endpoint")
+	}
+	if endpoint.NameTemplate != "" {
+		reserved.finish(false)
+		return nil, http.StatusUnauthorized, errors.New("Destination names its own uploads")
+	}
+	size, collection, status, err := sourceSize(r, sourcePath)
+	if err != nil {
+		reserved.finish(false)
+		return nil, status, err
+	}
+	if collection {
+		if endpoint.MaxTotalBytes != math.MaxInt64 || keySet.MaxTotalBytes != math.MaxInt64 {
+			reserved.finish(false)
+			return nil, http.StatusUnauthorized, errors.New("collections cannot be copied under a byte quota")
+		}
+	} else {
+		err = db.ReserveBytes(r.Context(), keySet.KeyID, name, size)
+		if err != nil {
+			reserved.finish(false)
+			if errors.Is(err, database.ErrByteQuota) {
+				return nil, http.StatusRequestEntityTooLarge, errByteQuota
+			}
+			return nil, http.StatusInternalServerError, err
+		}
+		// all of it is used once the backend has made the copy
+		reserved.bytes, reserved.used = size, size
+	}
+	if (endpoint.OnCollision != "" && endpoint.OnCollision != CollisionOverwrite) || protectsFiles(endpoint) {
+		r.Header.Set("Overwrite", "F")
+	}
+	reserved.webhookURL = endpoint.WebhookURL
+	reserved.event = UploadEvent{
+		Event:    strings.ToLower(r.Method),
+		KeyID:    keySet.KeyID,
+		Endpoint: name,
+		Path:     (&url.URL{Path: filesPath(name, filePath)}).EscapedPath(),
+	}
+	backend, _ := url.Parse(proxyURL)
+	backend.Path = joinBelow(strings.Trim(endpoint.Path, `"`), filePath)
+	r.Header.Set("Destination", backend.String())
+	return reserved, 0, nil
+}
+
+// davResource is what sourceSize reads from a multistatus response.
+type davResource struct {
+	Propstats []struct {
+		ContentLength string    `xml:"DAV: prop>getcontentlength"`
+		Collection    *struct{} `xml:"DAV: prop>resourcetype>collection"`
+	} `xml:"DAV: response>propstat"`
+}
+
+// sourceSize asks the backend for the size of the file at path, or whether it
+// is a collection, with a PROPFIND of depth 0. The status goes with the error.
+func sourceSize(r *http.Request, path string) (size int64, collection bool, status int, err error) {
+	backend, _ := url.Parse(proxyURL)
+	backend.Path = path
+	body := xml.Header + `<D:propfind xmlns:D="DAV:"><D:prop><D:getcontentlength/><D:resourcetype/></D:prop></D:propfind>`
+	req, err := http.NewRequestWithContext(r.Context(), "PROPFIND", backend.String(), strings.NewReader(body))
+	if err != nil {
+		return 0, false, http.StatusInternalServerError, err
+	}
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", `application/xml; charset="utf-8"`)
+	if id := logging.RequestID(r.Context()); id != "" {
+		req.Header.Set(logging.RequestIDHeader, id)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, false, http.StatusBadGateway, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return 0, false, http.StatusNotFound, errors.New("source not found")
+	}
+	if res.StatusCode != http.StatusMultiStatus {
+		return 0, false, http.StatusBadGateway, fmt.Errorf("backend answered PROPFIND of the source with %d", res.StatusCode)
+	}
+	var resource davResource
+	err = xml.NewDecoder(res.Body).Decode(&resource)
+	if err != nil {
+		return 0, false, http.StatusBadGateway, fmt.Errorf("reading PROPFIND of the source: %w", err)
+	}
+	for _, propstat := range resource.Propstats {
+		if propstat.Collection != nil {
+			return 0, true, 0, nil
+		}
+		if propstat.ContentLength != "" {
+			size, err = strconv.ParseInt(strings.TrimSpace(propstat.ContentLength), 10, 64)
+			if err != nil || size < 0 {
+				return 0, false, http.StatusBadGateway, fmt.Errorf("invalid size of the source %q", propstat.ContentLength)
+			}
+			return size, false, 0, nil
+		}
+	}
+	return 0, false, http.StatusBadGateway, errors.New("backend gave no size for the source")
+}
@@ -0,0 +1,91 @@
+package handles
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lanelewis/rclone-proxy/database"
+)
+
+// davBackend answers every PROPFIND with a single resource, a collection or
+// a file of size bytes.
+type davBackend struct {
+	collection bool
+	size       string
+}
+
+func (b davBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prop := `<D:getcontentlength>` + b.size + `</D:getcontentlength><D:resourcetype/>`
+	if b.collection {
+		prop = `<D:resourcetype><D:collection/></D:resourcetype>`
+	}
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><D:multistatus xmlns:D="DAV:"><D:response><D:href>` + r.URL.Path +
+		`</D:href><D:propstat><D:prop>` + prop + `</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response></D:multistatus>`))
+}
+
+func TestScopeDestinationChargesBytes(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		backend  davBackend
+		maxBytes int64
+		status   int
+		charged  int64
+	}{
+		{"file within quota", davBackend{size: "40"}, 100, 0, 40},
+		{"file over quota", davBackend{size: "140"}, 100, http.StatusRequestEntityTooLarge, 0},
+		{"collection under quota", davBackend{collection: true}, 100, http.StatusUnauthorized, 0},
+		{"collection without quota", davBackend{collection: true}, -1, 0, 0},
+		{"unreadable size", davBackend{size: "lots"}, 100, http.StatusBadGateway, 0},
+	} {
+		server := httptest.NewServer(tt.backend)
+		oldProxy := proxyURL
+		proxyURL = server.URL
+
+		db := database.NewMemoryStore()
+		keySet := database.KeySet{
+			KeyValue:      "destination-test-key",
+			ExpireDelta:   1 << 40,
+			MaxTotalBytes: 1 << 62,
+			Endpoints: map[string]database.Endpoint{
+				"root": {Path: "/base", PutTypes: []string{"any"}, MaxPut: 10, MaxPutSize: 1 << 20, MaxTotalBytes: tt.maxBytes, Put: true, Copy: true},
+			},
+		}
+		if tt.maxBytes < 0 {
+			keySet.MaxTotalBytes = math.MaxInt64
+			endpoint := keySet.Endpoints["root"]
+			endpoint.MaxTotalBytes = math.MaxInt64
+			keySet.Endpoints["root"] = endpoint
+		}
+		err := db.AddKey(context.Background(), keySet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keySet.KeyID = database.KeyID("destination-test-key")
+		req := httptest.NewRequest("COPY", "/files/root/a.txt", nil)
+		req.Header.Set("Destination", "/files/root/b.txt")
+		reserved, status, err := scopeDestination(db, keySet, "root", "/base/a.txt", req)
+		if status != tt.status || (err == nil) != (tt.status == 0) {
+			t.Errorf("%s: scopeDestination answered %d, %v, want %d", tt.name, status, err, tt.status)
+		}
+		if reserved != nil {
+			reserved.finish(true)
+		}
+		stored, err := db.GetKey(context.Background(), "destination-test-key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stored.Endpoints["root"].TotalBytes; got != tt.charged {
+			t.Errorf("%s: charged %d bytes, want %d", tt.name, got, tt.charged)
+		}
+		if got, want := stored.Endpoints["root"].PutCount, map[bool]int{true: 1, false: 0}[tt.status == 0]; got != want {
+			t.Errorf("%s: PutCount %d, want %d", tt.name, got, want)
+		}
+
+		proxyURL = oldProxy
+		server.Close()
+	}
+}
@@ -0,0 +1,52 @@
+package handles
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// inFlight counts the requests being served, from when Track sees them until
+// their handler, middleware included, has returned.
+var inFlight atomic.Int64
+
+var _ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Name: "exius_http_requests_in_flight",
+	Help: "Requests being served.",
+}, func() float64 {
+	return float64(inFlight.Load())
+})
+
+// Track counts the requests it wraps as in flight, so shutdown can wait for
+// them. It goes outside every middleware that still works after the response,
+// such as Audit.
+func Track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// InFlight returns how many requests are being served.
+func InFlight() int64 {
+	return inFlight.Load()
+}
+
+// WaitIdle waits until no request is being served, or ctx is done.
+func WaitIdle(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
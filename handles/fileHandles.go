@@ -1,149 +1,450 @@
 package handles
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/lanelewis/rclone-proxy/database"
+	"github.com/lanelewis/rclone-proxy/filetype"
+	"github.com/lanelewis/rclone-proxy/schema"
 )
 
-const proxyURL = "http://localhost:8081"
+// proxyURL is the rclone WebDAV server files are served from.
+var proxyURL = "http://localhost:8081"
 
-func serveProxy(target string, path string, method string, key string, endpoint string, db *database.DB, res http.ResponseWriter, req *http.Request) {
+// serveProxy proxies req to path on the backend. modify, if set, rewrites the
+// backend's response.
+func serveProxy(target string, path string, modify func(*http.Response) error, reserved *reservation, res http.ResponseWriter, req *http.Request) {
 	url, _ := url.Parse(target)
-	originalURL := fmt.Sprint(req.URL)
+	originalURL := *req.URL
 	proxy := httputil.NewSingleHostReverseProxy(url)
 	req.URL.Host = url.Host
 	req.URL.Scheme = url.Scheme
 	req.URL.Path = path
 	req.Header.Set("X-Forwarded-Host", req.Header.Get("Host"))
 	req.Host = url.Host
-	if method == "Propfind" {
-		proxy.ModifyResponse = propfindProxyResp(originalURL)
-		proxy.ServeHTTP(res, req)
-	} else if method == "Put" {
-		proxy.ModifyResponse = putProxyResp(key, endpoint, db)
-		proxy.ServeHTTP(res, req)
-	} else if method == "Get" {
-		proxy.ModifyResponse = getProxyResp(key, endpoint, db)
-		proxy.ServeHTTP(res, req)
-	} else if method == "Mkcol" {
-		proxy.ModifyResponse = mkcolProxyResp(key, endpoint, db)
-		proxy.ServeHTTP(res, req)
-	} else {
-		proxy.ServeHTTP(res, req)
+	method := methodLabel(req.Method)
+	proxy.ModifyResponse = func(res *http.Response) error {
+		backendResponses.WithLabelValues(method, strconv.Itoa(res.StatusCode)).Inc()
+		if reserved != nil {
+			reservationProxyResp(reserved)(res)
+		}
+		if modify != nil {
+			return modify(res)
+		}
+		return nil
 	}
-	log.Println("reverse-proxy: ", originalURL, " -> ", req.URL)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		requestLogger(r).Error("reverse-proxy error", "url", originalURL, "err", err)
+		if reserved != nil {
+			reserved.finish(false)
+			if abort := reserved.aborted(); abort != nil {
+				http.Error(w, abort.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+		backendErrors.WithLabelValues(method).Inc()
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	proxy.ServeHTTP(res, req)
+	if reserved != nil {
+		// no-op if the response already settled the reservation
+		reserved.finish(false)
+	}
+	requestLogger(req).Debug("reverse-proxy", "url", originalURL, "backend", req.URL)
 }
 
-func AuthenticateAndRoute(field string, db *database.DB, w http.ResponseWriter, r *http.Request) (err error) {
-	_, password, ok := r.BasicAuth()
-	if !ok {
-		w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return errors.New("no basic auth passed")
+var errByteQuota = errors.New("upload exceeds the byte quota of the key")
+var errPutSize = errors.New("upload exceeds MaxPutSize")
+
+// uploadChunk is how many bytes are reserved at a time while an upload of
+// unknown length streams through.
+const uploadChunk = 1 << 20
+
+// reservation is a quota slot taken before a Put, Get or Mkcol is proxied. It
+// is committed if the backend succeeds and released otherwise, exactly once.
+// A Put also reserves bytes against the byte quota, and gives back whatever
+// was not actually uploaded.
+type reservation struct {
+	db       database.KeyStore
+	logger   *slog.Logger
+	keyID    string
+	endpoint string
+	field    string
+	once     sync.Once
+
+	lock  sync.Mutex
+	bytes int64
+	used  int64
+	// abort is why the upload was cut off while streaming, if it was
+	abort error
+	// webhookURL, if set, is sent event once the backend has taken the
+	// request, committed along with the slot
+	webhookURL string
+	event      UploadEvent
+}
+
+func (reserved *reservation) finish(success bool) {
+	reserved.once.Do(func() {
+		reserved.lock.Lock()
+		used := reserved.used
+		unused := reserved.bytes
+		if success {
+			unused -= used
+		}
+		reserved.lock.Unlock()
+		// the request context may already be cancelled by a client disconnect,
+		// and the slot must be settled either way
+		var err error
+		if success {
+			err = reserved.db.Commit(context.Background(), reserved.keyID, reserved.endpoint, reserved.field, reserved.notifications(used))
+		} else {
+			err = reserved.db.Release(context.Background(), reserved.keyID, reserved.endpoint, reserved.field)
+		}
+		if err != nil {
+			reserved.logger.Error("failed to settle reservation", "endpoint", reserved.endpoint, "field", reserved.field, "err", err)
+		}
+		if unused > 0 {
+			err = reserved.db.ReleaseBytes(context.Background(), reserved.keyID, reserved.endpoint, unused)
+			if err != nil {
+				reserved.logger.Error("failed to release reserved bytes", "endpoint", reserved.endpoint, "bytes", unused, "err", err)
+			}
+		}
+	})
+}
+
+// reserveBytes makes sure at least n bytes are reserved, asking for a whole
+// chunk at a time and falling back to the exact amount near the limit.
+func (reserved *reservation) reserveBytes(ctx context.Context, n int64) error {
+	reserved.lock.Lock()
+	defer reserved.lock.Unlock()
+	missing := n - reserved.bytes
+	if missing <= 0 {
+		return nil
+	}
+	if missing < uploadChunk {
+		err := reserved.db.ReserveBytes(ctx, reserved.keyID, reserved.endpoint, uploadChunk)
+		if err == nil {
+			reserved.bytes += uploadChunk
+			return nil
+		}
+	}
+	err := reserved.db.ReserveBytes(ctx, reserved.keyID, reserved.endpoint, missing)
+	if errors.Is(err, database.ErrByteQuota) {
+		return errByteQuota
+	}
+	if err != nil {
+		return err
+	}
+	reserved.bytes += missing
+	return nil
+}
+
+func (reserved *reservation) aborted() error {
+	reserved.lock.Lock()
+	defer reserved.lock.Unlock()
+	return reserved.abort
+}
+
+// uploadReader streams an upload to the backend, counting its bytes against
+// MaxPutSize and charging them to the byte quota as they are read. Crossing
+// either limit fails the read, which aborts the upstream request.
+type uploadReader struct {
+	ctx      context.Context
+	body     io.Reader
+	closer   io.Closer
+	maxSize  int64
+	reserved *reservation
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	n, err := u.body.Read(p)
+	if n > 0 {
+		u.reserved.lock.Lock()
+		used := u.reserved.used + int64(n)
+		u.reserved.lock.Unlock()
+		limitErr := errPutSize
+		if used <= u.maxSize {
+			limitErr = u.reserved.reserveBytes(u.ctx, used)
+		}
+		u.reserved.lock.Lock()
+		defer u.reserved.lock.Unlock()
+		if limitErr != nil {
+			if limitErr == errPutSize || limitErr == errByteQuota {
+				u.reserved.abort = limitErr
+			}
+			return 0, limitErr
+		}
+		u.reserved.used = used
+	}
+	return n, err
+}
+
+func (u *uploadReader) Close() error {
+	return u.closer.Close()
+}
+
+// streamUpload checks what it can of a PUT before it is proxied: the declared
+// size against MaxPutSize and the byte quota, and the file name and first 512
+// bytes against PutTypes. The body is then streamed through an uploadReader
+// rather than buffered, unless a matched type or the endpoint's schema has
+// to see the whole file.
+func streamUpload(endpoint database.Endpoint, reserved *reservation, r *http.Request) (status int, err error) {
+	if r.ContentLength > endpoint.MaxPutSize {
+		return http.StatusRequestEntityTooLarge, errPutSize
+	}
+	if r.ContentLength > 0 {
+		err = reserved.reserveBytes(r.Context(), r.ContentLength)
+		if err == errByteQuota {
+			return http.StatusRequestEntityTooLarge, err
+		}
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+	body := bufio.NewReaderSize(r.Body, filetype.HeadSize)
+	specs, anyType, err := filetype.ParseSpecs(endpoint.PutTypes)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !anyType {
+		head, err := body.Peek(filetype.HeadSize)
+		if err != nil && err != io.EOF {
+			return http.StatusBadRequest, err
+		}
+		specs = filetype.Match(specs, r.URL.Path, head)
+		if len(specs) == 0 {
+			return http.StatusUnauthorized, errors.New("invalid file type")
+		}
+	}
+	if anyType {
+		specs = nil
+	}
+	upload := &uploadReader{ctx: r.Context(), body: body, closer: r.Body, maxSize: endpoint.MaxPutSize, reserved: reserved}
+	if !filetype.NeedsFile(specs) && endpoint.Schema == nil {
+		r.Body = upload
+		return 0, nil
+	}
+	return spoolUpload(specs, endpoint.Schema, upload, r)
+}
+
+// spoolUpload reads a whole upload into a temporary file so the validators of
+// its matched types and the endpoint's schema can run before anything reaches
+// the backend. The file is then proxied in place of the request body and
+// removed when it is closed.
+func spoolUpload(specs []filetype.Spec, uploadSchema *schema.Schema, upload *uploadReader, r *http.Request) (status int, err error) {
+	file, err := os.CreateTemp("", "exius-upload-*")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	spooled := &spooledBody{file}
+	size, err := io.Copy(file, upload)
+	upload.Close()
+	if err != nil {
+		spooled.Close()
+		if abort := upload.reserved.aborted(); abort != nil {
+			return http.StatusRequestEntityTooLarge, abort
+		}
+		return http.StatusBadRequest, err
+	}
+	// the schema reports what is wrong in more detail than the types can
+	if uploadSchema != nil {
+		_, err = file.Seek(0, io.SeekStart)
+		if err == nil {
+			err = uploadSchema.Validate(file, r.URL.Path)
+		}
+		var invalid *schema.Error
+		if errors.As(err, &invalid) {
+			spooled.Close()
+			return http.StatusUnprocessableEntity, err
+		}
+		if err != nil {
+			spooled.Close()
+			return http.StatusInternalServerError, err
+		}
+	}
+	if filetype.NeedsFile(specs) {
+		err = filetype.ValidateFile(specs, file)
+		if err != nil {
+			spooled.Close()
+			return http.StatusUnauthorized, err
+		}
 	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		spooled.Close()
+		return http.StatusInternalServerError, err
+	}
+	r.Body = spooled
+	r.ContentLength = size
+	r.TransferEncoding = nil
+	return 0, nil
+}
+
+// spooledBody is an upload held in a temporary file.
+type spooledBody struct {
+	*os.File
+}
+
+func (s *spooledBody) Close() error {
+	s.File.Close()
+	return os.Remove(s.Name())
+}
+
+// AuthenticateAndRoute proxies a WebDAV request made with a key, or through a
+// presigned URL, to the endpoint it names.
+func AuthenticateAndRoute(field string, db database.KeyStore, w http.ResponseWriter, r *http.Request) (err error) {
 	origPath := strings.Split(r.URL.Path, "/")[1:]
 	if len(origPath) < 2 {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return errors.New("invalid URL")
 	}
+	filePath, err := cleanRelative(strings.Join(origPath[2:], "/"))
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return err
+	}
+	var keyID string
+	var keySet database.KeySet
+	var signed *presigned
+	if isPresigned(r) {
+		p, err := verifyPresigned(field, r)
+		if err != nil {
+			authFailures.WithLabelValues(authInvalidPresign).Inc()
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return err
+		}
+		keyID, signed = p.keyID, &p
+		auditKey(r, keyID, "")
+	} else {
+		keySet, err = requireKey(w, r)
+		if err != nil {
+			return err
+		}
+		keyID = keySet.KeyID
+	}
+	auditPath(r, origPath[1], "")
 	var proxyPath string
 	var access bool
-	var putTypes []string
-	var maxPutSize int64
-	if field == "Put" {
-		proxyPath, access, putTypes, maxPutSize, err = database.GetPutAndPath(password, origPath[1], db)
-		if err != nil || !access {
+	var reserved *reservation
+	if field == "Put" || field == "Get" || field == "Mkcol" {
+		endpoint, err := db.Reserve(r.Context(), keyID, origPath[1], field)
+		if err != nil {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return errors.New("no access to method")
+			return fmt.Errorf("no access to method: %w", err)
 		}
-		valid := isFileValid(putTypes, maxPutSize, w, r)
-		if !valid {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return errors.New("invalid file type")
+		reserved = &reservation{db: db, logger: requestLogger(r), keyID: keyID, endpoint: origPath[1], field: field}
+		proxyPath, access = endpoint.Path, true
+		if signed != nil {
+			err = signed.restrict(&endpoint)
+			if err != nil {
+				reserved.finish(false)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return err
+			}
+		}
+		if field == "Put" {
+			var status int
+			filePath, status, err = nameUpload(endpoint, keyID, filePath, r)
+			if err != nil {
+				reserved.finish(false)
+				if status == http.StatusInternalServerError {
+					http.Error(w, "", status)
+				} else {
+					http.Error(w, err.Error(), status)
+				}
+				return err
+			}
+			// the file types and schema go by the name the file is stored under
+			r.URL.Path = filesPath(origPath[1], filePath)
+			w.Header().Set("Content-Location", (&url.URL{Path: r.URL.Path}).EscapedPath())
+			reserved.webhookURL = endpoint.WebhookURL
+			reserved.event = UploadEvent{
+				Event:       "upload",
+				KeyID:       keyID,
+				Endpoint:    origPath[1],
+				Path:        w.Header().Get("Content-Location"),
+				ContentType: r.Header.Get("Content-Type"),
+			}
+			status, err = streamUpload(endpoint, reserved, r)
+			if err != nil {
+				reserved.finish(false)
+				switch status {
+				case http.StatusUnauthorized:
+					http.Error(w, "Unauthorized", status)
+				case http.StatusInternalServerError:
+					http.Error(w, "", status)
+				case http.StatusUnprocessableEntity:
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(status)
+					json.NewEncoder(w).Encode(err)
+				default:
+					http.Error(w, err.Error(), status)
+				}
+				return err
+			}
+		}
+	} else if field == "Move" {
+		// a move copies the source and deletes it
+		proxyPath, access, err = db.GetBoolFieldAndPath(r.Context(), keyID, origPath[1], "Copy")
+		if err == nil && access {
+			proxyPath, access, err = db.GetBoolFieldAndPath(r.Context(), keyID, origPath[1], "Delete")
 		}
-	} else if field == "Mkcol" {
-		//not finished implementation
-		proxyPath, access, err = database.GetMkcolAndPath(password, origPath[1], db)
-	} else if field == "Get" {
-		proxyPath, access, err = database.GetAndPath(password, origPath[1], db)
 	} else {
-		proxyPath, access, err = database.GetBoolFieldAndPath(password, origPath[1], field, db)
+		proxyPath, access, err = db.GetBoolFieldAndPath(r.Context(), keyID, origPath[1], field)
 	}
 	proxyPath = strings.Trim(proxyPath, `"`)
 	if err != nil || !access {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return errors.New("no access to method")
 	}
-	targetString := proxyURL
-	if proxyPath == "/" {
-		serveProxy(targetString, strings.Join(origPath[2:], "/"), field, password, origPath[1], db, w, r)
-	} else {
-		serveProxy(targetString, proxyPath+"/"+strings.Join(origPath[2:], "/"), field, password, origPath[1], db, w, r)
-	}
-	return nil
-}
-
-func propfindProxyResp(originalURL string) func(res *http.Response) error {
-	return func(res *http.Response) error {
-		context := strings.Split(originalURL, "/")[2]
-		b, err := io.ReadAll(res.Body)
+	if field == "Copy" || field == "Move" {
+		var status int
+		reserved, status, err = scopeDestination(db, keySet, origPath[1], joinBelow(proxyPath, filePath), r)
 		if err != nil {
-			log.Fatalln(err)
-		}
-		res.Body.Close()
-		b = bytes.Replace(b, []byte("<D:href>"), []byte(fmt.Sprintf("<D:href>/files/%s", context)), -1)
-		body := ioutil.NopCloser(bytes.NewReader(b))
-		res.Body = body
-		res.ContentLength = int64(len(b))
-		res.Header.Set("Content-Length", strconv.Itoa(len(b)))
-		return nil
-	}
-}
-
-func putProxyResp(key string, endpoint string, db *database.DB) func(res *http.Response) error {
-	return func(res *http.Response) error {
-		if res.StatusCode == 200 || res.StatusCode == 201 {
-			err := database.IteratePut(key, endpoint, db)
-			if err != nil {
-				return err
+			switch status {
+			case http.StatusUnauthorized:
+				http.Error(w, "Unauthorized", status)
+			case http.StatusInternalServerError:
+				http.Error(w, "", status)
+			default:
+				http.Error(w, err.Error(), status)
 			}
-			return nil
+			return err
 		}
-		return errors.New("bad put")
 	}
-}
-
-func getProxyResp(key string, endpoint string, db *database.DB) func(res *http.Response) error {
-	return func(res *http.Response) error {
-		if res.StatusCode == 200 || res.StatusCode == 201 {
-			err := database.IterateGet(key, endpoint, db)
-			if err != nil {
-				return err
-			}
+	var modify func(*http.Response) error
+	if field == "Propfind" {
+		err = checkDepth(w, r)
+		if err != nil {
+			return err
 		}
-		return nil
+		// the response is rewritten as it streams, which needs it uncompressed
+		r.Header.Del("Accept-Encoding")
+		modify = propfindProxyResp(origPath[1], proxyPath)
 	}
+	auditPath(r, origPath[1], filesPath(origPath[1], filePath))
+	serveProxy(proxyURL, joinBelow(proxyPath, filePath), modify, reserved, w, r)
+	return nil
 }
 
-func mkcolProxyResp(key string, endpoint string, db *database.DB) func(res *http.Response) error {
+// reservationProxyResp settles a reservation from the backend's status code.
+// The response itself is passed through unchanged.
+func reservationProxyResp(reserved *reservation) func(res *http.Response) error {
 	return func(res *http.Response) error {
-		if res.StatusCode == 200 || res.StatusCode == 201 {
-			err := database.IterateMkcol(key, endpoint, db)
-			if err != nil {
-				return err
-			}
-		}
+		reserved.finish(res.StatusCode >= 200 && res.StatusCode < 300)
 		return nil
 	}
 }
@@ -156,21 +457,3 @@ func contains(arr []string, value string) (index int, valid bool) {
 	}
 	return 0, false
 }
-
-func isFileValid(fileTypes []string, maxFileSize int64, w http.ResponseWriter, r *http.Request) bool {
-	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize-1)
-	b, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		r.Body = ioutil.NopCloser(bytes.NewBuffer(b))
-		return false
-	}
-	_, anyInTypes := contains(fileTypes, "any")
-	if anyInTypes {
-		r.Body = ioutil.NopCloser(bytes.NewBuffer(b))
-		return true
-	}
-	mimeType := http.DetectContentType(b)
-	_, valid := contains(fileTypes, strings.Split(mimeType, ";")[0])
-	r.Body = ioutil.NopCloser(bytes.NewBuffer(b))
-	return valid
-}
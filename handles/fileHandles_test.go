@@ -0,0 +1,84 @@
+package handles
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lanelewis/rclone-proxy/database"
+	"github.com/lanelewis/rclone-proxy/schema"
+)
+
+func TestPutSchemaViolationBody(t *testing.T) {
+	backend := &backendPaths{}
+	server := httptest.NewServer(backend)
+	defer server.Close()
+	oldProxy := proxyURL
+	proxyURL = server.URL
+	defer func() { proxyURL = oldProxy }()
+
+	db := database.NewMemoryStore()
+	err := db.AddKey(context.Background(), database.KeySet{
+		KeyValue:      "schema-test-key",
+		ExpireDelta:   1 << 40,
+		MaxTotalBytes: 1 << 40,
+		Endpoints: map[string]database.Endpoint{
+			"root": {Path: "/base", PutTypes: []string{"any"}, MaxPut: 10, MaxPutSize: 1 << 20, MaxTotalBytes: 1 << 40, Put: true,
+				Schema: &schema.Schema{CSV: &schema.CSV{Header: true, Columns: []schema.Column{{Name: "id", Type: "integer"}, {Name: "name", Required: true}}}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := Authenticate(db)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		AuthenticateAndRoute("Put", db, w, r)
+	}))
+	req := httptest.NewRequest(http.MethodPut, "/files/root/people.csv", strings.NewReader("id,name\nx,Ann\n2,\n"))
+	req.SetBasicAuth("", "schema-test-key")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	if res.Code != http.StatusUnprocessableEntity || res.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("PUT answered %d %s: %s", res.Code, res.Header().Get("Content-Type"), res.Body)
+	}
+	var body struct {
+		Errors    []map[string]interface{}
+		Truncated bool
+	}
+	dec := json.NewDecoder(res.Body)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&body)
+	if err != nil {
+		t.Fatalf("422 body %s: %v", res.Body, err)
+	}
+	want := []map[string]interface{}{
+		{"Line": 2.0, "Column": "id", "Message": `"x" is not a valid integer`},
+		{"Line": 3.0, "Column": "name", "Message": "value is required"},
+	}
+	if len(body.Errors) != len(want) || body.Truncated {
+		t.Fatalf("422 body lists %v, truncated %v", body.Errors, body.Truncated)
+	}
+	for i, violation := range body.Errors {
+		for k, v := range want[i] {
+			if violation[k] != v {
+				t.Errorf("violation %d: %s = %v, want %v", i, k, violation[k], v)
+			}
+		}
+		if len(violation) != len(want[i]) {
+			t.Errorf("violation %d has fields %v", i, violation)
+		}
+	}
+	if len(backend.paths) > 0 {
+		t.Errorf("invalid upload reached the backend at %v", backend.paths)
+	}
+	stored, err := db.GetKey(context.Background(), "schema-test-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := stored.Endpoints["root"].PutCount; n != 0 {
+		t.Errorf("rejected upload counted, PutCount %d", n)
+	}
+}
@@ -0,0 +1,149 @@
+package handles
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lanelewis/rclone-proxy/database"
+	"github.com/lanelewis/rclone-proxy/logging"
+)
+
+// readyTimeout bounds each check of /readyz, so a hung dependency makes the
+// probe fail rather than hang.
+const readyTimeout = 2 * time.Second
+
+// readyTTL is how long the outcome of /readyz is reused, so frequent or
+// hostile probing does not turn into load on the dependencies.
+const readyTTL = 2 * time.Second
+
+// ReadyCheck is the outcome of one dependency check of /readyz. Why a check
+// failed is only logged, since /readyz needs no key.
+type ReadyCheck struct {
+	Status       string
+	Milliseconds int64
+}
+
+// Readiness is the body returned by /healthz and /readyz. Status is "ok", or
+// "unavailable" if any check failed.
+type Readiness struct {
+	Status string
+	Checks map[string]ReadyCheck `json:",omitempty"`
+}
+
+// HealthzHandle reports that the process is up and serving requests. It
+// checks nothing else, so a struggling dependency never gets it restarted.
+func HealthzHandle(w http.ResponseWriter, r *http.Request) {
+	writeReadiness(w, Readiness{Status: "ok"})
+}
+
+// ReadyzHandle reports whether the key store, the rclone WebDAV backend and
+// the rclone rc server all answer, checking them in parallel. The outcome is
+// reused for readyTTL.
+func ReadyzHandle(db database.KeyStore) http.HandlerFunc {
+	checks := map[string]func(context.Context) error{
+		"database": db.Ping,
+		"backend":  pingBackend,
+		"admin":    pingAdmin,
+	}
+	var cacheLock sync.Mutex
+	var cached Readiness
+	var checkedAt time.Time
+	return func(w http.ResponseWriter, r *http.Request) {
+		// held while checking, so concurrent probes wait for one outcome
+		cacheLock.Lock()
+		if time.Since(checkedAt) >= readyTTL {
+			cached = checkReadiness(r, checks)
+			checkedAt = time.Now()
+		}
+		ready := cached
+		cacheLock.Unlock()
+		writeReadiness(w, ready)
+	}
+}
+
+// checkReadiness runs checks in parallel and logs why any failed.
+func checkReadiness(r *http.Request, checks map[string]func(context.Context) error) Readiness {
+	ready := Readiness{Status: "ok", Checks: map[string]ReadyCheck{}}
+	logger := requestLogger(r)
+	var lock sync.Mutex
+	var wait sync.WaitGroup
+	for name, check := range checks {
+		wait.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wait.Done()
+			// the outcome is shared, so it must not depend on this client
+			// staying connected
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), readyTimeout)
+			defer cancel()
+			start := time.Now()
+			err := check(ctx)
+			result := ReadyCheck{Status: "ok", Milliseconds: time.Since(start).Milliseconds()}
+			if err != nil {
+				result.Status = "error"
+				logger.Warn("readiness check failed", "check", name, "err", err)
+			}
+			lock.Lock()
+			ready.Checks[name] = result
+			if err != nil {
+				ready.Status = "unavailable"
+			}
+			lock.Unlock()
+		}(name, check)
+	}
+	wait.Wait()
+	return ready
+}
+
+func writeReadiness(w http.ResponseWriter, ready Readiness) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if ready.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(ready)
+}
+
+// probe sends req and fails unless the status of the answer is among ok.
+func probe(ctx context.Context, req *http.Request, ok ...int) error {
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set(logging.RequestIDHeader, id)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	for _, status := range ok {
+		if res.StatusCode == status {
+			return nil
+		}
+	}
+	return fmt.Errorf("answered %s with %d", req.Method, res.StatusCode)
+}
+
+// pingBackend lists the root of the WebDAV backend without its children.
+func pingBackend(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", proxyURL+"/", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Depth", "0")
+	return probe(ctx, req, http.StatusMultiStatus)
+}
+
+// pingAdmin calls rc/noop on the rclone rc server behind /admin/, which
+// initiate.sh starts with the admin key as its password.
+func pingAdmin(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, adminURL+"/admin/rc/noop", strings.NewReader("{}"))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("admin", adminKey)
+	return probe(ctx, req, http.StatusOK)
+}
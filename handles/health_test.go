@@ -0,0 +1,39 @@
+package handles
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lanelewis/rclone-proxy/database"
+)
+
+func TestReadyzCachesAndHidesErrors(t *testing.T) {
+	var hits atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "secret backend detail", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	oldProxy, oldAdmin := proxyURL, adminURL
+	SetBackendURLs(server.URL, server.URL)
+	defer func() { proxyURL, adminURL = oldProxy, oldAdmin }()
+
+	handler := ReadyzHandle(database.NewMemoryStore())
+	for i := 0; i < 3; i++ {
+		res := httptest.NewRecorder()
+		handler(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if res.Code != http.StatusServiceUnavailable {
+			t.Errorf("/readyz answered %d, want %d", res.Code, http.StatusServiceUnavailable)
+		}
+		body := res.Body.String()
+		if !strings.Contains(body, `"backend":{"Status":"error"`) || strings.Contains(body, "secret") || strings.Contains(body, "500") {
+			t.Errorf("/readyz body %s", body)
+		}
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("three probes within %v reached the backends %d times, want 2", readyTTL, n)
+	}
+}
@@ -0,0 +1,146 @@
+package handles
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lanelewis/rclone-proxy/config"
+	"github.com/lanelewis/rclone-proxy/database"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exius_http_requests_total",
+		Help: "Requests served, by route, method and status code.",
+	}, []string{"route", "method", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "exius_http_request_duration_seconds",
+		Help:    "Time taken to serve requests, by route and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+	httpRequestBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exius_http_request_bytes_total",
+		Help: "Bytes read from request bodies, by route and method.",
+	}, []string{"route", "method"})
+	httpResponseBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exius_http_response_bytes_total",
+		Help: "Bytes written to response bodies, by route and method.",
+	}, []string{"route", "method"})
+	authFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exius_auth_failures_total",
+		Help: "Requests refused for their credentials, by reason.",
+	}, []string{"reason"})
+	backendResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exius_backend_responses_total",
+		Help: "Responses from the storage backend, by method and status code.",
+	}, []string{"method", "status"})
+	backendErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "exius_backend_errors_total",
+		Help: "Proxied requests the storage backend gave no response to, by method.",
+	}, []string{"method"})
+)
+
+// Reasons counted by exius_auth_failures_total.
+const (
+	authNoCredentials          = "no_credentials"
+	authConflictingCredentials = "conflicting_credentials"
+	authInvalidKey             = "invalid_key"
+	authInvalidPresign         = "invalid_presign"
+	authNotAdmin               = "not_admin"
+)
+
+// routes are the first path segments given their own route label, so that
+// requests to unknown paths cannot blow up the number of series.
+var routes = []string{"files", "addKey", "getKey", "deleteKey", "updateKey", "getChildKeys", "presign", "audit", "admin"}
+
+var methods = []string{"COPY", "DELETE", "GET", "HEAD", "LOCK", "MKCOL", "MOVE", "OPTIONS", "POST", "PROPFIND", "PUT", "TRACE", "UNLOCK"}
+
+func routeLabel(r *http.Request) string {
+	route := strings.Split(r.URL.Path, "/")[1]
+	if _, ok := contains(routes, route); ok {
+		return route
+	}
+	return "other"
+}
+
+func methodLabel(method string) string {
+	if _, ok := contains(methods, method); ok {
+		return method
+	}
+	return "OTHER"
+}
+
+// Metrics counts and times every request it wraps.
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route, method := routeLabel(r), methodLabel(r.Method)
+		body := &countingBody{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+		httpRequestBytes.WithLabelValues(route, method).Add(float64(body.n))
+		httpResponseBytes.WithLabelValues(route, method).Add(float64(recorder.n))
+	})
+}
+
+// MetricsHandler serves the metrics to whoever rule lets in: the admin key
+// (the default), requests bearing token, or anyone. It sits outside
+// Authenticate, so it checks keys itself.
+func MetricsHandler(db database.KeyStore, rule string, token string) (http.Handler, error) {
+	metrics := promhttp.Handler()
+	switch rule {
+	case "", config.MetricsAuthAdmin:
+		adminID := database.KeyID(adminKey)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key, err := presentedKey(r)
+			if err == nil {
+				var keySet database.KeySet
+				keySet, err = db.GetKey(r.Context(), key)
+				if err == nil && keySet.KeyID != adminID {
+					authFailures.WithLabelValues(authNotAdmin).Inc()
+					err = errors.New("key is not the admin key")
+				}
+			}
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="restricted", charset="UTF-8"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				requestLogger(r).Warn("metrics scrape refused", "path", r.URL.Path, "err", err)
+				return
+			}
+			metrics.ServeHTTP(w, r)
+		}), nil
+	case config.MetricsAuthToken:
+		if token == "" {
+			return nil, fmt.Errorf("METRICS_AUTH=%s needs METRICS_TOKEN", config.MetricsAuthToken)
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scheme, presented, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+			if !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(presented)), []byte(token)) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				requestLogger(r).Warn("metrics scrape refused", "path", r.URL.Path, "err", "invalid token")
+				return
+			}
+			metrics.ServeHTTP(w, r)
+		}), nil
+	case config.MetricsAuthNone:
+		return metrics, nil
+	}
+	return nil, fmt.Errorf("unknown METRICS_AUTH %q", rule)
+}
@@ -0,0 +1,218 @@
+package handles
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/lanelewis/rclone-proxy/database"
+	"github.com/lanelewis/rclone-proxy/logging"
+)
+
+// Collision policies of an endpoint, applied when an upload's name is already
+// taken. An empty policy means CollisionOverwrite.
+const (
+	CollisionOverwrite = "overwrite"
+	CollisionReject    = "reject"
+	CollisionSuffix    = "suffix"
+)
+
+// maxSuffix bounds how many numbered names a suffixed upload tries, each
+// costing a HEAD to the backend before the PUT goes through.
+const maxSuffix = 9
+
+var errNameTaken = errors.New("file name already taken")
+
+// nameFields are the placeholders a NameTemplate can use. filename is the last
+// segment of the request path, basename and ext are it split at its extension.
+var nameFields = []string{"keyid", "uuid", "timestamp", "date", "filename", "basename", "ext"}
+
+func validCollision(policy string) bool {
+	switch policy {
+	case "", CollisionOverwrite, CollisionReject, CollisionSuffix:
+		return true
+	}
+	return false
+}
+
+// collisionWithin reports whether a child's collision policy protects existing
+// files at least as well as its parent's.
+func collisionWithin(child string, parent string) bool {
+	return !(child == "" || child == CollisionOverwrite) || parent == "" || parent == CollisionOverwrite
+}
+
+// checkNameTemplate makes sure template only uses known placeholders and
+// always names a file below the endpoint.
+func checkNameTemplate(template string) error {
+	if template == "" {
+		return nil
+	}
+	values := map[string]string{}
+	for _, field := range nameFields {
+		values[field] = "x"
+	}
+	name, err := fillTemplate(template, values)
+	if err != nil {
+		return err
+	}
+	cleaned, err := cleanRelative(name)
+	if err != nil || cleaned == "" || strings.HasSuffix(name, "/") {
+		return errors.New("name template must name a file below the endpoint")
+	}
+	return nil
+}
+
+// checkNaming validates the NameTemplate and OnCollision of an endpoint from a
+// request body.
+func checkNaming(endpoint ClientEndpoint) error {
+	if !validCollision(endpoint.OnCollision) {
+		return fmt.Errorf("invalid value %q for onCollision", endpoint.OnCollision)
+	}
+	return checkNameTemplate(endpoint.NameTemplate)
+}
+
+func fillTemplate(template string, values map[string]string) (string, error) {
+	var b strings.Builder
+	rest := template
+	for {
+		open := strings.IndexAny(rest, "{}")
+		if open < 0 {
+			b.WriteString(rest)
+			return b.String(), nil
+		}
+		if rest[open] == '}' {
+			return "", errors.New("unmatched } in name template")
+		}
+		b.WriteString(rest[:open])
+		rest = rest[open+1:]
+		end := strings.IndexAny(rest, "{}")
+		if end < 0 || rest[end] == '{' {
+			return "", errors.New("unmatched { in name template")
+		}
+		value, ok := values[rest[:end]]
+		if !ok {
+			return "", fmt.Errorf("unknown name template field {%s}", rest[:end])
+		}
+		b.WriteString(value)
+		rest = rest[end+1:]
+	}
+}
+
+// templateName renames an upload to filePath by the endpoint's NameTemplate.
+func templateName(template string, keyID string, filePath string) (string, error) {
+	filename := path.Base("/" + filePath)
+	ext := path.Ext(filename)
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	// version 4, variant 1
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	hexID := hex.EncodeToString(id)
+	now := time.Now().UTC()
+	name, err := fillTemplate(template, map[string]string{
+		"keyid":     keyID,
+		"uuid":      hexID[:8] + "-" + hexID[8:12] + "-" + hexID[12:16] + "-" + hexID[16:20] + "-" + hexID[20:],
+		"timestamp": now.Format("20060102T150405.000Z"),
+		"date":      now.Format("2006-01-02"),
+		"filename":  filename,
+		"basename":  strings.TrimSuffix(filename, ext),
+		"ext":       strings.TrimPrefix(ext, "."),
+	})
+	if err != nil {
+		return "", err
+	}
+	return cleanRelative(name)
+}
+
+// backendStat asks the backend whether a file is at path, and when it was last
+// written if the backend says.
+func backendStat(ctx context.Context, path string) (exists bool, modified time.Time, err error) {
+	target, _ := url.Parse(proxyURL)
+	target.Path = path
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, target.String(), nil)
+	if err != nil {
+		return false, modified, err
+	}
+	if id := logging.RequestID(ctx); id != "" {
+		req.Header.Set(logging.RequestIDHeader, id)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, modified, err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return false, modified, nil
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		modified, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+		return true, modified, nil
+	}
+	return false, modified, fmt.Errorf("backend answered HEAD with %d", res.StatusCode)
+}
+
+// nameUpload works out where a PUT to filePath below endpoint ends up, by its
+// NameTemplate and collision policy, and checks that its Overwrite policy
+// allows replacing whatever is there. When the name was free, the upload is
+// sent with If-None-Match: * so a backend that honours it refuses a file
+// created since the name was checked.
+func nameUpload(endpoint database.Endpoint, keyID string, filePath string, r *http.Request) (name string, status int, err error) {
+	overwrite := endpoint.OnCollision == "" || endpoint.OnCollision == CollisionOverwrite
+	if overwrite && endpoint.NameTemplate == "" && !protectsFiles(endpoint) {
+		return filePath, 0, nil
+	}
+	if filePath == "" || strings.HasSuffix(filePath, "/") {
+		return "", http.StatusBadRequest, errors.New("PUT must name a file")
+	}
+	if endpoint.NameTemplate != "" {
+		filePath, err = templateName(endpoint.NameTemplate, keyID, filePath)
+		if err != nil {
+			return "", http.StatusInternalServerError, err
+		}
+	}
+	root := strings.Trim(endpoint.Path, `"`)
+	if overwrite {
+		if !protectsFiles(endpoint) {
+			return filePath, 0, nil
+		}
+		exists, modified, err := backendStat(r.Context(), joinBelow(root, filePath))
+		if err != nil {
+			return "", http.StatusBadGateway, err
+		}
+		if !exists {
+			r.Header.Set("If-None-Match", "*")
+		} else if !mayOverwrite(endpoint, modified) {
+			return "", http.StatusConflict, errImmutable
+		}
+		return filePath, 0, nil
+	}
+	ext := path.Ext(filePath)
+	for i := 0; i <= maxSuffix; i++ {
+		candidate := filePath
+		if i > 0 {
+			candidate = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(filePath, ext), i, ext)
+		}
+		exists, _, err := backendStat(r.Context(), joinBelow(root, candidate))
+		if err != nil {
+			return "", http.StatusBadGateway, err
+		}
+		if !exists {
+			r.Header.Set("If-None-Match", "*")
+			return candidate, 0, nil
+		}
+		if endpoint.OnCollision == CollisionReject {
+			break
+		}
+	}
+	return "", http.StatusConflict, errNameTaken
+}
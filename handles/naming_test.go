@@ -0,0 +1,203 @@
+package handles
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lanelewis/rclone-proxy/database"
+)
+
+// fileBackend answers HEAD requests for the files it holds, with when they
+// were last written, and 404 for the rest. It counts the HEADs it is sent.
+type fileBackend struct {
+	lock  sync.Mutex
+	files map[string]time.Time
+	heads int
+}
+
+func (b *fileBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if r.Method != http.MethodHead {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	b.heads++
+	modified, ok := b.files[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// useFileBackend points the proxy at a fileBackend holding files for the
+// length of the test.
+func useFileBackend(t *testing.T, files map[string]time.Time) *fileBackend {
+	backend := &fileBackend{files: files}
+	server := httptest.NewServer(backend)
+	oldProxy := proxyURL
+	proxyURL = server.URL
+	t.Cleanup(func() {
+		proxyURL = oldProxy
+		server.Close()
+	})
+	return backend
+}
+
+func putRequest(filePath string) *http.Request {
+	return httptest.NewRequest(http.MethodPut, "/files/root/"+filePath, nil)
+}
+
+func TestNameTemplates(t *testing.T) {
+	backend := useFileBackend(t, nil)
+	uuid := "[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}"
+	for _, tt := range []struct {
+		template string
+		filePath string
+		want     string
+	}{
+		{"{keyid}/{filename}", "report.csv", `^key-1/report\.csv$`},
+		{"{filename}", "dir/sub/report.csv", `^report\.csv$`},
+		{"in/{basename}-{date}.{ext}", "dir/report.csv", `^in/report-\d{4}-\d{2}-\d{2}\.csv$`},
+		{"{timestamp}-{filename}", "report.csv", `^\d{8}T\d{6}\.\d{3}Z-report\.csv$`},
+		{"{uuid}.{ext}", "report.csv", "^" + uuid + `\.csv$`},
+		{"{keyid}/../{filename}", "dir/report.csv", `^report\.csv$`},
+	} {
+		req := putRequest(tt.filePath)
+		endpoint := database.Endpoint{Path: "/base", NameTemplate: tt.template}
+		name, status, err := nameUpload(endpoint, "key-1", tt.filePath, req)
+		if err != nil {
+			t.Errorf("%s for %s: %d %v", tt.template, tt.filePath, status, err)
+			continue
+		}
+		if !regexp.MustCompile(tt.want).MatchString(name) {
+			t.Errorf("%s for %s named %q, want %s", tt.template, tt.filePath, name, tt.want)
+		}
+		if req.Header.Get("If-None-Match") != "" {
+			t.Errorf("%s: overwriting upload sent If-None-Match", tt.template)
+		}
+	}
+	if backend.heads != 0 {
+		t.Errorf("overwrite policy sent %d HEADs", backend.heads)
+	}
+	first, _, _ := nameUpload(database.Endpoint{NameTemplate: "{uuid}"}, "key-1", "a", putRequest("a"))
+	second, _, _ := nameUpload(database.Endpoint{NameTemplate: "{uuid}"}, "key-1", "a", putRequest("a"))
+	if first == second {
+		t.Errorf("two uploads got the same uuid %s", first)
+	}
+}
+
+func TestCheckNameTemplate(t *testing.T) {
+	for template, ok := range map[string]bool{
+		"":                          true,
+		"{filename}":                true,
+		"{keyid}/{date}/{filename}": true,
+		"{nope}":                    false,
+		"{filename":                 false,
+		"filename}":                 false,
+		"{{filename}}":              false,
+		"../{filename}":             false,
+		"{filename}/":               false,
+		"{keyid}/..":                false,
+		"/":                         false,
+	} {
+		if err := checkNameTemplate(template); (err == nil) != ok {
+			t.Errorf("checkNameTemplate(%q) = %v", template, err)
+		}
+	}
+}
+
+func TestNameUploadCollisions(t *testing.T) {
+	taken := map[string]time.Time{"/base/a.txt": {}, "/base/a-1.txt": {}, "/base/a-2.txt": {}}
+	for _, tt := range []struct {
+		policy string
+		want   string
+		status int
+		heads  int
+	}{
+		{"", "a.txt", 0, 0},
+		{CollisionOverwrite, "a.txt", 0, 0},
+		{CollisionReject, "", http.StatusConflict, 1},
+		{CollisionSuffix, "a-3.txt", 0, 4},
+	} {
+		backend := useFileBackend(t, taken)
+		req := putRequest("a.txt")
+		name, status, err := nameUpload(database.Endpoint{Path: "/base", OnCollision: tt.policy}, "key-1", "a.txt", req)
+		if name != tt.want || status != tt.status || (err == nil) != (tt.status == 0) {
+			t.Errorf("%q: named %q, %d %v, want %q %d", tt.policy, name, status, err, tt.want, tt.status)
+		}
+		if backend.heads != tt.heads {
+			t.Errorf("%q: sent %d HEADs, want %d", tt.policy, backend.heads, tt.heads)
+		}
+		if noneMatch := req.Header.Get("If-None-Match"); (noneMatch == "*") != (tt.heads > 0 && tt.status == 0) {
+			t.Errorf("%q: If-None-Match %q", tt.policy, noneMatch)
+		}
+	}
+	for _, policy := range []string{CollisionReject, CollisionSuffix} {
+		useFileBackend(t, nil)
+		name, _, err := nameUpload(database.Endpoint{Path: "/base", OnCollision: policy}, "key-1", "a.txt", putRequest("a.txt"))
+		if err != nil || name != "a.txt" {
+			t.Errorf("%q: free name became %q, %v", policy, name, err)
+		}
+		_, status, _ := nameUpload(database.Endpoint{Path: "/base", OnCollision: policy}, "key-1", "dir/", putRequest("dir/"))
+		if status != http.StatusBadRequest {
+			t.Errorf("%q: PUT to a collection answered %d", policy, status)
+		}
+	}
+}
+
+func TestNameUploadSuffixIsBounded(t *testing.T) {
+	taken := map[string]time.Time{"/base/a.txt": {}}
+	for i := 1; i <= 1000; i++ {
+		taken["/base/a-"+strconv.Itoa(i)+".txt"] = time.Time{}
+	}
+	backend := useFileBackend(t, taken)
+	_, status, err := nameUpload(database.Endpoint{Path: "/base", OnCollision: CollisionSuffix}, "key-1", "a.txt", putRequest("a.txt"))
+	if status != http.StatusConflict || err != errNameTaken {
+		t.Errorf("answered %d %v, want %d %v", status, err, http.StatusConflict, errNameTaken)
+	}
+	if backend.heads != maxSuffix+1 {
+		t.Errorf("sent %d HEADs for one PUT, want %d", backend.heads, maxSuffix+1)
+	}
+}
+
+func TestNameUploadBackendDown(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	oldProxy := proxyURL
+	proxyURL = server.URL
+	defer func() { proxyURL = oldProxy }()
+
+	_, status, err := nameUpload(database.Endpoint{Path: "/base", OnCollision: CollisionSuffix}, "key-1", "a.txt", putRequest("a.txt"))
+	if status != http.StatusBadGateway || err == nil {
+		t.Errorf("answered %d %v, want %d", status, err, http.StatusBadGateway)
+	}
+}
+
+func TestCollisionWithin(t *testing.T) {
+	for _, tt := range []struct {
+		child, parent string
+		want          bool
+	}{
+		{"", "", true},
+		{CollisionReject, "", true},
+		{CollisionSuffix, CollisionOverwrite, true},
+		{CollisionReject, CollisionSuffix, true},
+		{CollisionOverwrite, CollisionReject, false},
+		{"", CollisionSuffix, false},
+	} {
+		if got := collisionWithin(tt.child, tt.parent); got != tt.want {
+			t.Errorf("collisionWithin(%q, %q) = %v, want %v", tt.child, tt.parent, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package handles
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lanelewis/rclone-proxy/database"
+)
+
+// Overwrite policies of an endpoint. Under OverwriteDenyAfter a file can
+// still be replaced for OverwriteWindow seconds after it was last written, so
+// a bad upload can be fixed before it becomes final. An empty policy means
+// OverwriteAllow.
+const (
+	OverwriteAllow     = "allow"
+	OverwriteDeny      = "deny"
+	OverwriteDenyAfter = "deny-after"
+)
+
+var errImmutable = errors.New("file already exists and may not be overwritten")
+
+// checkOverwrite validates the Overwrite and OverwriteWindow of an endpoint
+// from a request body.
+func checkOverwrite(endpoint ClientEndpoint) error {
+	switch endpoint.Overwrite {
+	case "", OverwriteAllow, OverwriteDeny:
+		if endpoint.OverwriteWindow != 0 {
+			return errors.New("overwriteWindow only applies to deny-after")
+		}
+	case OverwriteDenyAfter:
+		if endpoint.OverwriteWindow <= 0 {
+			return errors.New("deny-after needs a positive overwriteWindow")
+		}
+	default:
+		return fmt.Errorf("invalid value %q for overwrite", endpoint.Overwrite)
+	}
+	return nil
+}
+
+// overwriteWindow is how long a file under policy can be overwritten for, or
+// -1 for ever.
+func overwriteWindow(policy string, window int64) int64 {
+	switch policy {
+	case OverwriteDeny:
+		return 0
+	case OverwriteDenyAfter:
+		return window
+	}
+	return -1
+}
+
+// overwriteWithin reports whether a child's overwrite policy is at least as
+// strict as its parent's.
+func overwriteWithin(child ClientEndpoint, parent ClientEndpoint) bool {
+	childWindow := overwriteWindow(child.Overwrite, child.OverwriteWindow)
+	parentWindow := overwriteWindow(parent.Overwrite, parent.OverwriteWindow)
+	return parentWindow < 0 || (childWindow >= 0 && childWindow <= parentWindow)
+}
+
+// protectsFiles reports whether an endpoint keeps some existing files from
+// being overwritten.
+func protectsFiles(endpoint database.Endpoint) bool {
+	return overwriteWindow(endpoint.Overwrite, endpoint.OverwriteWindow) >= 0
+}
+
+// mayOverwrite reports whether a file last written at modified can be
+// replaced through endpoint. A zero modified time, from a backend that did
+// not say, counts as long ago.
+func mayOverwrite(endpoint database.Endpoint, modified time.Time) bool {
+	window := overwriteWindow(endpoint.Overwrite, endpoint.OverwriteWindow)
+	if window < 0 {
+		return true
+	}
+	return !modified.IsZero() && time.Since(modified) < time.Duration(window)*time.Second
+}
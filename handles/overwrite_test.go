@@ -0,0 +1,123 @@
+package handles
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/lanelewis/rclone-proxy/database"
+)
+
+func TestNameUploadOverwritePolicies(t *testing.T) {
+	now := time.Now()
+	files := map[string]time.Time{
+		"/base/recent.txt":  now.Add(-10 * time.Second),
+		"/base/old.txt":     now.Add(-2 * time.Hour),
+		"/base/unknown.txt": {},
+	}
+	for _, tt := range []struct {
+		policy    string
+		window    int64
+		file      string
+		status    int
+		noneMatch bool
+	}{
+		{OverwriteAllow, 0, "old.txt", 0, false},
+		{"", 0, "old.txt", 0, false},
+		{OverwriteDeny, 0, "new.txt", 0, true},
+		{OverwriteDeny, 0, "recent.txt", http.StatusConflict, false},
+		{OverwriteDeny, 0, "old.txt", http.StatusConflict, false},
+		{OverwriteDenyAfter, 60, "new.txt", 0, true},
+		{OverwriteDenyAfter, 60, "recent.txt", 0, false},
+		{OverwriteDenyAfter, 60, "old.txt", http.StatusConflict, false},
+		{OverwriteDenyAfter, 60, "unknown.txt", http.StatusConflict, false},
+		{OverwriteDenyAfter, 3 * 3600, "old.txt", 0, false},
+	} {
+		backend := useFileBackend(t, files)
+		req := putRequest(tt.file)
+		endpoint := database.Endpoint{Path: "/base", Overwrite: tt.policy, OverwriteWindow: tt.window}
+		name, status, err := nameUpload(endpoint, "key-1", tt.file, req)
+		if status != tt.status || (err == nil) != (tt.status == 0) {
+			t.Errorf("%s %d on %s: answered %d %v, want %d", tt.policy, tt.window, tt.file, status, err, tt.status)
+		}
+		if tt.status == http.StatusConflict && err != errImmutable {
+			t.Errorf("%s %d on %s: %v, want %v", tt.policy, tt.window, tt.file, err, errImmutable)
+		}
+		if tt.status == 0 && name != tt.file {
+			t.Errorf("%s %d on %s: named %q", tt.policy, tt.window, tt.file, name)
+		}
+		if got := req.Header.Get("If-None-Match") == "*"; got != tt.noneMatch {
+			t.Errorf("%s %d on %s: If-None-Match sent %v, want %v", tt.policy, tt.window, tt.file, got, tt.noneMatch)
+		}
+		if wantHeads := map[bool]int{true: 1, false: 0}[protectsFiles(endpoint)]; backend.heads != wantHeads {
+			t.Errorf("%s %d on %s: sent %d HEADs, want %d", tt.policy, tt.window, tt.file, backend.heads, wantHeads)
+		}
+	}
+}
+
+func TestCheckOverwrite(t *testing.T) {
+	for _, tt := range []struct {
+		policy string
+		window int64
+		ok     bool
+	}{
+		{"", 0, true},
+		{OverwriteAllow, 0, true},
+		{OverwriteDeny, 0, true},
+		{OverwriteDenyAfter, 60, true},
+		{OverwriteDenyAfter, 0, false},
+		{OverwriteDenyAfter, -1, false},
+		{OverwriteDeny, 60, false},
+		{OverwriteAllow, 60, false},
+		{"never", 0, false},
+	} {
+		err := checkOverwrite(ClientEndpoint{Overwrite: tt.policy, OverwriteWindow: tt.window})
+		if (err == nil) != tt.ok {
+			t.Errorf("checkOverwrite(%q, %d) = %v", tt.policy, tt.window, err)
+		}
+	}
+}
+
+func TestChildOverwriteInheritance(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		parent ClientEndpoint
+		child  ClientEndpoint
+		ok     bool
+		policy string
+		window int64
+	}{
+		{"inherits deny", ClientEndpoint{Overwrite: OverwriteDeny}, ClientEndpoint{}, true, OverwriteDeny, 0},
+		{"inherits deny-after", ClientEndpoint{Overwrite: OverwriteDenyAfter, OverwriteWindow: 60}, ClientEndpoint{}, true, OverwriteDenyAfter, 60},
+		{"cannot loosen deny to allow", ClientEndpoint{Overwrite: OverwriteDeny}, ClientEndpoint{Overwrite: OverwriteAllow}, false, "", 0},
+		{"cannot loosen deny to deny-after", ClientEndpoint{Overwrite: OverwriteDeny}, ClientEndpoint{Overwrite: OverwriteDenyAfter, OverwriteWindow: 1}, false, "", 0},
+		{"cannot widen the window", ClientEndpoint{Overwrite: OverwriteDenyAfter, OverwriteWindow: 60}, ClientEndpoint{Overwrite: OverwriteDenyAfter, OverwriteWindow: 61}, false, "", 0},
+		{"cannot loosen deny-after to allow", ClientEndpoint{Overwrite: OverwriteDenyAfter, OverwriteWindow: 60}, ClientEndpoint{Overwrite: OverwriteAllow}, false, "", 0},
+		{"narrows the window", ClientEndpoint{Overwrite: OverwriteDenyAfter, OverwriteWindow: 60}, ClientEndpoint{Overwrite: OverwriteDenyAfter, OverwriteWindow: 30}, true, OverwriteDenyAfter, 30},
+		{"tightens deny-after to deny", ClientEndpoint{Overwrite: OverwriteDenyAfter, OverwriteWindow: 60}, ClientEndpoint{Overwrite: OverwriteDeny}, true, OverwriteDeny, 0},
+		{"tightens allow", ClientEndpoint{}, ClientEndpoint{Overwrite: OverwriteDenyAfter, OverwriteWindow: 5}, true, OverwriteDenyAfter, 5},
+	} {
+		parent := confineParent()
+		parentEndpoint := parent.Endpoints["root"]
+		parentEndpoint.Overwrite, parentEndpoint.OverwriteWindow = tt.parent.Overwrite, tt.parent.OverwriteWindow
+		parent.Endpoints["root"] = parentEndpoint
+		child := ClientKeySet{
+			MaxTotalBytes: -1,
+			Endpoints: map[string]ClientEndpoint{
+				"child": {Path: "root", PutTypes: []string{"any"}, MaxTotalBytes: -1, Put: true,
+					Overwrite: tt.child.Overwrite, OverwriteWindow: tt.child.OverwriteWindow},
+			},
+		}
+		key, err := ValidateChildKey(child, parent)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := key.Endpoints["child"]; got.Overwrite != tt.policy || got.OverwriteWindow != tt.window {
+			t.Errorf("%s: child stored with %q %d, want %q %d", tt.name, got.Overwrite, got.OverwriteWindow, tt.policy, tt.window)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package handles
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lanelewis/rclone-proxy/database"
+	"github.com/lanelewis/rclone-proxy/filetype"
+)
+
+// PresignJson is the body of /presign. Path is the endpoint name followed by
+// the file, e.g. "uploads/subject1.csv". MaxSize and ContentType only apply to
+// PUT, and narrow the endpoint's MaxPutSize and PutTypes for that one URL.
+type PresignJson struct {
+	Method string
+	Path   string
+	// ExpiresIn is in milliseconds, like the ExpireDelta of keys.
+	ExpiresIn   uint64
+	MaxSize     int64
+	ContentType string
+}
+
+// PresignedURL is returned by /presign. Expires is in unix milliseconds.
+type PresignedURL struct {
+	URL     string
+	Method  string
+	Expires int64
+}
+
+// maxPresignLifetime bounds how long a presigned URL can live, whatever the
+// key it was issued from.
+const maxPresignLifetime = 7 * 24 * time.Hour
+
+// Query parameters of a presigned URL. They are stripped before the request
+// is proxied.
+const (
+	presignCredential  = "X-Exius-Credential"
+	presignExpires     = "X-Exius-Expires"
+	presignMaxSize     = "X-Exius-Max-Size"
+	presignContentType = "X-Exius-Content-Type"
+	presignSignature   = "X-Exius-Signature"
+)
+
+var presignSecret []byte
+
+// SetPresignSecret sets the secret presigned URLs are signed with. Without one
+// a random secret is made up, so URLs stop working when the server restarts.
+func SetPresignSecret(secret string) error {
+	if secret != "" {
+		presignSecret = []byte(secret)
+		return nil
+	}
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+	presignSecret = b
+	return nil
+}
+
+// presigned is what a verified presigned URL allows.
+type presigned struct {
+	keyID       string
+	maxSize     int64
+	contentType string
+}
+
+func presignFields(method string) (field string, ok bool) {
+	switch method {
+	case http.MethodGet:
+		return "Get", true
+	case http.MethodPut:
+		return "Put", true
+	}
+	return "", false
+}
+
+// presignMAC signs everything a presigned URL grants, so none of it can be
+// changed without invalidating the signature.
+func presignMAC(method string, filePath string, p presigned, expires int64) string {
+	mac := hmac.New(sha256.New, presignSecret)
+	mac.Write([]byte(strings.Join([]string{
+		method,
+		filePath,
+		p.keyID,
+		strconv.FormatInt(expires, 10),
+		strconv.FormatInt(p.maxSize, 10),
+		p.contentType,
+	}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func isPresigned(r *http.Request) bool {
+	return r.URL.Query().Has(presignSignature)
+}
+
+// verifyPresigned checks the signature and expiry of a presigned request
+// without touching the key store, then strips the signing parameters from the
+// URL. The request is still charged to the issuing key when it is reserved,
+// so the key's own limits, expiry and deletion apply to it as well.
+func verifyPresigned(field string, r *http.Request) (p presigned, err error) {
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get(presignExpires), 10, 64)
+	if err != nil {
+		return p, errors.New("invalid presigned expiry")
+	}
+	if time.Now().UnixMilli() > expires {
+		return p, errors.New("presigned url expired")
+	}
+	p.keyID = query.Get(presignCredential)
+	p.contentType = query.Get(presignContentType)
+	if query.Has(presignMaxSize) {
+		p.maxSize, err = strconv.ParseInt(query.Get(presignMaxSize), 10, 64)
+		if err != nil {
+			return p, errors.New("invalid presigned max size")
+		}
+	}
+	expected := presignMAC(r.Method, r.URL.Path, p, expires)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(presignSignature))) {
+		return p, errors.New("invalid presigned signature")
+	}
+	if signedField, _ := presignFields(r.Method); signedField != field {
+		return p, errors.New("method cannot be presigned")
+	}
+	for _, param := range []string{presignCredential, presignExpires, presignMaxSize, presignContentType, presignSignature} {
+		query.Del(param)
+	}
+	r.URL.RawQuery = query.Encode()
+	return p, nil
+}
+
+// restrict narrows an endpoint to what a presigned URL allows.
+func (p presigned) restrict(endpoint *database.Endpoint) error {
+	if p.maxSize > 0 && p.maxSize < endpoint.MaxPutSize {
+		endpoint.MaxPutSize = p.maxSize
+	}
+	if p.contentType != "" {
+		// the key may have been narrowed since the url was signed
+		if !filetype.Within([]string{p.contentType}, endpoint.PutTypes) {
+			return errors.New("presigned content type no longer allowed")
+		}
+		endpoint.PutTypes = []string{p.contentType}
+	}
+	return nil
+}
+
+// keyDeadline returns when a key expires in unix milliseconds, counting from
+// now for keys whose expiry has not started yet, or 0 if it never expires.
+func keyDeadline(keySet database.KeySet) int64 {
+	if keySet.InitiateExpire == "Never" {
+		return 0
+	}
+	if keySet.ExpireStarted {
+		return addMillis(keySet.ExpireStartTime, keySet.ExpireDelta)
+	}
+	return addMillis(time.Now().UnixMilli(), keySet.ExpireDelta)
+}
+
+// addMillis adds delta milliseconds to the unix millisecond time at, stopping
+// at math.MaxInt64 rather than overflowing, since keys that practically never
+// expire are given huge deltas.
+func addMillis(at int64, delta int64) int64 {
+	if delta > math.MaxInt64-at {
+		return math.MaxInt64
+	}
+	return at + delta
+}
+
+// checkPresign makes sure a presign request stays within the issuing key and
+// returns the signed path.
+func checkPresign(keySet database.KeySet, request PresignJson) (string, error) {
+	field, ok := presignFields(request.Method)
+	if !ok {
+		return "", errors.New("method must be GET or PUT")
+	}
+	cleanPath, err := cleanRelative(request.Path)
+	if err != nil {
+		return "", err
+	}
+	segments := strings.Split(cleanPath, "/")
+	if len(segments) < 2 || strings.HasSuffix(cleanPath, "/") {
+		return "", errors.New("path must name a file under an endpoint")
+	}
+	endpoint, ok := toClientKey(keySet).Endpoints[segments[0]]
+	if !ok {
+		return "", errors.New("endpoint not in key")
+	}
+	if (field == "Get" && !endpoint.Get) || (field == "Put" && !endpoint.Put) {
+		return "", fmt.Errorf("key has no %s access to endpoint", request.Method)
+	}
+	if request.ExpiresIn == 0 || request.ExpiresIn > uint64(maxPresignLifetime.Milliseconds()) {
+		return "", fmt.Errorf("ExpiresIn must be between 1 and %d", maxPresignLifetime.Milliseconds())
+	}
+	if deadline := keyDeadline(keySet); deadline != 0 && time.Now().UnixMilli()+int64(request.ExpiresIn) > deadline {
+		return "", errors.New("url would outlive key")
+	}
+	if field != "Put" && (request.MaxSize != 0 || request.ContentType != "") {
+		return "", errors.New("MaxSize and ContentType only apply to PUT")
+	}
+	if request.MaxSize < 0 || request.MaxSize > endpoint.MaxPutSize {
+		return "", errors.New("MaxSize exceeds endpoint maxPutSize")
+	}
+	if request.ContentType != "" {
+		err = filetype.Valid([]string{request.ContentType})
+		if err != nil {
+			return "", err
+		}
+		if !filetype.Within([]string{request.ContentType}, endpoint.PutTypes) {
+			return "", errors.New("content type not in endpoint put types")
+		}
+	}
+	return "/files/" + cleanPath, nil
+}
+
+// PresignHandle issues a URL that performs one GET or PUT of one file with the
+// permissions of the requesting key, without the key itself.
+func PresignHandle(db database.KeyStore, w http.ResponseWriter, r *http.Request) (err error) {
+	keySet, err := requireKey(w, r)
+	if err != nil {
+		return err
+	}
+	var request PresignJson
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&request)
+	if err != nil {
+		http.Error(w, fmt.Sprint("Invalid json body: ", err), http.StatusBadRequest)
+		return errors.New("invalid presign json")
+	}
+	request.Method = strings.ToUpper(request.Method)
+	filePath, err := checkPresign(keySet, request)
+	if err != nil {
+		http.Error(w, fmt.Sprint("Invalid json body: ", err), http.StatusBadRequest)
+		return fmt.Errorf("invalid presign parameters: %w", err)
+	}
+	auditPath(r, strings.Split(filePath, "/")[2], filePath)
+	p := presigned{keyID: keySet.KeyID, maxSize: request.MaxSize, contentType: request.ContentType}
+	expires := time.Now().UnixMilli() + int64(request.ExpiresIn)
+	query := url.Values{}
+	query.Set(presignCredential, p.keyID)
+	query.Set(presignExpires, strconv.FormatInt(expires, 10))
+	if p.maxSize > 0 {
+		query.Set(presignMaxSize, strconv.FormatInt(p.maxSize, 10))
+	}
+	if p.contentType != "" {
+		query.Set(presignContentType, p.contentType)
+	}
+	query.Set(presignSignature, presignMAC(request.Method, filePath, p, expires))
+	signedURL := url.URL{Path: filePath, RawQuery: query.Encode()}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(PresignedURL{URL: signedURL.String(), Method: request.Method, Expires: expires})
+	return nil
+}
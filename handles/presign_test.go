@@ -0,0 +1,48 @@
+package handles
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/lanelewis/rclone-proxy/database"
+)
+
+func TestKeyDeadlineDoesNotOverflow(t *testing.T) {
+	now := time.Now().UnixMilli()
+	for _, tt := range []struct {
+		name   string
+		keySet database.KeySet
+		want   int64
+	}{
+		{"never", database.KeySet{InitiateExpire: "Never", ExpireDelta: math.MaxInt64}, 0},
+		{"started", database.KeySet{ExpireStarted: true, ExpireStartTime: now, ExpireDelta: 1000}, now + 1000},
+		{"started, huge delta", database.KeySet{ExpireStarted: true, ExpireStartTime: now, ExpireDelta: math.MaxInt64}, math.MaxInt64},
+		{"not started, huge delta", database.KeySet{InitiateExpire: "Put", ExpireDelta: math.MaxInt64 - 1}, math.MaxInt64},
+	} {
+		if got := keyDeadline(tt.keySet); got != tt.want {
+			t.Errorf("%s: keyDeadline = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPresignBoundsExpiresIn(t *testing.T) {
+	keySet := database.KeySet{
+		InitiateExpire: "Never",
+		Endpoints: map[string]database.Endpoint{
+			"root": {Path: "/base", PutTypes: []string{"any"}, Get: true},
+		},
+	}
+	// would wrap to a small duration if multiplied into a time.Duration
+	wraps := uint64(math.MaxUint64/uint64(time.Millisecond)) + 1
+	for _, expiresIn := range []uint64{0, uint64(maxPresignLifetime.Milliseconds()) + 1, wraps, math.MaxUint64} {
+		_, err := checkPresign(keySet, PresignJson{Method: "GET", Path: "root/a.txt", ExpiresIn: expiresIn})
+		if err == nil {
+			t.Errorf("ExpiresIn %d accepted", expiresIn)
+		}
+	}
+	_, err := checkPresign(keySet, PresignJson{Method: "GET", Path: "root/a.txt", ExpiresIn: 60000})
+	if err != nil {
+		t.Errorf("ExpiresIn 60000 refused: %v", err)
+	}
+}
@@ -0,0 +1,288 @@
+package handles
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const davNamespace = "DAV:"
+
+// hiddenProps are the DAV: properties removed from PROPFIND responses. Quotas
+// describe the whole backend rather than the endpoint, and lock discovery
+// shows other clients' lock owners and tokens. Properties outside the DAV:
+// namespace are removed too, since backends use them for their own metadata.
+var hiddenProps = map[string]bool{
+	"quota-available-bytes": true,
+	"quota-used-bytes":      true,
+	"lockdiscovery":         true,
+}
+
+// checkDepth rejects PROPFIND requests of infinite depth, which would list
+// the whole tree below an endpoint in one response. A missing Depth header
+// means infinity.
+func checkDepth(w http.ResponseWriter, r *http.Request) error {
+	depth := r.Header.Get("Depth")
+	if depth == "0" || depth == "1" {
+		return nil
+	}
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusForbidden)
+	io.WriteString(w, xml.Header+`<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`)
+	return errors.New("propfind depth must be 0 or 1")
+}
+
+// propfindProxyResp rewrites the multistatus body of a PROPFIND response as it
+// streams through, so the client only sees paths under its endpoint.
+func propfindProxyResp(endpoint string, root string) func(res *http.Response) error {
+	return func(res *http.Response) error {
+		if res.StatusCode != http.StatusMultiStatus {
+			return nil
+		}
+		body := res.Body
+		reader, writer := io.Pipe()
+		go func() {
+			defer body.Close()
+			rewriter := &multistatusRewriter{
+				dec:      xml.NewDecoder(body),
+				out:      writer,
+				endpoint: endpoint,
+				root:     strings.TrimSuffix(strings.Trim(root, `"`), "/"),
+			}
+			err := rewriter.rewrite()
+			if err != nil {
+				requestLogger(res.Request).Error("failed to rewrite propfind response", "err", err)
+			}
+			writer.CloseWithError(err)
+		}()
+		res.Body = reader
+		res.ContentLength = -1
+		res.Header.Del("Content-Length")
+		return nil
+	}
+}
+
+// multistatusRewriter copies a multistatus document token by token, keeping
+// the backend's namespace prefixes. Each DAV:response is held back until it
+// ends, and dropped if any of its hrefs is outside the endpoint.
+type multistatusRewriter struct {
+	dec      *xml.Decoder
+	out      io.Writer
+	endpoint string
+	root     string
+
+	// namespaces holds the prefix bindings in scope, innermost last
+	namespaces []map[string]string
+	// response buffers the DAV:response being read, if any
+	response *bytes.Buffer
+	inScope  bool
+	// skip counts the open elements of a hidden property being dropped
+	skip int
+	// href collects the text of the DAV:href being read, if any
+	href   *strings.Builder
+	parent []xml.Name
+	// started is set once the DAV:multistatus element has been read
+	started bool
+}
+
+var errNotMultistatus = errors.New("backend answered with something other than a multistatus document")
+
+func (m *multistatusRewriter) resolve(name xml.Name) string {
+	for i := len(m.namespaces) - 1; i >= 0; i-- {
+		if uri, ok := m.namespaces[i][name.Space]; ok {
+			return uri
+		}
+	}
+	return ""
+}
+
+func (m *multistatusRewriter) pushNamespaces(start xml.StartElement) {
+	bindings := map[string]string{}
+	for _, attr := range start.Attr {
+		if attr.Name.Space == "xmlns" {
+			bindings[attr.Name.Local] = attr.Value
+		} else if attr.Name.Space == "" && attr.Name.Local == "xmlns" {
+			bindings[""] = attr.Value
+		}
+	}
+	m.namespaces = append(m.namespaces, bindings)
+}
+
+func (m *multistatusRewriter) writer() io.Writer {
+	if m.response != nil {
+		return m.response
+	}
+	return m.out
+}
+
+func (m *multistatusRewriter) isDAV(name xml.Name, local string) bool {
+	return name.Local == local && m.resolve(name) == davNamespace
+}
+
+func (m *multistatusRewriter) rewrite() error {
+	for {
+		token, err := m.dec.RawToken()
+		if err == io.EOF {
+			if len(m.parent) > 0 || !m.started {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			err = m.start(t)
+		case xml.EndElement:
+			err = m.end(t)
+		case xml.CharData:
+			if len(m.parent) == 0 {
+				// only whitespace may surround the document element
+				if len(bytes.TrimSpace(t)) > 0 {
+					return errNotMultistatus
+				}
+				continue
+			}
+			if m.skip > 0 {
+				continue
+			}
+			if m.href != nil {
+				m.href.Write(t)
+				continue
+			}
+			err = xml.EscapeText(m.writer(), t)
+		case xml.Comment, xml.Directive:
+			// neither carries anything the client needs
+		case xml.ProcInst:
+			if m.skip == 0 {
+				_, err = io.WriteString(m.writer(), "<?"+t.Target+" "+string(t.Inst)+"?>")
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (m *multistatusRewriter) start(t xml.StartElement) error {
+	m.pushNamespaces(t)
+	if len(m.parent) == 0 {
+		if m.started || !m.isDAV(t.Name, "multistatus") {
+			return errNotMultistatus
+		}
+		m.started = true
+	}
+	inProp := len(m.parent) > 0 && m.isDAV(m.parent[len(m.parent)-1], "prop")
+	m.parent = append(m.parent, t.Name)
+	if m.skip > 0 {
+		m.skip++
+		return nil
+	}
+	if inProp && (m.resolve(t.Name) != davNamespace || hiddenProps[t.Name.Local]) {
+		m.skip = 1
+		return nil
+	}
+	if m.isDAV(t.Name, "response") {
+		m.response = &bytes.Buffer{}
+		m.inScope = true
+	}
+	if m.isDAV(t.Name, "href") {
+		m.href = &strings.Builder{}
+	}
+	return writeStart(m.writer(), t)
+}
+
+func (m *multistatusRewriter) end(t xml.EndElement) error {
+	if len(m.parent) == 0 {
+		return errors.New("unbalanced multistatus document")
+	}
+	name := m.parent[len(m.parent)-1]
+	defer func() {
+		m.parent = m.parent[:len(m.parent)-1]
+		m.namespaces = m.namespaces[:len(m.namespaces)-1]
+	}()
+	if m.skip > 0 {
+		m.skip--
+		return nil
+	}
+	if m.href != nil && m.isDAV(name, "href") {
+		mapped, ok := m.mapHref(m.href.String())
+		m.href = nil
+		if !ok {
+			m.inScope = false
+		}
+		err := xml.EscapeText(m.writer(), []byte(mapped))
+		if err != nil {
+			return err
+		}
+	}
+	err := writeEnd(m.writer(), t)
+	if err != nil {
+		return err
+	}
+	if m.response != nil && m.isDAV(name, "response") {
+		response := m.response
+		m.response = nil
+		if m.inScope {
+			_, err = m.out.Write(response.Bytes())
+		}
+	}
+	return err
+}
+
+// mapHref turns a backend href into the /files/{endpoint}/ path it is served
+// under, failing for hrefs outside the endpoint's root.
+func (m *multistatusRewriter) mapHref(href string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return "", false
+	}
+	p := "/" + strings.TrimPrefix(u.Path, "/")
+	var rel string
+	switch {
+	case m.root == "":
+		rel = p
+	case p == m.root:
+		rel = "/"
+	case strings.HasPrefix(p, m.root+"/"):
+		rel = strings.TrimPrefix(p, m.root)
+	default:
+		return "", false
+	}
+	cleaned, err := cleanRelative(rel)
+	if err != nil {
+		return "", false
+	}
+	mapped := url.URL{Path: "/files/" + m.endpoint + "/" + cleaned}
+	return mapped.EscapedPath(), true
+}
+
+func rawName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+func writeStart(w io.Writer, t xml.StartElement) error {
+	var b strings.Builder
+	b.WriteString("<" + rawName(t.Name))
+	for _, attr := range t.Attr {
+		b.WriteString(" " + rawName(attr.Name) + `="`)
+		xml.EscapeText(&b, []byte(attr.Value))
+		b.WriteString(`"`)
+	}
+	b.WriteString(">")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeEnd(w io.Writer, t xml.EndElement) error {
+	_, err := io.WriteString(w, "</"+rawName(t.Name)+">")
+	return err
+}
@@ -0,0 +1,145 @@
+package handles
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// propfindRoot is the backend root of the endpoint in these tests. It must
+// never reach the client.
+const propfindRoot = "/srv/secret-root"
+
+// rewritePropfind passes a backend multistatus body through
+// propfindProxyResp for endpoint "ep" and returns what the client would read.
+func rewritePropfind(t *testing.T, body string) (string, error) {
+	t.Helper()
+	res := &http.Response{
+		StatusCode: http.StatusMultiStatus,
+		Header:     http.Header{"Content-Length": {"1"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    httptest.NewRequest("PROPFIND", "/files/ep/", nil),
+	}
+	err := propfindProxyResp("ep", `"`+propfindRoot+`"`)(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Header.Get("Content-Length") != "" || res.ContentLength != -1 {
+		t.Error("Content-Length of the backend body kept")
+	}
+	out, err := io.ReadAll(res.Body)
+	if strings.Contains(string(out), propfindRoot) {
+		t.Errorf("backend root in the rewritten body: %s", out)
+	}
+	return string(out), err
+}
+
+func davResponse(prefix string, href string, props string) string {
+	return `<` + prefix + `response><` + prefix + `href>` + href + `</` + prefix + `href><` + prefix + `propstat><` + prefix + `prop>` +
+		props + `</` + prefix + `prop><` + prefix + `status>HTTP/1.1 200 OK</` + prefix + `status></` + prefix + `propstat></` + prefix + `response>`
+}
+
+func TestPropfindRewritesHrefs(t *testing.T) {
+	for _, prefix := range []string{"D", "lp1", ""} {
+		open, p := `<?xml version="1.0" encoding="UTF-8"?><multistatus xmlns="DAV:" xmlns:oc="http://owncloud.org/ns">`, ""
+		if prefix != "" {
+			open = `<?xml version="1.0" encoding="UTF-8"?><` + prefix + `:multistatus xmlns:` + prefix + `="DAV:" xmlns:oc="http://owncloud.org/ns">`
+			p = prefix + ":"
+		}
+		body := open +
+			davResponse(p, propfindRoot+"/", `<`+p+`resourcetype><`+p+`collection/></`+p+`resourcetype>`) +
+			davResponse(p, "http://localhost:8081"+propfindRoot+"/a%20b.txt",
+				`<`+p+`getcontentlength>5</`+p+`getcontentlength>`+
+					`<`+p+`quota-used-bytes>99</`+p+`quota-used-bytes>`+
+					`<`+p+`lockdiscovery><`+p+`activelock><`+p+`href>/srv/other</`+p+`href></`+p+`activelock></`+p+`lockdiscovery>`+
+					`<oc:id>backend-id</oc:id>`) +
+			`</` + p + `multistatus>`
+		out, err := rewritePropfind(t, body)
+		if err != nil {
+			t.Fatalf("prefix %q: %v", prefix, err)
+		}
+		for _, want := range []string{
+			"<" + p + "href>/files/ep/</" + p + "href>",
+			"<" + p + "href>/files/ep/a%20b.txt</" + p + "href>",
+			"<" + p + "getcontentlength>5</" + p + "getcontentlength>",
+			"<" + p + "collection>",
+		} {
+			if !strings.Contains(out, want) {
+				t.Errorf("prefix %q: %s missing from %s", prefix, want, out)
+			}
+		}
+		for _, hidden := range []string{"quota-used-bytes", "lockdiscovery", "/srv/other", "backend-id"} {
+			if strings.Contains(out, hidden) {
+				t.Errorf("prefix %q: %s left in %s", prefix, hidden, out)
+			}
+		}
+	}
+}
+
+func TestPropfindDropsResponsesOutsideRoot(t *testing.T) {
+	for _, href := range []string{
+		"/srv/other/secret.txt",
+		"http://localhost:8081/srv/other/secret.txt",
+		"/srv/secret-rootfoo/secret.txt",
+		propfindRoot + "/../other/secret.txt",
+		propfindRoot + "/%2e%2e/other/secret.txt",
+		propfindRoot + "/a%2f..%2f..%2fsecret.txt",
+		propfindRoot + "/a%5c..%5csecret.txt",
+		"%zz",
+	} {
+		body := `<D:multistatus xmlns:D="DAV:">` +
+			davResponse("D:", propfindRoot+"/kept.txt", "<D:getcontentlength>1</D:getcontentlength>") +
+			davResponse("D:", href, "<D:getcontentlength>2</D:getcontentlength>") +
+			`</D:multistatus>`
+		out, err := rewritePropfind(t, body)
+		if err != nil {
+			t.Errorf("%s: %v", href, err)
+			continue
+		}
+		if !strings.Contains(out, "/files/ep/kept.txt") || strings.Count(out, "<D:response>") != 1 || strings.Contains(out, "secret") {
+			t.Errorf("%s: rewritten to %s", href, out)
+		}
+	}
+}
+
+func TestPropfindRefusesBrokenBodies(t *testing.T) {
+	whole := `<D:multistatus xmlns:D="DAV:">` +
+		davResponse("D:", propfindRoot+"/a.txt", "<D:getcontentlength>1</D:getcontentlength>") +
+		`</D:multistatus>`
+	for _, body := range []string{
+		whole[:len(whole)-len("</D:multistatus>")],
+		whole[:strings.Index(whole, "</D:href>")],
+		whole[:strings.Index(whole, "a.txt")],
+		`</D:multistatus>`,
+		`<D:multistatus xmlns:D="DAV:"><D:response><D:href>` + propfindRoot + `/a.txt</D:href>`,
+		`<D:multistatus xmlns:D="DAV:"><D:response <<>`,
+		`not xml at all ` + propfindRoot,
+		``,
+		`<D:error xmlns:D="DAV:">` + propfindRoot + `</D:error>`,
+		`<D:multistatus xmlns:D="DAV:"></D:multistatus><D:multistatus xmlns:D="DAV:">` + propfindRoot + `</D:multistatus>`,
+	} {
+		out, err := rewritePropfind(t, body)
+		if err == nil {
+			t.Errorf("%q rewritten without an error to %q", body, out)
+		}
+	}
+}
+
+func TestCheckDepth(t *testing.T) {
+	for depth, ok := range map[string]bool{"0": true, "1": true, "infinity": false, "": false, "2": false} {
+		req := httptest.NewRequest("PROPFIND", "/files/ep/", nil)
+		if depth != "" {
+			req.Header.Set("Depth", depth)
+		}
+		res := httptest.NewRecorder()
+		err := checkDepth(res, req)
+		if (err == nil) != ok {
+			t.Errorf("Depth %q: %v", depth, err)
+		}
+		if !ok && (res.Code != http.StatusForbidden || !strings.Contains(res.Body.String(), "propfind-finite-depth")) {
+			t.Errorf("Depth %q answered %d %s", depth, res.Code, res.Body)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package handles
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+
+	"github.com/lanelewis/rclone-proxy/logging"
+)
+
+// maxRequestID bounds the length of request IDs taken from clients.
+const maxRequestID = 128
+
+// validRequestID reports whether a client's request ID is short and plain
+// enough to log and forward as is.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// RequestID gives every request an ID, the client's X-Request-ID if it sent a
+// usable one. The ID is echoed in the response, passed on to the backend and
+// attached to everything logged about the request.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(logging.RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		// proxied requests keep the client's headers, so the backend sees it too
+		r.Header.Set(logging.RequestIDHeader, id)
+		w.Header().Set(logging.RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// requestLogger returns the logger for r, tagged with its request ID.
+func requestLogger(r *http.Request) *slog.Logger {
+	return logging.FromContext(r.Context())
+}
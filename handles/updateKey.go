@@ -0,0 +1,266 @@
+package handles
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/lanelewis/rclone-proxy/database"
+	"github.com/lanelewis/rclone-proxy/filetype"
+)
+
+// UpdateJson is the body of /updateKey. Fields left out keep their current
+// value. An endpoint given as null is removed, and other endpoints are merged
+// over the key's current endpoint of that name.
+type UpdateJson struct {
+	CanCreateChild *bool
+	ExpireDelta    *uint64
+	MaxTotalBytes  *int64
+	Endpoints      map[string]json.RawMessage
+	// ResetCounts zeroes the named counters (Put, Get, Mkcol) of every
+	// endpoint of the key. Bytes zeroes TotalBytes of the key and its
+	// endpoints.
+	ResetCounts []string
+}
+
+var errChildExceedsKey = errors.New("a child key would exceed the updated key, update or delete it first")
+var errInvalidUpdate = errors.New("Invalid json body")
+
+func parseUpdateJson(r *http.Request) (update UpdateJson, err error) {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&update)
+	if err != nil {
+		return update, err
+	}
+	if update.MaxTotalBytes != nil && *update.MaxTotalBytes < 0 {
+		return update, errors.New("maxTotalBytes must not be negative")
+	}
+	for _, field := range update.ResetCounts {
+		_, valid := contains([]string{"Put", "Get", "Mkcol", "Bytes"}, field)
+		if !valid {
+			return update, fmt.Errorf("no counter for %s", field)
+		}
+	}
+	return update, nil
+}
+
+// relativeClientKey converts a stored key to its client form with its endpoint
+// paths relative to parentKey's endpoint names, as ValidateChildKey expects of
+// a child.
+func relativeClientKey(parentKey database.KeySet, childKey database.KeySet) (ClientKeySet, error) {
+	clientKey := toClientKey(childKey)
+	for k, endpoint := range clientKey.Endpoints {
+		path, ok := relativePath(parentKey, endpoint.Path)
+		if !ok {
+			return clientKey, errors.New("child key endpoint not in parent")
+		}
+		endpoint.Path = path
+		clientKey.Endpoints[k] = endpoint
+	}
+	return clientKey, nil
+}
+
+// validateChild applies the waterfall checks of ValidateChildKey to a key that
+// already exists.
+func validateChild(childKey ClientKeySet, parentKey ClientKeySet) (map[string]database.Endpoint, error) {
+	// keys that never expire were only bounded by their requested delta
+	if childKey.InitiateExpire != "Never" && childKey.ExpireDelta > parentKey.ExpireDelta {
+		return nil, errors.New("timeDelta of child exceeds parent")
+	}
+	if !validChildFieldPermission(parentKey.CanCreateChild, childKey.CanCreateChild) {
+		return nil, errors.New("child key can create children but parent cannot")
+	}
+	if childKey.MaxTotalBytes > parentKey.MaxTotalBytes {
+		return nil, errors.New("child key maxTotalBytes exceeds parent maxTotalBytes")
+	}
+	return validateChildEndpoints(childKey, parentKey)
+}
+
+// applyUpdate changes keySet as asked by update, checked against its direct
+// parent. Counters carry over unless reset.
+func applyUpdate(keySet *database.KeySet, parentKey database.KeySet, update UpdateJson) error {
+	clientKey, err := relativeClientKey(parentKey, *keySet)
+	if err != nil {
+		return err
+	}
+	if update.CanCreateChild != nil {
+		clientKey.CanCreateChild = *update.CanCreateChild
+	}
+	if update.ExpireDelta != nil {
+		clientKey.ExpireDelta = *update.ExpireDelta
+	}
+	if update.MaxTotalBytes != nil {
+		clientKey.MaxTotalBytes = *update.MaxTotalBytes
+	}
+	for k, raw := range update.Endpoints {
+		if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			delete(clientKey.Endpoints, k)
+			continue
+		}
+		endpoint, ok := clientKey.Endpoints[k]
+		if !ok {
+			endpoint = defaultClientEndpoint()
+		}
+		var replaced struct{ Schema json.RawMessage }
+		err = json.Unmarshal(raw, &replaced)
+		if err != nil {
+			// raw is valid json, so only a value other than an object fails
+			return fmt.Errorf("endpoint %s must be an object or null", k)
+		}
+		if replaced.Schema != nil {
+			// a schema is replaced as a whole rather than merged
+			endpoint.Schema = nil
+		}
+		err = json.Unmarshal(raw, &endpoint)
+		if err != nil {
+			return err
+		}
+		err = filetype.Valid(endpoint.PutTypes)
+		if err != nil {
+			return err
+		}
+		err = endpoint.Schema.Check()
+		if err != nil {
+			return err
+		}
+		err = checkNaming(endpoint)
+		if err != nil {
+			return err
+		}
+		err = checkOverwrite(endpoint)
+		if err != nil {
+			return err
+		}
+		err = checkWebhookURL(endpoint.WebhookURL)
+		if err != nil {
+			return err
+		}
+		clientKey.Endpoints[k] = endpoint
+	}
+	endpoints, err := validateChild(clientKey, toClientKey(parentKey))
+	if err != nil {
+		return err
+	}
+	for k, endpoint := range endpoints {
+		previous := keySet.Endpoints[k]
+		endpoint.PutCount = previous.PutCount
+		endpoint.GetCount = previous.GetCount
+		endpoint.MkcolCount = previous.MkcolCount
+		endpoint.TotalBytes = previous.TotalBytes
+		for _, field := range update.ResetCounts {
+			switch field {
+			case "Put":
+				endpoint.PutCount = 0
+			case "Get":
+				endpoint.GetCount = 0
+			case "Mkcol":
+				endpoint.MkcolCount = 0
+			case "Bytes":
+				endpoint.TotalBytes = 0
+			}
+		}
+		endpoints[k] = endpoint
+	}
+	keySet.CanCreateChild = clientKey.CanCreateChild
+	keySet.Endpoints = endpoints
+	keySet.MaxTotalBytes = clientKey.MaxTotalBytes
+	if _, reset := contains(update.ResetCounts, "Bytes"); reset {
+		keySet.TotalBytes = 0
+	}
+	if keySet.InitiateExpire != "Never" {
+		keySet.ExpireDelta = int64(clientKey.ExpireDelta)
+	}
+	return nil
+}
+
+// checkChildren makes sure the direct children of an updated key still fit
+// within it. Their own children are already bounded by them.
+func checkChildren(keySet database.KeySet, children []database.KeySet) error {
+	for _, child := range children {
+		clientChild, err := relativeClientKey(keySet, child)
+		if err != nil {
+			return errChildExceedsKey
+		}
+		_, err = validateChild(clientChild, toClientKey(keySet))
+		if err != nil {
+			return errChildExceedsKey
+		}
+	}
+	return nil
+}
+
+// UpdateKeyHandle changes the permissions, counters or expiry of the
+// descendant key given by ?id=. The result must stay within the descendant's
+// direct parent, and so within the access key, and must still contain the
+// descendant's own children.
+func UpdateKeyHandle(db database.KeyStore, w http.ResponseWriter, r *http.Request) (err error) {
+	updaterKey, err := requireKey(w, r)
+	if err != nil {
+		return err
+	}
+	keyID := r.URL.Query().Get("id")
+	descendants, err := db.GetChildren(r.Context(), updaterKey.KeyID, true)
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return errors.New("unable to list child keys")
+	}
+	isDescendant := false
+	for _, keySet := range descendants {
+		if keySet.KeyID == keyID {
+			isDescendant = true
+		}
+	}
+	if !isDescendant {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return errors.New("key is not a descendant")
+	}
+	auditTarget(r, keyID)
+	update, err := parseUpdateJson(r)
+	if err != nil {
+		http.Error(w, fmt.Sprint("Invalid json body: ", err), http.StatusBadRequest)
+		return errors.New("invalid update json")
+	}
+	var updated database.KeySet
+	// the parent and children are those of the transaction, not the ones
+	// listed above, which an update of theirs may have changed since
+	err = db.UpdateKey(r.Context(), keyID, func(keySet *database.KeySet, parentKey database.KeySet, children []database.KeySet) error {
+		err := applyUpdate(keySet, parentKey, update)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidUpdate, err)
+		}
+		err = checkChildren(*keySet, children)
+		if err != nil {
+			return err
+		}
+		updated = *keySet
+		return nil
+	})
+	if errors.Is(err, errChildExceedsKey) {
+		http.Error(w, fmt.Sprint(err), http.StatusConflict)
+		return errors.New("update would orphan child permissions")
+	}
+	if errors.Is(err, database.ErrKeyNotFound) || errors.Is(err, database.ErrKeyExpired) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return errors.New("key not found")
+	}
+	if errors.Is(err, errInvalidUpdate) {
+		http.Error(w, fmt.Sprint(err), http.StatusBadRequest)
+		return errors.New("invalid update parameters")
+	}
+	if err != nil {
+		http.Error(w, "", http.StatusInternalServerError)
+		return errors.New("unable to update key in database")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	// obscure absolute path field for user
+	for k, endpoint := range updated.Endpoints {
+		endpoint.Path = k
+		updated.Endpoints[k] = endpoint
+	}
+	json.NewEncoder(w).Encode(updated)
+	return nil
+}
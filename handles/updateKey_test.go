@@ -0,0 +1,106 @@
+package handles
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lanelewis/rclone-proxy/database"
+)
+
+// updateKeyTree stores a parent key, a child made by it and a grandchild made
+// by the child, and returns the handler of /updateKey behind Authenticate.
+func updateKeyTree(t *testing.T, db database.KeyStore) http.Handler {
+	ctx := context.Background()
+	endpoint := func(path string, maxPut int) database.Endpoint {
+		return database.Endpoint{Path: path, PutTypes: []string{"any"}, MaxPut: maxPut, MaxGet: maxPut, MaxPutSize: 1 << 20, MaxTotalBytes: 1 << 30, Put: true, Get: true}
+	}
+	for _, keySet := range []database.KeySet{
+		{KeyValue: "update-parent", CanCreateChild: true, ExpireDelta: 1 << 40, MaxTotalBytes: 1 << 30,
+			Endpoints: map[string]database.Endpoint{"root": endpoint("/base", 10)}},
+		{KeyValue: "update-child", ParentID: database.KeyID("update-parent"), CanCreateChild: true, ExpireDelta: 1 << 40, MaxTotalBytes: 1 << 30, TotalBytes: 7,
+			Endpoints: map[string]database.Endpoint{"c": endpoint("/base/sub", 8), "x": endpoint("/base/x", 1)}},
+		{KeyValue: "update-grandchild", ParentID: database.KeyID("update-child"), ExpireDelta: 1 << 40, MaxTotalBytes: 1 << 30,
+			Endpoints: map[string]database.Endpoint{"g": endpoint("/base/sub/g", 5)}},
+	} {
+		err := db.AddKey(ctx, keySet)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := db.Reserve(ctx, database.KeyID("update-child"), "c", "Put")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Authenticate(db)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		UpdateKeyHandle(db, w, r)
+	}))
+}
+
+func TestUpdateKey(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		updater string
+		target  string
+		body    string
+		status  int
+		check   func(child database.Endpoint, key database.KeySet) bool
+	}{
+		{"narrowing", "update-parent", "update-child", `{"Endpoints": {"c": {"MaxPut": 6}}}`, http.StatusOK,
+			func(c database.Endpoint, key database.KeySet) bool {
+				return c.MaxPut == 6 && c.PutCount == 1 && c.Path == "/base/sub" && key.TotalBytes == 7
+			}},
+		{"widening beyond the parent", "update-parent", "update-child", `{"Endpoints": {"c": {"MaxPut": 11}}}`, http.StatusBadRequest,
+			func(c database.Endpoint, key database.KeySet) bool { return c.MaxPut == 8 }},
+		{"moving outside the parent", "update-parent", "update-child", `{"Endpoints": {"c": {"Path": "root/../etc"}}}`, http.StatusBadRequest,
+			func(c database.Endpoint, key database.KeySet) bool { return c.Path == "/base/sub" }},
+		{"reset counts", "update-parent", "update-child", `{"ResetCounts": ["Put", "Bytes"]}`, http.StatusOK,
+			func(c database.Endpoint, key database.KeySet) bool { return c.PutCount == 0 && key.TotalBytes == 0 }},
+		{"orphaning a grandchild", "update-parent", "update-child", `{"Endpoints": {"c": {"MaxPut": 4}}}`, http.StatusConflict,
+			func(c database.Endpoint, key database.KeySet) bool { return c.MaxPut == 8 }},
+		{"removing an endpoint", "update-parent", "update-child", `{"Endpoints": {"x": null}}`, http.StatusOK,
+			func(c database.Endpoint, key database.KeySet) bool {
+				_, ok := key.Endpoints["x"]
+				return !ok && c.MaxPut == 8
+			}},
+		{"removing the grandchild's endpoint", "update-parent", "update-child", `{"Endpoints": {"c": null}}`, http.StatusConflict,
+			func(c database.Endpoint, key database.KeySet) bool { return c.MaxPut == 8 }},
+		{"malformed endpoint", "update-parent", "update-child", `{"Endpoints": {"c": 3}}`, http.StatusBadRequest,
+			func(c database.Endpoint, key database.KeySet) bool { return c.MaxPut == 8 }},
+		{"unknown field", "update-parent", "update-child", `{"MaxPut": 3}`, http.StatusBadRequest,
+			func(c database.Endpoint, key database.KeySet) bool { return c.MaxPut == 8 }},
+		{"updating itself", "update-child", "update-child", `{"Endpoints": {"c": {"MaxPut": 10}}}`, http.StatusUnauthorized,
+			func(c database.Endpoint, key database.KeySet) bool { return c.MaxPut == 8 }},
+		{"updating its parent", "update-grandchild", "update-child", `{"Endpoints": {"c": {"MaxPut": 1}}}`, http.StatusUnauthorized,
+			func(c database.Endpoint, key database.KeySet) bool { return c.MaxPut == 8 }},
+	} {
+		db, err := database.BuildSQLite(filepath.Join(t.TempDir(), "keys.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for store, db := range map[string]database.KeyStore{"memory": database.NewMemoryStore(), "sqlite": db} {
+			handler := updateKeyTree(t, db)
+			req := httptest.NewRequest(http.MethodPost, "/updateKey?id="+database.KeyID(tt.target), strings.NewReader(tt.body))
+			req.SetBasicAuth("", tt.updater)
+			res := httptest.NewRecorder()
+			handler.ServeHTTP(res, req)
+			if res.Code != tt.status {
+				t.Errorf("%s on %s: answered %d %s, want %d", tt.name, store, res.Code, res.Body, tt.status)
+			}
+			if res.Code == http.StatusOK && strings.Contains(res.Body.String(), "/base") {
+				t.Errorf("%s on %s: answer shows backend paths: %s", tt.name, store, res.Body)
+			}
+			key, err := db.GetKey(context.Background(), tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(key.Endpoints["c"], key) {
+				t.Errorf("%s on %s: stored %+v", tt.name, store, key)
+			}
+		}
+		db.Close()
+	}
+}
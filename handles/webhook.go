@@ -0,0 +1,263 @@
+package handles
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lanelewis/rclone-proxy/database"
+)
+
+// Headers sent with every webhook. The signature is the hex HMAC-SHA256 of the
+// timestamp, a ".", and the body, so a receiver can check both came from
+// here and refuse replays of old deliveries.
+const (
+	webhookTimestamp = "X-Exius-Timestamp"
+	webhookSignature = "X-Exius-Signature"
+	webhookDelivery  = "X-Exius-Delivery"
+)
+
+const (
+	webhookPoll       = time.Second
+	webhookBatch      = 20
+	webhookTimeout    = 10 * time.Second
+	webhookFirstRetry = 10 * time.Second
+	webhookMaxRetry   = 6 * time.Hour
+	// webhookAttempts is how many times a webhook is tried before it is
+	// given up on, a couple of days with the backoff above.
+	webhookAttempts = 20
+)
+
+var webhookSecret []byte
+
+// webhookAllowed are the networks webhooks may reach even though they are
+// not public, such as a receiver on the same private network.
+var webhookAllowed []*net.IPNet
+
+// webhookBlocked are the networks, other than those the net.IP methods
+// know, that webhooks may not reach: "this network" and carrier-grade NAT.
+var webhookBlocked = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+}
+
+var errWebhookAddress = errors.New("webhook address is not public")
+
+// SetWebhookSecret turns webhooks on and sets the secret their payloads are
+// signed with. Without one endpoints may not have a webhookURL.
+func SetWebhookSecret(secret string) {
+	webhookSecret = []byte(secret)
+}
+
+// SetWebhookAllowedNetworks lets webhooks reach addresses in networks even if
+// they are loopback, link-local or private, which they otherwise may not.
+func SetWebhookAllowedNetworks(networks []*net.IPNet) {
+	webhookAllowed = networks
+}
+
+// webhookAddressAllowed reports whether a webhook may be sent to ip. Only
+// public addresses may, so a key cannot use webhooks to reach the rclone rc
+// server or anything else on the server's own network.
+func webhookAddressAllowed(ip net.IP) bool {
+	for _, network := range webhookAllowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	for _, network := range webhookBlocked {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// webhookClient sends webhooks. The address of every connection it opens,
+// redirects included, is checked once the host name has been resolved, so a
+// name that resolves to an internal address is caught too.
+func webhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !webhookAddressAllowed(ip) {
+				return fmt.Errorf("%w: %s", errWebhookAddress, host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would make the connection on our behalf, unchecked
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: webhookTimeout, Transport: transport}
+}
+
+// UploadEvent is the payload of the webhook sent when a PUT, COPY or MOVE
+// into an endpoint succeeds, with Event upload, copy or move. Path is the URL
+// the file is served under and Timestamp is in unix milliseconds.
+type UploadEvent struct {
+	Event       string
+	KeyID       string
+	Endpoint    string
+	Path        string
+	Size        int64
+	ContentType string
+	Timestamp   int64
+}
+
+// checkWebhookURL makes sure url is an absolute http or https URL, and not
+// one that plainly names an internal address. Host names are only checked
+// when a webhook is sent, since what they resolve to can change.
+func checkWebhookURL(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	if len(webhookSecret) == 0 {
+		return errors.New("webhooks are not enabled on this server")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("webhookURL must be an http or https URL")
+	}
+	ip := net.ParseIP(u.Hostname())
+	if strings.EqualFold(u.Hostname(), "localhost") {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	if ip != nil && !webhookAddressAllowed(ip) {
+		return errors.New("webhookURL must be a public address")
+	}
+	return nil
+}
+
+// notifications returns the webhook of a request that succeeded having
+// written used bytes, if its endpoint has one.
+func (reserved *reservation) notifications(used int64) []database.Notification {
+	if reserved.webhookURL == "" || len(webhookSecret) == 0 {
+		// a webhookURL set while webhooks were enabled is left unused
+		return nil
+	}
+	event := reserved.event
+	event.Size, event.Timestamp = used, time.Now().UnixMilli()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		reserved.logger.Error("failed to encode webhook", "path", event.Path, "err", err)
+		return nil
+	}
+	return []database.Notification{{URL: reserved.webhookURL, Payload: payload}}
+}
+
+func signWebhook(timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, webhookSecret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func deliverWebhook(ctx context.Context, client *http.Client, webhook database.Webhook) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(webhook.Payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestamp, timestamp)
+	req.Header.Set(webhookDelivery, strconv.FormatInt(webhook.ID, 10))
+	req.Header.Set(webhookSignature, signWebhook(timestamp, webhook.Payload))
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("receiver answered %d", res.StatusCode)
+	}
+	return nil
+}
+
+// webhookBackoff is how long to wait after a webhook has failed attempts
+// times, doubling from webhookFirstRetry up to webhookMaxRetry.
+func webhookBackoff(attempts int) time.Duration {
+	wait := webhookFirstRetry
+	for i := 1; i < attempts && wait < webhookMaxRetry; i++ {
+		wait *= 2
+	}
+	if wait > webhookMaxRetry {
+		wait = webhookMaxRetry
+	}
+	return wait
+}
+
+// RunWebhooks delivers the webhooks in db's outbox until ctx is done. Each
+// one is leased while it is delivered, so several servers can share the
+// outbox, and a webhook whose server died mid-delivery is picked up again
+// once its lease runs out.
+func RunWebhooks(ctx context.Context, db database.KeyStore) {
+	client := webhookClient()
+	ticker := time.NewTicker(webhookPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		deliverDue(ctx, db, client, time.Now())
+	}
+}
+
+// deliverDue claims a batch of the webhooks due at now and delivers them,
+// rescheduling those that fail.
+func deliverDue(ctx context.Context, db database.KeyStore, client *http.Client, now time.Time) {
+	// long enough to work through the whole batch
+	lease := now.Add((webhookBatch + 1) * webhookTimeout)
+	webhooks, err := db.ClaimWebhooks(ctx, now.UnixMilli(), lease.UnixMilli(), webhookBatch)
+	if err != nil {
+		slog.Error("failed to read webhook outbox", "err", err)
+		return
+	}
+	for _, webhook := range webhooks {
+		err = deliverWebhook(ctx, client, webhook)
+		if ctx.Err() != nil {
+			// shutting down; the rest are picked up once their lease runs out
+			return
+		}
+		if err == nil {
+			err = db.DeleteWebhook(context.Background(), webhook.ID)
+			if err != nil {
+				slog.Error("failed to remove delivered webhook", "webhook", webhook.ID, "err", err)
+			}
+			continue
+		}
+		attempts := webhook.Attempts + 1
+		failed := attempts >= webhookAttempts
+		if failed {
+			slog.Warn("giving up on webhook", "webhook", webhook.ID, "url", webhook.URL, "err", err)
+		}
+		next := time.Now().Add(webhookBackoff(attempts)).UnixMilli()
+		retryErr := db.RetryWebhook(context.Background(), webhook.ID, next, failed, err.Error())
+		if retryErr != nil {
+			slog.Error("failed to reschedule webhook", "webhook", webhook.ID, "err", retryErr)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package handles
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lanelewis/rclone-proxy/database"
+)
+
+// webhookReceiver stands in for the server a webhook is sent to, answering
+// every request with status.
+type webhookReceiver struct {
+	status   int
+	lock     sync.Mutex
+	requests []receivedWebhook
+}
+
+type receivedWebhook struct {
+	header http.Header
+	body   []byte
+}
+
+func (h *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	h.lock.Lock()
+	h.requests = append(h.requests, receivedWebhook{r.Header.Clone(), body})
+	h.lock.Unlock()
+	w.WriteHeader(h.status)
+}
+
+func (h *webhookReceiver) received() []receivedWebhook {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([]receivedWebhook(nil), h.requests...)
+}
+
+// useWebhooks turns webhooks on with secret for the length of the test, and
+// lets them reach the loopback httptest servers.
+func useWebhooks(t *testing.T, secret string) {
+	oldSecret, oldAllowed := webhookSecret, webhookAllowed
+	SetWebhookSecret(secret)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	SetWebhookAllowedNetworks([]*net.IPNet{loopback})
+	t.Cleanup(func() { webhookSecret, webhookAllowed = oldSecret, oldAllowed })
+}
+
+// pending returns how many webhooks in db are due at at, and would be sent.
+func pending(t *testing.T, db database.KeyStore, at time.Time) int {
+	// a lease ending when it starts leaves them due
+	webhooks, err := db.ClaimWebhooks(context.Background(), at.UnixMilli(), at.UnixMilli(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(webhooks)
+}
+
+func TestDeliverWebhookSigned(t *testing.T) {
+	useWebhooks(t, "test-secret")
+	receiver := &webhookReceiver{status: http.StatusNoContent}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	db := database.NewMemoryStore()
+	payload := []byte(`{"Event":"upload","Path":"/files/root/a.txt"}`)
+	err := db.EnqueueWebhook(context.Background(), server.URL, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliverDue(context.Background(), db, webhookClient(), time.Now())
+
+	requests := receiver.received()
+	if len(requests) != 1 {
+		t.Fatalf("receiver got %d requests, want 1", len(requests))
+	}
+	got := requests[0]
+	if string(got.body) != string(payload) {
+		t.Errorf("body = %s, want %s", got.body, payload)
+	}
+	timestamp := got.header.Get(webhookTimestamp)
+	if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+		t.Errorf("%s = %q, want unix milliseconds", webhookTimestamp, timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte("test-secret"))
+	mac.Write([]byte(timestamp + "." + string(payload)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if signature := got.header.Get(webhookSignature); signature != want {
+		t.Errorf("%s = %q, want %q", webhookSignature, signature, want)
+	}
+	if delivery := got.header.Get(webhookDelivery); delivery != "1" {
+		t.Errorf("%s = %q, want the outbox ID 1", webhookDelivery, delivery)
+	}
+	if n := pending(t, db, time.UnixMilli(math.MaxInt64)); n != 0 {
+		t.Errorf("%d webhooks left in the outbox after delivery", n)
+	}
+}
+
+func TestDeliverWebhookRetriesUntilFailed(t *testing.T) {
+	useWebhooks(t, "test-secret")
+	receiver := &webhookReceiver{status: http.StatusBadGateway}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	db := database.NewMemoryStore()
+	err := db.EnqueueWebhook(context.Background(), server.URL, []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := webhookClient()
+	due := time.Now()
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		before := time.Now()
+		deliverDue(context.Background(), db, client, due)
+		after := time.Now()
+		if n := len(receiver.received()); n != attempt {
+			t.Fatalf("after attempt %d the receiver got %d requests", attempt, n)
+		}
+		if attempt == webhookAttempts {
+			break
+		}
+		wait := webhookBackoff(attempt)
+		if n := pending(t, db, before.Add(wait-time.Millisecond)); n != 0 {
+			t.Fatalf("after attempt %d the webhook was due again before %v", attempt, wait)
+		}
+		due = after.Add(wait)
+	}
+	if n := pending(t, db, time.UnixMilli(math.MaxInt64)); n != 0 {
+		t.Errorf("webhook still due after %d failed attempts", webhookAttempts)
+	}
+	deliverDue(context.Background(), db, client, time.UnixMilli(math.MaxInt64))
+	if n := len(receiver.received()); n != webhookAttempts {
+		t.Errorf("receiver got %d requests, want %d", n, webhookAttempts)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  webhookFirstRetry,
+		2:  2 * webhookFirstRetry,
+		3:  4 * webhookFirstRetry,
+		20: webhookMaxRetry,
+	} {
+		if got := webhookBackoff(attempts); got != want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestWebhookClientRefusesInternalAddresses(t *testing.T) {
+	useWebhooks(t, "test-secret")
+	webhookAllowed = nil
+	receiver := &webhookReceiver{status: http.StatusNoContent}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	_, err := webhookClient().Get(server.URL)
+	if !errors.Is(err, errWebhookAddress) {
+		t.Errorf("sending to %s: %v, want %v", server.URL, err, errWebhookAddress)
+	}
+	if n := len(receiver.received()); n != 0 {
+		t.Errorf("receiver got %d requests", n)
+	}
+	for raw, ok := range map[string]bool{
+		"https://hooks.example.org/upload": true,
+		"http://203.0.113.7:8080/":         true,
+		"http://localhost:8082/admin/":     false,
+		"http://127.0.0.1/":                false,
+		"http://[::1]/":                    false,
+		"http://10.1.2.3/":                 false,
+		"http://169.254.169.254/latest/":   false,
+		"ftp://hooks.example.org/":         false,
+	} {
+		if err := checkWebhookURL(raw); (err == nil) != ok {
+			t.Errorf("checkWebhookURL(%q) = %v", raw, err)
+		}
+	}
+}
+
+func TestReservationCommitsWebhook(t *testing.T) {
+	useWebhooks(t, "test-secret")
+	db := database.NewMemoryStore()
+	err := db.AddKey(context.Background(), database.KeySet{
+		KeyValue:    "webhook-test-key",
+		ExpireDelta: 1 << 40,
+		Endpoints: map[string]database.Endpoint{
+			"root": {Path: "/base", PutTypes: []string{"any"}, MaxPut: 2, MaxPutSize: 1 << 20, MaxTotalBytes: -1, Put: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := database.KeyID("webhook-test-key")
+	for _, success := range []bool{false, true} {
+		_, err = db.Reserve(context.Background(), keyID, "root", "Put")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reserved := &reservation{db: db, logger: slog.Default(), keyID: keyID, endpoint: "root", field: "Put",
+			webhookURL: "https://hooks.example.org/", event: UploadEvent{Event: "upload", Path: "/files/root/a.txt"}}
+		reserved.used = 12
+		reserved.finish(success)
+	}
+	webhooks, err := db.ClaimWebhooks(context.Background(), math.MaxInt64, math.MaxInt64, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(webhooks) != 1 {
+		t.Fatalf("%d webhooks enqueued for one failed and one successful upload, want 1", len(webhooks))
+	}
+	var event UploadEvent
+	err = json.Unmarshal(webhooks[0].Payload, &event)
+	if err != nil || event.Path != "/files/root/a.txt" || event.Size != 12 {
+		t.Errorf("enqueued %s, %v", webhooks[0].Payload, err)
+	}
+}
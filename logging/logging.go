@@ -0,0 +1,148 @@
+// Package logging sets up the structured logger the proxy writes through and
+// keeps the request ID of each request in its context, so that everything
+// logged while serving it can be tied together.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RequestIDHeader carries the request ID to clients and to the backend.
+const RequestIDHeader = "X-Request-ID"
+
+const redacted = "REDACTED"
+
+// sensitiveQuery are the query parameters whose values are never logged.
+var sensitiveQuery = []string{"X-Exius-Signature", "key", "token", "access_token", "password"}
+
+// sensitiveHeaders are the headers whose values are never logged.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "X-Exius-Key", "Cookie", "Set-Cookie"}
+
+// sensitiveAttrs are the attribute names whose values are never logged.
+var sensitiveAttrs = []string{"key", "adminkey", "password", "secret", "token"}
+
+type contextKey int
+
+const requestIDKey contextKey = 0
+
+// Setup makes the default logger, which the log package also writes through,
+// log to w at level ("debug", "info", "warn" or "error", info if empty) as
+// format ("json" or "text", json if empty).
+func Setup(w io.Writer, level string, format string) error {
+	var lvl slog.Level
+	if level != "" {
+		err := lvl.UnmarshalText([]byte(level))
+		if err != nil {
+			return fmt.Errorf("unknown log level %q", level)
+		}
+	}
+	options := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redactAttr}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "json":
+		handler = slog.NewJSONHandler(w, options)
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	// lines from the log package, e.g. net/http's, come through at info and
+	// should not carry a timestamp of their own
+	log.SetFlags(0)
+	return nil
+}
+
+// WithRequestID returns ctx carrying the request ID id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID in ctx, or "" if it has none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// FromContext returns the default logger, tagged with the request ID of ctx
+// if it has one.
+func FromContext(ctx context.Context) *slog.Logger {
+	if id := RequestID(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// RedactURL returns u as a string with the values of sensitive query
+// parameters and any password replaced.
+func RedactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	clean := *u
+	if _, ok := clean.User.Password(); ok {
+		clean.User = url.UserPassword(clean.User.Username(), redacted)
+	}
+	if clean.RawQuery != "" {
+		query := clean.Query()
+		changed := false
+		for name := range query {
+			if isSensitive(sensitiveQuery, name) {
+				query[name] = []string{redacted}
+				changed = true
+			}
+		}
+		if changed {
+			clean.RawQuery = query.Encode()
+		}
+	}
+	return clean.String()
+}
+
+// RedactHeader returns a copy of h with the values of sensitive headers
+// replaced.
+func RedactHeader(h http.Header) http.Header {
+	clean := h.Clone()
+	for name := range clean {
+		if isSensitive(sensitiveHeaders, name) {
+			clean[name] = []string{redacted}
+		}
+	}
+	return clean
+}
+
+func isSensitive(names []string, name string) bool {
+	for _, sensitive := range names {
+		if strings.EqualFold(sensitive, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactAttr keeps keys out of the logs: URLs and headers are redacted
+// wherever they are logged, and attributes named like secrets are blanked.
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if isSensitive(sensitiveAttrs, attr.Key) {
+		return slog.String(attr.Key, redacted)
+	}
+	if attr.Value.Kind() != slog.KindAny {
+		return attr
+	}
+	switch value := attr.Value.Any().(type) {
+	case *url.URL:
+		return slog.String(attr.Key, RedactURL(value))
+	case url.URL:
+		return slog.String(attr.Key, RedactURL(&value))
+	case http.Header:
+		return slog.Any(attr.Key, RedactHeader(value))
+	}
+	return attr
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/lanelewis/rclone-proxy/config"
+	"github.com/lanelewis/rclone-proxy/database"
+)
+
+// runMigrate inspects or changes the schema of the configured key store, e.g.
+// `rclone-proxy migrate status` or `rclone-proxy migrate down -steps 1`.
+func runMigrate(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: migrate status|up|down [-steps n] [-config file] [flags]")
+	}
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	steps := flags.Int("steps", 1, "number of migrations to revert with down")
+	cfg, err := config.LoadFlags(flags, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	database.SetKeyPepper(os.Getenv("KEY_PEPPER"))
+	database.SetTimeouts(cfg.Database.ConnectTimeout, cfg.Database.QueryTimeout)
+	db, err := database.OpenMigrator(cfg.Database.Driver, cfg.Database.URL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+	switch args[0] {
+	case "status":
+		states, err := db.MigrationStatus(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, state := range states {
+			status := "pending"
+			if state.Legacy {
+				status = "applied, not yet recorded"
+			} else if state.Applied {
+				status = "applied " + time.UnixMilli(state.AppliedAt).Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", state.Version, state.Name, status)
+		}
+	case "up":
+		applied, err := db.MigrateUp(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "down":
+		reverted, err := db.MigrateDown(ctx, *steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown migrate command %q", args[0])
+	}
+}
@@ -2,13 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/lanelewis/rclone-proxy/config"
 	"github.com/lanelewis/rclone-proxy/database"
 	"github.com/lanelewis/rclone-proxy/handles"
+	"github.com/lanelewis/rclone-proxy/logging"
 	"github.com/rs/cors"
 
 	"github.com/gorilla/mux"
@@ -18,199 +27,215 @@ import (
 //todo: change all to unsigned int
 // add ability for multiple rclone endpoints. Use inside endpoint and append to prefix
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		runConfig(os.Args[2:])
+		return
+	}
+	cfg, err := config.Load(os.Args[0], os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = logging.Setup(os.Stderr, cfg.Log.Level, cfg.Log.Format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = cfg.RegisterTypes()
+	if err != nil {
+		fatal(err)
+	}
+	handles.SetBackendURLs(cfg.Backend.WebDAV, cfg.Backend.Admin)
+	database.SetTimeouts(cfg.Database.ConnectTimeout, cfg.Database.QueryTimeout)
 	adminKey := os.Getenv("ADMINKEY")
-	url := os.Getenv("DATABASE_URL") //"postgres://postgres:postgres@db:5432/postgres"
+	handles.SetAdminKey(adminKey)
+	pepper := os.Getenv("KEY_PEPPER")
+	if pepper == "" {
+		// key ids would be plain hashes of the keys, open to offline guessing
+		fatal(errors.New("KEY_PEPPER is not set"))
+	}
+	database.SetKeyPepper(pepper)
+	presignSecret := os.Getenv("PRESIGN_SECRET")
+	if presignSecret == "" {
+		slog.Warn("PRESIGN_SECRET is not set, presigned URLs stop working on restart")
+	}
+	err = handles.SetPresignSecret(presignSecret)
+	if err != nil {
+		fatal(err)
+	}
+	if cfg.Webhooks.Enabled {
+		handles.SetWebhookSecret(os.Getenv("WEBHOOK_SECRET"))
+	}
+	webhookNetworks, err := cfg.WebhookNetworks()
+	if err != nil {
+		fatal(err)
+	}
+	handles.SetWebhookAllowedNetworks(webhookNetworks)
 	//err := database.DestroyDB(url)
-	db, err := database.BuildDB(url)
-	database.ClearExpiredKeys(db)
+	store, err := database.OpenStore(cfg.Database.Driver, cfg.Database.URL)
 	if err != nil {
-		log.Fatal(err)
+		fatal(err)
+	}
+	db := database.InstrumentedStore{KeyStore: store}
+	database.RegisterKeyCount(db)
+	// cancelled on SIGTERM or ^C to start shutting down
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		database.ClearExpiredKeys(ctx, db, cfg.ExpiredKeySweep)
+	}()
+	if cfg.Webhooks.Enabled {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			handles.RunWebhooks(ctx, db)
+		}()
 	}
 	//err = database.DeleteKey("1234", db)
 	err = database.AddAdmin(adminKey, db)
 	if err != nil {
 		if fmt.Sprint(err) == "admin key already exists" {
-			log.Println("admin already exists")
+			slog.Info("admin already exists")
 		} else {
-			log.Fatal(err)
+			fatal(err)
 		}
 	} else {
-		log.Println("added admin key")
+		slog.Info("added admin key")
 	}
-	db.Conn.Close(context.Background())
-	router := mux.NewRouter()
-
-	router.PathPrefix("/files/").Methods("COPY").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			err = handles.AuthenticateAndRoute("Copy", db, w, r)
-			if err != nil {
-				log.Println("failed to COPY: ", r.URL, ".", err)
-				return
-			}
-		})
-
-	router.PathPrefix("/files/").Methods("DELETE").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			err = handles.AuthenticateAndRoute("Del", db, w, r)
-			if err != nil {
-				log.Println("failed to DELETE: ", r.URL, ".", err)
-				return
-			}
-		})
-
-	router.PathPrefix("/files/").Methods("GET").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			err = handles.AuthenticateAndRoute("Get", db, w, r)
-			if err != nil {
-				log.Println("failed to GET: ", r.URL, ".", err)
-				return
-			}
-		})
-
-	router.PathPrefix("/files/").Methods("HEAD").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			err = handles.AuthenticateAndRoute("Head", db, w, r)
-			if err != nil {
-				log.Println("failed to HEAD: ", r.URL, ".", err)
-				return
-			}
-		})
-
-	router.PathPrefix("/files/").Methods("LOCK").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			err = handles.AuthenticateAndRoute("Lock", db, w, r)
-			if err != nil {
-				log.Println("failed to LOCK: ", r.URL, ".", err)
-				return
-			}
-		})
-
-	router.PathPrefix("/files/").Methods("MKCOL").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			err = handles.AuthenticateAndRoute("Mkcol", db, w, r)
-			if err != nil {
-				log.Println("failed to MKCOL: ", r.URL, ".", err)
-				return
-			}
-		})
-
-	router.PathPrefix("/files/").Methods("MOVE").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			err = handles.AuthenticateAndRoute("Move", db, w, r)
-			if err != nil {
-				log.Println("failed to MOVE: ", r.URL, ".", err)
-				return
-			}
-		})
-
-	router.PathPrefix("/files/").Methods("OPTIONS").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			err = handles.AuthenticateAndRoute("Options", db, w, r)
-			if err != nil {
-				log.Println("failed to OPTIONS: ", r.URL, ".", err)
-				return
-			}
-		})
-
-	router.PathPrefix("/files/").Methods("POST").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			err = handles.AuthenticateAndRoute("Post", db, w, r)
-			if err != nil {
-				log.Println("failed to POST: ", r.URL, ".", err)
-				return
-			}
-		})
-
-	router.PathPrefix("/files/").Methods("PROPFIND").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			err = handles.AuthenticateAndRoute("Propfind", db, w, r)
-			if err != nil {
-				log.Println("failed to PROPFIND: ", r.URL, ".", err)
-				return
-			}
-		})
-
-	router.PathPrefix("/files/").Methods("PUT").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			err = handles.AuthenticateAndRoute("Put", db, w, r)
-			if err != nil {
-				log.Println("failed to PUT: ", r.URL, ".", err)
-				return
-			}
-		})
-
-	router.PathPrefix("/files/").Methods("TRACE").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			err = handles.AuthenticateAndRoute("Trace", db, w, r)
-			if err != nil {
-				log.Println("failed to TRACE: ", r.URL, ".", err)
-				return
-			}
-		})
-
-	router.PathPrefix("/files/").Methods("UNLOCK").HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			err = handles.AuthenticateAndRoute("Unlock", db, w, r)
-			if err != nil {
-				log.Println("failed to UNLOCK: ", r.URL, ".", err)
-				return
-			}
-		})
-
-	router.HandleFunc("/addKey", func(w http.ResponseWriter, r *http.Request) {
-		err = handles.AddKeyHandle(db, w, r)
-		if err != nil {
-			log.Println("failed to addKey:", r.URL, ".", err)
-			return
-		} else {
-			log.Println("successful addKey:", r.URL)
-		}
-	})
+	metricsHandler, err := handles.MetricsHandler(db, cfg.Metrics.Auth, os.Getenv("METRICS_TOKEN"))
+	if err != nil {
+		fatal(err)
+	}
+	root := mux.NewRouter()
+	root.Use(handles.RequestID)
+	root.Use(handles.Track)
+	// registered ahead of the middleware below, which would demand a key
+	root.Handle("/metrics", metricsHandler)
+	root.HandleFunc("/healthz", handles.HealthzHandle)
+	root.HandleFunc("/readyz", handles.ReadyzHandle(db))
+	router := root.NewRoute().Subrouter()
+	router.Use(handles.Metrics)
+	router.Use(handles.Audit(db))
+	// every route below needs a key, or for /files/ a presigned URL
+	router.Use(handles.Authenticate(db))
+
+	for _, route := range fileMethods {
+		router.PathPrefix("/files/").Methods(route.method).HandlerFunc(
+			handle(db, route.method, slog.LevelDebug, fileHandle(route.name)))
+	}
+	router.HandleFunc("/addKey", handle(db, "addKey", slog.LevelInfo, handles.AddKeyHandle))
+	router.HandleFunc("/getKey", handle(db, "getKey", slog.LevelInfo, handles.GetKeyHandle))
+	router.HandleFunc("/deleteKey", handle(db, "deleteKey", slog.LevelInfo, handles.DeleteKeyHandle))
+	router.HandleFunc("/updateKey", handle(db, "updateKey", slog.LevelInfo, handles.UpdateKeyHandle))
+	router.HandleFunc("/getChildKeys", handle(db, "getChildKeys", slog.LevelInfo, handles.GetChildrenHandle))
+	router.HandleFunc("/presign", handle(db, "presign", slog.LevelInfo, handles.PresignHandle))
+	router.HandleFunc("/audit", handle(db, "audit", slog.LevelInfo, handles.AuditHandle))
+	router.PathPrefix("/admin/").HandlerFunc(handle(db, "admin", slog.LevelInfo, handles.AdminHandle))
+	handler := cors.New(cors.Options{
+		AllowedOrigins:   cfg.CORS.AllowedOrigins,
+		AllowedMethods:   cfg.CORS.AllowedMethods,
+		AllowedHeaders:   cfg.CORS.AllowedHeaders,
+		ExposedHeaders:   cfg.CORS.ExposedHeaders,
+		AllowCredentials: cfg.CORS.AllowCredentials,
+		MaxAge:           cfg.CORS.MaxAge,
+	}).Handler(root)
+	srv := &http.Server{
+		Handler: handler,
+		Addr:    cfg.Listen,
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+	slog.Info("proxy server up", "addr", srv.Addr)
+	select {
+	case err = <-served:
+		fatal(err)
+	case <-ctx.Done():
+	}
+	stop()
+	shutdown(srv, store, &workers, cfg.ShutdownTimeout)
+}
 
-	router.HandleFunc("/getKey", func(w http.ResponseWriter, r *http.Request) {
-		err = handles.GetKeyHandle(db, w, r)
-		if err != nil {
-			log.Println("failed to getKey:", r.URL, ".", err)
-			return
-		} else {
-			log.Println("successful getKey:", r.URL)
-		}
-	})
+// shutdown stops srv taking connections and gives the requests in flight,
+// uploads most of all, until timeout to finish. Whatever is still running
+// then is cut off. The background workers are stopped before store is closed.
+func shutdown(srv *http.Server, store database.KeyStore, workers *sync.WaitGroup, timeout time.Duration) {
+	slog.Info("shutting down", "in_flight", handles.InFlight(), "timeout", timeout.String())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		cutOff := handles.InFlight()
+		srv.Close()
+		slog.Warn("shutdown timed out, cut off requests", "requests", cutOff)
+		// let the cut off handlers release their quota before the store goes
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		handles.WaitIdle(ctx)
+	}
+	workers.Wait()
+	err = store.Close()
+	if err != nil {
+		slog.Error("failed to close key store", "err", err)
+	}
+	slog.Info("shut down")
+}
 
-	router.HandleFunc("/deleteKey", func(w http.ResponseWriter, r *http.Request) {
-		err = handles.DeleteKeyHandle(db, w, r)
-		if err != nil {
-			log.Println("failed to deleteKey:", r.URL, ".", err)
-			return
-		} else {
-			log.Println("successful deleteKey:", r.URL)
-		}
-	})
+// fileMethods are the WebDAV methods served under /files/, with the names
+// AuthenticateAndRoute knows them by.
+var fileMethods = []struct{ method, name string }{
+	{"COPY", "Copy"},
+	{"DELETE", "Del"},
+	{"GET", "Get"},
+	{"HEAD", "Head"},
+	{"LOCK", "Lock"},
+	{"MKCOL", "Mkcol"},
+	{"MOVE", "Move"},
+	{"OPTIONS", "Options"},
+	{"POST", "Post"},
+	{"PROPFIND", "Propfind"},
+	{"PUT", "Put"},
+	{"TRACE", "Trace"},
+	{"UNLOCK", "Unlock"},
+}
 
-	router.HandleFunc("/getChildKeys", func(w http.ResponseWriter, r *http.Request) {
-		err = handles.GetChildrenHandle(db, w, r)
-		if err != nil {
-			log.Println("failed to getChildKeys:", r.URL, ".", err)
-			return
-		} else {
-			log.Println("successful getChildKeys", r.URL)
-		}
-	})
+func fileHandle(name string) func(database.KeyStore, http.ResponseWriter, *http.Request) error {
+	return func(db database.KeyStore, w http.ResponseWriter, r *http.Request) error {
+		return handles.AuthenticateAndRoute(name, db, w, r)
+	}
+}
 
-	router.PathPrefix("/admin/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		err = handles.AdminHandle(db, w, r)
+// handle serves a route with handler and logs how each request went,
+// successes at level.
+func handle(db database.KeyStore, name string, level slog.Level, handler func(database.KeyStore, http.ResponseWriter, *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// proxied requests have their URL pointed at the backend
+		requestURL := *r.URL
+		err := handler(db, w, r)
+		logger := logging.FromContext(r.Context())
 		if err != nil {
-			log.Println("failed to admin:", r.URL, ".", err)
+			logger.Warn("failed to "+name, "url", requestURL, "err", err)
 			return
-		} else {
-			log.Println("successful admin", r.URL)
 		}
-	})
-	handler := cors.AllowAll().Handler(router)
-	srv := &http.Server{
-		Handler: handler,
-		Addr:    "0.0.0.0:8080",
+		logger.Log(r.Context(), level, "successful "+name, "url", requestURL)
 	}
-	log.Println("proxy server up")
-	log.Fatal(srv.ListenAndServe())
+}
+
+// fatal logs err and exits.
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
 }
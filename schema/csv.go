@@ -0,0 +1,138 @@
+package schema
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+func (c *CSV) delimiter() rune {
+	switch c.Delimiter {
+	case "":
+		return ','
+	case "tab":
+		return '\t'
+	}
+	r, _ := utf8.DecodeRuneInString(c.Delimiter)
+	return r
+}
+
+func (column Column) columnType() string {
+	if column.Type == "" {
+		return "string"
+	}
+	return column.Type
+}
+
+// checkValue returns why value does not fit column, or "" if it does.
+func (column Column) checkValue(value string, pattern *regexp.Regexp) string {
+	if value == "" {
+		if column.Required {
+			return "value is required"
+		}
+		return ""
+	}
+	var err error
+	switch column.columnType() {
+	case "integer":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "number":
+		_, err = strconv.ParseFloat(value, 64)
+	case "boolean":
+		_, err = strconv.ParseBool(value)
+	case "date":
+		_, err = time.Parse("2006-01-02", value)
+	}
+	if err != nil {
+		return fmt.Sprintf("%q is not a valid %s", value, column.columnType())
+	}
+	if pattern != nil && !pattern.MatchString(value) {
+		return fmt.Sprintf("%q does not match %s", value, column.Pattern)
+	}
+	return ""
+}
+
+func (c *CSV) validate(r io.Reader) error {
+	patterns := make([]*regexp.Regexp, len(c.Columns))
+	for i, column := range c.Columns {
+		if column.Pattern != "" {
+			pattern, err := regexp.Compile("^(?:" + column.Pattern + ")$")
+			if err != nil {
+				return err
+			}
+			patterns[i] = pattern
+		}
+	}
+	reader := csv.NewReader(r)
+	reader.Comma = c.delimiter()
+	// field counts are reported as violations rather than stopping the read
+	reader.FieldsPerRecord = -1
+	result := &Error{}
+	records := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			result.add(Violation{Line: parseErr.Line, Message: parseErr.Err.Error()})
+			return result
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := reader.FieldPos(0)
+		records++
+		if !c.checkRecord(result, line, records == 1 && c.Header, record, patterns) {
+			break
+		}
+	}
+	if records == 0 {
+		result.add(Violation{Message: "file has no records"})
+	} else if records == 1 && c.Header {
+		result.add(Violation{Message: "file has a header but no records"})
+	}
+	if len(result.Errors) > 0 {
+		return result
+	}
+	return nil
+}
+
+// checkRecord adds the violations of one record to result, returning false
+// once result is full.
+func (c *CSV) checkRecord(result *Error, line int, header bool, record []string, patterns []*regexp.Regexp) bool {
+	for _, field := range record {
+		if !utf8.ValidString(field) {
+			return result.add(Violation{Line: line, Message: "record is not utf-8 text"})
+		}
+	}
+	if len(record) != len(c.Columns) {
+		return result.add(Violation{Line: line, Message: fmt.Sprintf("record has %d fields, want %d", len(record), len(c.Columns))})
+	}
+	for i, column := range c.Columns {
+		message := ""
+		if header {
+			name := record[i]
+			if i == 0 {
+				// spreadsheet exports often start with a byte order mark
+				name = strings.TrimPrefix(name, "\ufeff")
+			}
+			if name != column.Name {
+				message = fmt.Sprintf("header is %q, want %q", name, column.Name)
+			}
+		} else {
+			message = column.checkValue(record[i], patterns[i])
+		}
+		if message != "" && !result.add(Violation{Line: line, Column: column.Name, Message: message}) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,287 @@
+// Package schema checks the contents of an upload against the schema of its
+// endpoint: the columns of a CSV file, or a JSON Schema document for JSON.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Schema is the optional schema of an endpoint. With both CSV and JSON set,
+// uploads whose name ends in .json are checked against JSON and the rest
+// against CSV. With only one set, every upload is checked against it.
+type Schema struct {
+	CSV *CSV `json:",omitempty"`
+	// JSON is a JSON Schema document, draft 2020-12 unless it names another
+	// with $schema. References to other documents are not followed.
+	JSON json.RawMessage `json:",omitempty"`
+}
+
+// CSV describes the columns of a CSV upload.
+type CSV struct {
+	// Delimiter is a single character or "tab". It defaults to a comma.
+	Delimiter string `json:",omitempty"`
+	// Header requires the first record to hold the column names, in order.
+	Header  bool
+	Columns []Column
+}
+
+type Column struct {
+	Name string
+	// Type is string, integer, number, boolean or date (YYYY-MM-DD). It
+	// defaults to string.
+	Type string `json:",omitempty"`
+	// Required columns may not be empty.
+	Required bool
+	// Pattern is a regular expression the whole value must match, if set.
+	Pattern string `json:",omitempty"`
+}
+
+var columnTypes = []string{"", "string", "integer", "number", "boolean", "date"}
+
+// Violation is one reason an upload does not fit its schema. Line and Column
+// locate it in a CSV file, Pointer in a JSON document.
+type Violation struct {
+	Line    int    `json:",omitempty"`
+	Column  string `json:",omitempty"`
+	Pointer string `json:",omitempty"`
+	Message string
+}
+
+// maxViolations bounds how many violations are collected from one upload.
+const maxViolations = 100
+
+// Error lists the violations of an upload. Truncated is set if there were
+// more than are listed.
+type Error struct {
+	Errors    []Violation
+	Truncated bool
+}
+
+func (e *Error) Error() string {
+	if len(e.Errors) == 0 {
+		return "upload does not match schema"
+	}
+	return fmt.Sprintf("upload does not match schema: %s (%d errors)", e.Errors[0].Message, len(e.Errors))
+}
+
+func (e *Error) add(v Violation) bool {
+	if len(e.Errors) == maxViolations {
+		e.Truncated = true
+		return false
+	}
+	e.Errors = append(e.Errors, v)
+	return true
+}
+
+// Copy returns a deep copy of s, so decoding json over it leaves s alone.
+func (s *Schema) Copy() *Schema {
+	if s == nil {
+		return nil
+	}
+	c := &Schema{JSON: append(json.RawMessage(nil), s.JSON...)}
+	if s.CSV != nil {
+		csv := *s.CSV
+		csv.Columns = append([]Column(nil), s.CSV.Columns...)
+		c.CSV = &csv
+	}
+	if len(s.JSON) == 0 {
+		c.JSON = nil
+	}
+	return c
+}
+
+// Check reports whether s is a usable schema.
+func (s *Schema) Check() error {
+	if s == nil {
+		return nil
+	}
+	if s.CSV == nil && len(s.JSON) == 0 {
+		return errors.New("schema has neither CSV nor JSON")
+	}
+	if s.CSV != nil {
+		err := s.CSV.check()
+		if err != nil {
+			return fmt.Errorf("csv schema: %w", err)
+		}
+	}
+	if len(s.JSON) > 0 {
+		_, err := compileJSON(s.JSON)
+		if err != nil {
+			return fmt.Errorf("json schema: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *CSV) check() error {
+	if c.Delimiter != "" && c.Delimiter != "tab" && utf8.RuneCountInString(c.Delimiter) != 1 {
+		return errors.New("delimiter must be a single character or tab")
+	}
+	if len(c.Columns) == 0 {
+		return errors.New("no columns")
+	}
+	for _, column := range c.Columns {
+		valid := false
+		for _, t := range columnTypes {
+			if column.Type == t {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("column %s has unknown type %s", column.Name, column.Type)
+		}
+		if column.Pattern != "" {
+			_, err := regexp.Compile(column.Pattern)
+			if err != nil {
+				return fmt.Errorf("column %s: %w", column.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Within reports whether s accepts nothing parent rejects. Without a parent
+// schema anything is within. Otherwise s must have the same kinds of schema.
+// A CSV schema must have the same delimiter, header and column names and
+// types, and may make columns required or give patterns to columns that had
+// none. A JSON schema must equal the parent's, or combine it with allOf.
+func (s *Schema) Within(parent *Schema) bool {
+	if parent == nil {
+		return true
+	}
+	if s == nil {
+		return false
+	}
+	if (s.CSV == nil) != (parent.CSV == nil) || (len(s.JSON) == 0) != (len(parent.JSON) == 0) {
+		return false
+	}
+	if s.CSV != nil && !s.CSV.within(parent.CSV) {
+		return false
+	}
+	if len(s.JSON) > 0 && !jsonWithin(s.JSON, parent.JSON) {
+		return false
+	}
+	return true
+}
+
+func (c *CSV) within(parent *CSV) bool {
+	if c.delimiter() != parent.delimiter() || c.Header != parent.Header || len(c.Columns) != len(parent.Columns) {
+		return false
+	}
+	for i, column := range c.Columns {
+		parentColumn := parent.Columns[i]
+		if column.Name != parentColumn.Name || column.columnType() != parentColumn.columnType() {
+			return false
+		}
+		if parentColumn.Required && !column.Required {
+			return false
+		}
+		if parentColumn.Pattern != "" && column.Pattern != parentColumn.Pattern {
+			return false
+		}
+	}
+	return true
+}
+
+func jsonWithin(child json.RawMessage, parent json.RawMessage) bool {
+	var childDoc, parentDoc interface{}
+	if json.Unmarshal(child, &childDoc) != nil || json.Unmarshal(parent, &parentDoc) != nil {
+		return false
+	}
+	if reflect.DeepEqual(childDoc, parentDoc) {
+		return true
+	}
+	object, ok := childDoc.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	allOf, _ := object["allOf"].([]interface{})
+	for _, sub := range allOf {
+		if reflect.DeepEqual(sub, parentDoc) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileJSON(doc json.RawMessage) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.Draft = jsonschema.Draft2020
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("schema references %s, which is not allowed", url)
+	}
+	err := compiler.AddResource("endpoint.json", bytes.NewReader(doc))
+	if err != nil {
+		return nil, err
+	}
+	return compiler.Compile("endpoint.json")
+}
+
+// Validate checks an upload named filename against s. It returns an *Error
+// if the upload does not fit, and other errors only if it cannot be read.
+func (s *Schema) Validate(r io.Reader, filename string) error {
+	useJSON := len(s.JSON) > 0
+	if s.CSV != nil && useJSON {
+		useJSON = strings.HasSuffix(strings.ToLower(filename), ".json")
+	}
+	if useJSON {
+		return s.validateJSON(r)
+	}
+	return s.CSV.validate(r)
+}
+
+func (s *Schema) validateJSON(r io.Reader) error {
+	compiled, err := compileJSON(s.JSON)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var doc interface{}
+	err = dec.Decode(&doc)
+	var syntax *json.SyntaxError
+	if errors.As(err, &syntax) || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &Error{Errors: []Violation{{Message: fmt.Sprint("invalid json: ", err)}}}
+	}
+	if err != nil {
+		return err
+	}
+	if dec.More() {
+		return &Error{Errors: []Violation{{Message: "more than one json document"}}}
+	}
+	err = compiled.Validate(doc)
+	var invalid *jsonschema.ValidationError
+	if !errors.As(err, &invalid) {
+		return err
+	}
+	result := &Error{}
+	var leaves func(*jsonschema.ValidationError) bool
+	// only the leaves say what is actually wrong
+	leaves = func(ve *jsonschema.ValidationError) bool {
+		if len(ve.Causes) == 0 {
+			pointer := ve.InstanceLocation
+			if pointer == "" {
+				pointer = "/"
+			}
+			return result.add(Violation{Pointer: pointer, Message: ve.Message})
+		}
+		for _, cause := range ve.Causes {
+			if !leaves(cause) {
+				return false
+			}
+		}
+		return true
+	}
+	leaves(invalid)
+	return result
+}
@@ -0,0 +1,251 @@
+package schema
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var people = &Schema{CSV: &CSV{
+	Header: true,
+	Columns: []Column{
+		{Name: "name", Required: true},
+		{Name: "age", Type: "integer"},
+		{Name: "height", Type: "number"},
+		{Name: "member", Type: "boolean"},
+		{Name: "born", Type: "date"},
+		{Name: "code", Pattern: "[A-Z]{2}[0-9]+"},
+	},
+}}
+
+const peopleHeader = "name,age,height,member,born,code\n"
+
+// violations validates content named filename against s and returns what it
+// found wrong, failing the test on errors that are not an *Error.
+func violations(t *testing.T, s *Schema, content string, filename string) []Violation {
+	t.Helper()
+	err := s.Validate(strings.NewReader(content), filename)
+	if err == nil {
+		return nil
+	}
+	var invalid *Error
+	if !errors.As(err, &invalid) {
+		t.Fatalf("%q: %v is not a schema error", content, err)
+	}
+	if len(invalid.Errors) == 0 {
+		t.Fatalf("%q: schema error without violations", content)
+	}
+	return invalid.Errors
+}
+
+func TestCSVValid(t *testing.T) {
+	for _, content := range []string{
+		peopleHeader + "Ann,41,1.7,true,1983-02-01,AB12\n",
+		peopleHeader + "Bob,,,,,\n",
+		"\ufeff" + peopleHeader + "Ann,41,1.7,false,1983-02-01,ZZ0\n",
+	} {
+		if v := violations(t, people, content, "people.csv"); v != nil {
+			t.Errorf("%q: %v", content, v)
+		}
+	}
+}
+
+func TestCSVViolations(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content string
+		line    int
+		column  string
+		message string
+	}{
+		{"missing column", peopleHeader + "Ann,41,1.7,true,1983-02-01\n", 2, "", "record has 5 fields, want 6"},
+		{"wrong delimiter", strings.ReplaceAll(peopleHeader+"Ann;41;1.7;true;1983-02-01;AB1\n", ",", ";"), 1, "", "record has 1 fields, want 6"},
+		{"header order", "age,name,height,member,born,code\nAnn,41,1.7,true,1983-02-01,AB1\n", 1, "name", `header is "age", want "name"`},
+		{"no records", peopleHeader, 0, "", "file has a header but no records"},
+		{"empty", "", 0, "", "file has no records"},
+		{"required", peopleHeader + ",41,1.7,true,1983-02-01,AB1\n", 2, "name", "value is required"},
+		{"integer", peopleHeader + "Ann,4.1,1.7,true,1983-02-01,AB1\n", 2, "age", `"4.1" is not a valid integer`},
+		{"number", peopleHeader + "Ann,41,tall,true,1983-02-01,AB1\n", 2, "height", `"tall" is not a valid number`},
+		{"boolean", peopleHeader + "Ann,41,1.7,yes,1983-02-01,AB1\n", 2, "member", `"yes" is not a valid boolean`},
+		{"date", peopleHeader + "Ann,41,1.7,true,01/02/1983,AB1\n", 2, "born", `"01/02/1983" is not a valid date`},
+		{"pattern is anchored", peopleHeader + "Ann,41,1.7,true,1983-02-01,xAB1\n", 2, "code", `"xAB1" does not match [A-Z]{2}[0-9]+`},
+		{"quoting", peopleHeader + "Ann,\"41\n", 2, "", ""},
+	} {
+		v := violations(t, people, tt.content, "people.csv")
+		if len(v) == 0 {
+			t.Errorf("%s: no violations", tt.name)
+			continue
+		}
+		if v[0].Line != tt.line || v[0].Column != tt.column || (tt.message != "" && v[0].Message != tt.message) {
+			t.Errorf("%s: %+v, want line %d column %q %q", tt.name, v[0], tt.line, tt.column, tt.message)
+		}
+	}
+}
+
+func TestCSVDelimiter(t *testing.T) {
+	s := &Schema{CSV: &CSV{Delimiter: ";", Columns: []Column{{Name: "a"}, {Name: "b", Type: "integer"}}}}
+	if v := violations(t, s, "x;1\ny;2\n", "a.csv"); v != nil {
+		t.Errorf("semicolons: %v", v)
+	}
+	if v := violations(t, s, "x,1\ny,2\n", "a.csv"); len(v) != 2 {
+		t.Errorf("commas: %v, want a violation per record", v)
+	}
+	s.CSV.Delimiter = "tab"
+	if v := violations(t, s, "x\t1\n", "a.tsv"); v != nil {
+		t.Errorf("tabs: %v", v)
+	}
+}
+
+func TestCSVRejectsSpreadsheet(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, err := w.Create("xl/workbook.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(strings.Repeat("<sheet name=\"people\"/>", 50)))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := violations(t, people, buf.String(), "people.csv"); len(v) == 0 {
+		t.Error("an Excel workbook renamed to .csv passed")
+	}
+}
+
+func TestMaxViolations(t *testing.T) {
+	content := peopleHeader + strings.Repeat("Ann,x,1.7,true,1983-02-01,AB1\n", 2*maxViolations)
+	err := people.Validate(strings.NewReader(content), "people.csv")
+	var invalid *Error
+	if !errors.As(err, &invalid) {
+		t.Fatalf("%v is not a schema error", err)
+	}
+	if len(invalid.Errors) != maxViolations || !invalid.Truncated {
+		t.Errorf("%d violations, truncated %v, want %d and truncated", len(invalid.Errors), invalid.Truncated, maxViolations)
+	}
+	if last := invalid.Errors[maxViolations-1]; last.Line != maxViolations+1 {
+		t.Errorf("last violation on line %d, want %d", last.Line, maxViolations+1)
+	}
+}
+
+var order = json.RawMessage(`{
+	"type": "object",
+	"required": ["id", "items"],
+	"properties": {
+		"id": {"type": "integer"},
+		"items": {"type": "array", "items": {"type": "string"}}
+	}
+}`)
+
+func TestJSONViolations(t *testing.T) {
+	s := &Schema{JSON: order}
+	if v := violations(t, s, `{"id": 1, "items": ["a"]}`, "order.json"); v != nil {
+		t.Errorf("valid order: %v", v)
+	}
+	for _, tt := range []struct {
+		content string
+		pointer string
+	}{
+		{`{"id": "1", "items": []}`, "/id"},
+		{`{"id": 1, "items": ["a", 2]}`, "/items/1"},
+		{`{"id": 1}`, "/"},
+		{`{"id": 1, "items": [`, ""},
+		{`{"id": 1, "items": []} {}`, ""},
+		{``, ""},
+	} {
+		v := violations(t, s, tt.content, "order.json")
+		if len(v) == 0 || v[0].Pointer != tt.pointer {
+			t.Errorf("%q: %+v, want a violation at %q", tt.content, v, tt.pointer)
+		}
+	}
+}
+
+func TestValidatePicksSchemaByName(t *testing.T) {
+	s := &Schema{CSV: &CSV{Columns: []Column{{Name: "id", Type: "integer"}}}, JSON: order}
+	if v := violations(t, s, `{"id": 1, "items": []}`, "dir/ORDER.JSON"); v != nil {
+		t.Errorf("json checked against csv: %v", v)
+	}
+	if v := violations(t, s, "1\n2\n", "ids.csv"); v != nil {
+		t.Errorf("csv checked against json: %v", v)
+	}
+	if v := violations(t, &Schema{JSON: order}, "1\n2\n", "ids.csv"); len(v) == 0 {
+		t.Error("json only schema not applied to a .csv upload")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		schema *Schema
+		ok     bool
+	}{
+		{"none", nil, true},
+		{"people", people, true},
+		{"order", &Schema{JSON: order}, true},
+		{"empty", &Schema{}, false},
+		{"no columns", &Schema{CSV: &CSV{}}, false},
+		{"delimiter", &Schema{CSV: &CSV{Delimiter: ";;", Columns: []Column{{Name: "a"}}}}, false},
+		{"column type", &Schema{CSV: &CSV{Columns: []Column{{Name: "a", Type: "float"}}}}, false},
+		{"pattern", &Schema{CSV: &CSV{Columns: []Column{{Name: "a", Pattern: "("}}}}, false},
+		{"json", &Schema{JSON: json.RawMessage(`{"type": 3}`)}, false},
+		{"remote ref", &Schema{JSON: json.RawMessage(`{"$ref": "https://example.org/s.json"}`)}, false},
+	} {
+		if err := tt.schema.Check(); (err == nil) != tt.ok {
+			t.Errorf("%s: Check() = %v", tt.name, err)
+		}
+	}
+}
+
+func TestWithin(t *testing.T) {
+	csv := func(modify func(*CSV)) *Schema {
+		s := people.Copy()
+		modify(s.CSV)
+		return s
+	}
+	for _, tt := range []struct {
+		name   string
+		child  *Schema
+		parent *Schema
+		want   bool
+	}{
+		{"no parent", people, nil, true},
+		{"no child", nil, people, false},
+		{"same", people.Copy(), people, true},
+		{"required", csv(func(c *CSV) { c.Columns[1].Required = true }), people, true},
+		{"not required", csv(func(c *CSV) { c.Columns[0].Required = false }), people, false},
+		{"new pattern", csv(func(c *CSV) { c.Columns[0].Pattern = "[A-Z].*" }), people, true},
+		{"changed pattern", csv(func(c *CSV) { c.Columns[5].Pattern = ".*" }), people, false},
+		{"type", csv(func(c *CSV) { c.Columns[1].Type = "string" }), people, false},
+		{"default type", csv(func(c *CSV) { c.Columns[0].Type = "string" }), people, true},
+		{"renamed", csv(func(c *CSV) { c.Columns[0].Name = "first" }), people, false},
+		{"reordered", csv(func(c *CSV) { c.Columns[0], c.Columns[1] = c.Columns[1], c.Columns[0] }), people, false},
+		{"fewer columns", csv(func(c *CSV) { c.Columns = c.Columns[:5] }), people, false},
+		{"header", csv(func(c *CSV) { c.Header = false }), people, false},
+		{"delimiter", csv(func(c *CSV) { c.Delimiter = "tab" }), people, false},
+		{"comma", csv(func(c *CSV) { c.Delimiter = "," }), people, true},
+		{"json added", &Schema{CSV: people.CSV, JSON: order}, people, false},
+		{"json same", &Schema{JSON: json.RawMessage(`{"required": ["id", "items"], "type": "object", "properties": {"id": {"type": "integer"}, "items": {"type": "array", "items": {"type": "string"}}}}`)}, &Schema{JSON: order}, true},
+		{"json allOf", &Schema{JSON: json.RawMessage(`{"allOf": [` + string(order) + `, {"maxProperties": 2}]}`)}, &Schema{JSON: order}, true},
+		{"json anyOf", &Schema{JSON: json.RawMessage(`{"anyOf": [` + string(order) + `, {}]}`)}, &Schema{JSON: order}, false},
+		{"json other", &Schema{JSON: json.RawMessage(`{"type": "object"}`)}, &Schema{JSON: order}, false},
+	} {
+		if got := tt.child.Within(tt.parent); got != tt.want {
+			t.Errorf("%s: Within = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCopy(t *testing.T) {
+	c := people.Copy()
+	c.CSV.Columns[0].Name = "changed"
+	c.CSV.Header = false
+	if people.CSV.Columns[0].Name != "name" || !people.CSV.Header {
+		t.Error("changing a copy changed the original")
+	}
+	if (*Schema)(nil).Copy() != nil {
+		t.Error("copy of no schema is a schema")
+	}
+}